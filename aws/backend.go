@@ -1,11 +1,18 @@
 package aws
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
@@ -18,14 +25,19 @@ import (
 	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
 )
 
 type S3Backend struct {
-	bucketName  string
-	bucket      *s3.Bucket
-	cache       *urlcache.URLCache
-	presets     map[string]string
-	transformer *transformer.Transformer
+	bucketName       string
+	bucket           *s3.Bucket
+	cache            *urlcache.URLCache
+	partSize         int64
+	presets          map[string]string
+	presigner        *presigner // nil unless signed URLs are enabled
+	signedURLExpires time.Duration
+	store            variant.StoreConfig
+	transformer      *transformer.Transformer
 }
 
 func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*S3Backend, error) {
@@ -34,47 +46,130 @@ func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transfor
 		SecretKey: c.SecretKey,
 	}
 
-	s3o := s3.New(auth, aws.APNortheast)
-	return &S3Backend{
+	region := aws.APNortheast
+	if c.Region != "" {
+		r, ok := aws.Regions[c.Region]
+		if !ok {
+			return nil, errors.Errorf("aws backend: unknown region %s", c.Region)
+		}
+		region = r
+	}
+
+	partSize := c.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	} else if partSize < MinPartSize {
+		return nil, errors.Errorf("aws backend: 'PartSize' must be at least %d bytes", MinPartSize)
+	}
+
+	s3o := s3.New(auth, region)
+	b := &S3Backend{
 		bucket:      s3o.Bucket(c.BucketName),
 		bucketName:  c.BucketName,
 		cache:       cache,
+		partSize:    partSize,
 		presets:     presets,
+		store:       c.Store,
 		transformer: trans,
-	}, nil
+	}
+
+	if c.SignedURLExpires != 0 {
+		if c.SignedURLExpires < time.Second || c.SignedURLExpires > MaxSignedURLExpires {
+			return nil, errors.Errorf("aws backend: 'SignedURLExpires' must be between 1 second and %s", MaxSignedURLExpires)
+		}
+		if c.AccessKey == "" || c.SecretKey == "" {
+			return nil, errors.New("aws backend: 'AccessKey' and 'SecretKey' are required for signed URLs")
+		}
+
+		host := c.BucketName + ".s3." + region.Name + ".amazonaws.com"
+		if region.Name == "us-east-1" {
+			host = c.BucketName + ".s3.amazonaws.com"
+		}
+		b.presigner = &presigner{
+			accessKey: c.AccessKey,
+			secretKey: c.SecretKey,
+			host:      host,
+			region:    region.Name,
+		}
+		b.signedURLExpires = c.SignedURLExpires
+	}
+
+	return b, nil
+}
+
+// objectURL returns the URL to access the object at path. When signed
+// URLs are enabled, this is a presigned URL for the given method
+func (s *S3Backend) objectURL(method, path string) string {
+	if s.presigner == nil {
+		return "http://" + s.bucketName + ".s3.amazonaws.com" + path
+	}
+	return s.presigner.presign(method, path, time.Now(), s.signedURLExpires)
+}
+
+// makeSourcePath returns the path under which all variants of the
+// image at u are stored. Variants created with the options of signed
+// requests, which are kept in the fragment, are stored under a
+// directory named after the hash of the options
+func makeSourcePath(u *url.URL) string {
+	if u.Fragment == "" {
+		return "/" + u.Host + u.Path
+	}
+
+	h := sha256.Sum256([]byte(u.Fragment))
+	return "/" + u.Host + u.Path + "/~" + hex.EncodeToString(h[:8])
+}
+
+// makeStoragePath returns the path of the object holding the variant.
+// The hash of the preset's rule is included, so that a different
+// object is used when the rule changes
+func (s *S3Backend) makeStoragePath(preset string, u *url.URL) string {
+	return makeSourcePath(u) + "/" + preset + "/" + transformer.RuleHash(s.presets[preset])
+}
+
+func (s *S3Backend) makeCacheKey(preset string, u *url.URL) string {
+	return urlcache.MakeCacheKey("aws", preset, transformer.RuleHash(s.presets[preset]), u.String())
 }
 
 func (s *S3Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
-	cacheKey := urlcache.MakeCacheKey("aws", preset, u.String())
+	path := s.makeStoragePath(preset, u)
+	cacheKey := s.makeCacheKey(preset, u)
 	if cachedURL := s.cache.Lookup(ctx, cacheKey); cachedURL != "" {
 		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
 		if rand.Float32() < 0.25 {
 			log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
-			res, err := http.Head(cachedURL)
+			res, err := http.Head(s.objectURL(http.MethodHead, path))
+			if err == nil {
+				res.Body.Close()
+			}
 			if err != nil || res.StatusCode != http.StatusOK {
 				log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
 				s.cache.Delete(ctx, cacheKey)
 			}
 		}
 
-		return httputil.RedirectContent(cachedURL), nil
+		return httputil.RedirectContent(s.objectURL(http.MethodGet, path)), nil
 	}
 
 	// create the proper url
-	specificURL := "http://" + s.bucketName + ".s3.amazonaws.com/" + preset + u.Path
+	headURL := s.objectURL(http.MethodHead, path)
 
-	log.Debugf(ctx, "Making HEAD request to %s...", specificURL)
-	res, err := http.Head(specificURL)
+	log.Debugf(ctx, "Making HEAD request to %s...", headURL)
+	res, err := http.Head(headURL)
 	if err != nil {
-		return nil, errors.TransformationRequiredError{}
+		return nil, errors.Wrapf(err, `failed to make HEAD request for %s`, path)
 	}
+	res.Body.Close()
 
-	log.Debugf(ctx, "HEAD request for %s returns %d", specificURL, res.StatusCode)
-	if res.StatusCode != http.StatusOK {
+	log.Debugf(ctx, "HEAD request for %s returns %d", headURL, res.StatusCode)
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
 		return nil, errors.TransformationRequiredError{}
+	default:
+		return nil, errors.Errorf(`HEAD request for %s returned %d`, path, res.StatusCode)
 	}
 
-	return httputil.RedirectContent(specificURL), nil
+	return httputil.RedirectContent(s.objectURL(http.MethodGet, path)), nil
 }
 
 func (s *S3Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
@@ -90,49 +185,279 @@ func (s *S3Backend) StoreTransformedContent(ctx context.Context, u *url.URL) err
 		preset := preset
 		rule := rule
 		grp.Go(func() error {
+			st := t.TransformStream(ctx, rule, u.String())
+			defer st.Close()
+
+			// Variants that fit in a single part are uploaded in one go
 			buf := bbpool.Get()
 			defer bbpool.Release(buf)
 
-			var res transformer.Result
-			res.Content = buf
+			if _, err := io.CopyN(buf, st, s.partSize+1); err != io.EOF {
+				if err != nil {
+					return errors.Wrap(err, `failed to transform image`)
+				}
+				return s.putMulti(ctx, u, preset, rule, io.MultiReader(buf, st), st)
+			}
 
-			if err := t.Transform(ctx, rule, u.String(), &res); err != nil {
+			res, err := st.Result()
+			if err != nil {
 				return errors.Wrap(err, `failed to transform image`)
 			}
 
 			// good, done. save it to S3
-			path := "/" + preset + u.Path
-			log.Debugf(ctx, "Sending PUT to S3 %s...", path)
-			if err := s.bucket.PutReader(path, buf, res.Size, res.ContentType, s3.PublicRead, s3.Options{}); err != nil {
-				return errors.Wrapf(err, `failed to write data to %s`, path)
-			}
-			cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
-			specificURL := "http://" + s.bucketName + ".s3.amazonaws.com/" + preset + u.Path
-			s.cache.Set(ctx, cacheKey, specificURL)
-			return nil
+			return s.Put(ctx, u, preset, res.Metadata(preset, rule, u.String()), buf.Bytes())
 		})
 	}
 	return grp.Wait()
 }
 
+// Put stores already transformed content
+func (s *S3Backend) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	path := s.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Sending PUT to S3 %s...", path)
+	if err := s.bucket.PutReader(path, bytes.NewReader(content), int64(len(content)), md.ContentType, s.acl(), s.options(preset, md)); err != nil {
+		return errors.Storage(errors.Wrapf(err, `failed to write data to %s`, path))
+	}
+	s.setCache(ctx, preset, u, path)
+	return nil
+}
+
+// putMulti uploads content of unknown size using a multipart upload,
+// so that only a single part is held in memory at a time. The ETag of
+// the content is only known after all of it has been read, so it is
+// not stored in the object metadata
+func (s *S3Backend) putMulti(ctx context.Context, u *url.URL, preset, rule string, content io.Reader, st *transformer.Stream) error {
+	path := s.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Starting multipart upload to S3 %s...", path)
+
+	hdr, err := st.Header()
+	if err != nil {
+		return errors.Wrap(err, `failed to transform image`)
+	}
+	md := hdr.Metadata(preset, rule, u.String())
+
+	multi, err := s.bucket.InitMulti(path, md.ContentType, s.acl(), s.options(preset, md))
+	if err != nil {
+		return errors.Storage(errors.Wrapf(err, `failed to start multipart upload to %s`, path))
+	}
+
+	var parts []s3.Part
+	buf := make([]byte, s.partSize)
+	for n := 1; ; n++ {
+		l, err := io.ReadFull(content, buf)
+		if l > 0 {
+			part, err := multi.PutPart(n, bytes.NewReader(buf[:l]))
+			if err != nil {
+				multi.Abort()
+				return errors.Storage(errors.Wrapf(err, `failed to upload part %d of %s`, n, path))
+			}
+			parts = append(parts, part)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			multi.Abort()
+			return errors.Wrap(err, `failed to transform image`)
+		}
+	}
+
+	if _, err := st.Result(); err != nil {
+		multi.Abort()
+		return errors.Wrap(err, `failed to transform image`)
+	}
+
+	if err := multi.Complete(parts); err != nil {
+		multi.Abort()
+		return errors.Storage(errors.Wrapf(err, `failed to complete multipart upload to %s`, path))
+	}
+	s.setCache(ctx, preset, u, path)
+	return nil
+}
+
+func (s *S3Backend) acl() s3.ACL {
+	if s.presigner != nil {
+		// clients are given signed URLs instead
+		return s3.Private
+	}
+	return s3.PublicRead
+}
+
+// options returns the options for the object holding the variant
+func (s *S3Backend) options(preset string, md *variant.Metadata) s3.Options {
+	opts := s.store.Options(preset)
+	meta := make(map[string][]string)
+	for k, v := range md.ObjectMetadata(opts) {
+		meta[k] = []string{v}
+	}
+	return s3.Options{
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		Meta:               meta,
+		StorageClass:       s3.StorageClass(opts.StorageClass),
+	}
+}
+
+func (s *S3Backend) setCache(ctx context.Context, preset string, u *url.URL, path string) {
+	// The cached URL is only used as a marker when signed URLs
+	// are enabled, as the actual URL is signed on each request
+	s.cache.Set(ctx, s.makeCacheKey(preset, u), "http://"+s.bucketName+".s3.amazonaws.com"+path)
+}
+
+// HealthCheck makes sure that the bucket can be accessed
+func (s *S3Backend) HealthCheck(ctx context.Context) error {
+	if _, err := s.bucket.List("", "", "", 1); err != nil {
+		return errors.Wrapf(err, `failed to list objects in %s`, s.bucketName)
+	}
+	return nil
+}
+
+// ReadObject returns the content of the object whose key is p
+func (s *S3Backend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	path := "/" + strings.TrimPrefix(p, "/")
+	rdr, err := s.bucket.GetReader(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, path)
+	}
+	defer rdr.Close()
+
+	content, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, path)
+	}
+	return content, nil
+}
+
+// Stat returns the metadata stored along with the object
+func (s *S3Backend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	return s.stat(s.makeStoragePath(preset, u))
+}
+
+func (s *S3Backend) stat(path string) (*variant.Metadata, error) {
+	res, err := s.bucket.Head(path, nil)
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusNotFound {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch metadata for %s`, path)
+	}
+	res.Body.Close()
+
+	const metaPrefix = "x-amz-meta-"
+	values := make(map[string]string)
+	for name := range res.Header {
+		if lname := strings.ToLower(name); strings.HasPrefix(lname, metaPrefix) {
+			values[strings.TrimPrefix(lname, metaPrefix)] = res.Header.Get(name)
+		}
+	}
+
+	md := &variant.Metadata{
+		ContentType: res.Header.Get("Content-Type"),
+		Path:        path,
+		Size:        res.ContentLength,
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		md.Created = t
+	}
+	md.Decode(values)
+	return md, nil
+}
+
+// List returns the variants created from the image at u, which are
+// the objects named {preset}/{rule hash} under the source path of u
+func (s *S3Backend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	prefix := strings.TrimPrefix(makeSourcePath(u), "/") + "/"
+
+	var list []*variant.Metadata
+	err := s.walk(ctx, prefix, func(md *variant.Metadata) error {
+		// objects further down belong to other source URLs
+		if strings.Count(strings.TrimPrefix(md.Path, "/"+prefix), "/") != 1 {
+			return nil
+		}
+		if md.SourceURL != "" && md.SourceURL != u.String() {
+			return nil
+		}
+		list = append(list, md)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Walk calls fn for each object in the bucket. S3 does not return
+// object metadata in listings, so this makes a HEAD request for
+// each object
+func (s *S3Backend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	return s.walk(ctx, "", fn)
+}
+
+// walk calls fn for each object whose key starts with prefix
+func (s *S3Backend) walk(ctx context.Context, prefix string, fn variant.WalkFunc) error {
+	var marker string
+	for {
+		res, err := s.bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return errors.Wrap(err, `failed to list objects`)
+		}
+
+		for _, key := range res.Contents {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			md, err := s.stat("/" + key.Key)
+			if err != nil {
+				return errors.Wrapf(err, `failed to fetch metadata for %s`, key.Key)
+			}
+			if err := fn(md); err != nil {
+				return err
+			}
+			marker = key.Key
+		}
+
+		if !res.IsTruncated {
+			return nil
+		}
+		if res.NextMarker != "" {
+			marker = res.NextMarker
+		}
+	}
+}
+
+// Delete removes all the variants of the image at u, including those
+// created for presets or rules that are no longer configured. Objects
+// that are already gone are not an error
 func (s *S3Backend) Delete(ctx context.Context, u *url.URL) error {
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(s.presets))
+	// delete the cache regardless, because it's better to lose the
+	// cache than to accidentally have one linger
 	for preset := range s.presets {
+		s.cache.Delete(context.Background(), s.makeCacheKey(preset, u))
+	}
+
+	list, err := s.List(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, `error while deleting`)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(list))
+	for _, md := range list {
 		wg.Add(1)
-		go func(wg *sync.WaitGroup, preset string, errCh chan error) {
+		go func(wg *sync.WaitGroup, path string, errCh chan error) {
 			defer wg.Done()
-			path := "/" + preset + u.Path
 			log.Debugf(ctx, " + DELETE S3 entry %s\n", path)
 			err := s.bucket.Del(path)
+			if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusNotFound {
+				err = nil
+			}
 			if err != nil {
 				errCh <- err
 			}
-
-			// fallthrough here regardless, because it's better to lose the
-			// cache than to accidentally have one linger
-			s.cache.Delete(context.Background(), urlcache.MakeCacheKey(preset, u.String()))
-		}(&wg, preset, errCh)
+		}(&wg, md.Path, errCh)
 	}
 
 	wg.Wait()
@@ -0,0 +1,29 @@
+package aws
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeSourcePath(t *testing.T) {
+	u, _ := url.Parse("http://example.com/foo/bar.png")
+	if !assert.Equal(t, "/example.com/foo/bar.png", makeSourcePath(u), "path should match") {
+		return
+	}
+
+	// variants created with signed options go one level further down,
+	// so that they are not mixed up with the others
+	u.Fragment = "fp0.2:0.3"
+	p := makeSourcePath(u)
+	if !assert.True(t, strings.HasPrefix(p, "/example.com/foo/bar.png/~"), "path should be under the source path") {
+		return
+	}
+
+	u.Fragment = "fp0.4:0.3"
+	if !assert.NotEqual(t, p, makeSourcePath(u), "different options should have different paths") {
+		return
+	}
+}
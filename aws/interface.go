@@ -1,7 +1,25 @@
 package aws
 
+import (
+	"time"
+
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+const (
+	// DefaultPartSize is the default size of the parts that large
+	// variants are split into when uploading
+	DefaultPartSize = 8 << 20
+	// MinPartSize is the minimum part size allowed by S3
+	MinPartSize = 5 << 20
+)
+
 type Config struct {
-	AccessKey string
-	SecretKey string
-	BucketName string
+	AccessKey        string
+	SecretKey        string
+	BucketName       string
+	PartSize         int64               // variants larger than this are uploaded in parts of this size, using a multipart upload. Defaults to DefaultPartSize
+	Region           string              // defaults to ap-northeast-1
+	SignedURLExpires time.Duration       // if non-zero, objects are private and clients are redirected to presigned URLs valid for this long
+	Store            variant.StoreConfig // Cache-Control, storage class, etc. for stored objects
 }
@@ -0,0 +1,115 @@
+package aws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+)
+
+// MaxSignedURLExpires is the longest expiry that S3 accepts for
+// presigned URLs
+const MaxSignedURLExpires = 7 * 24 * time.Hour
+
+// presigner creates AWS Signature Version 4 presigned URLs. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+type presigner struct {
+	accessKey string
+	secretKey string
+	host      string
+	region    string
+}
+
+// presign returns a URL for path (which must start with a "/") that
+// is valid for the given duration, starting from now
+func (p *presigner) presign(method, path string, now time.Time, expires time.Duration) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + p.region + "/s3/aws4_request"
+
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {p.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(expires/time.Second), 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalPath := uriEncode(path, false)
+	canonicalQuery := canonicalQueryString(q)
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	buf.WriteString(method)
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalPath)
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalQuery)
+	buf.WriteString("\nhost:")
+	buf.WriteString(p.host)
+	buf.WriteString("\n\nhost\nUNSIGNED-PAYLOAD")
+	h := sha256.Sum256(buf.Bytes())
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+p.secretKey), date)
+	key = hmacSHA256(key, p.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "https://" + p.host + canonicalPath + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func canonicalQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			list = append(list, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(list, "&")
+}
+
+// uriEncode encodes s as required by AWS, which differs from
+// url.QueryEscape in that spaces are encoded as "%20"
+func uriEncode(s string, encodeSlash bool) string {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	const hexdigits = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hexdigits[c>>4])
+			buf.WriteByte(hexdigits[c&15])
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,771 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+// storageVersion is the version of the Blob service REST API that
+// we speak. Azurite supports this as well.
+const storageVersion = "2018-03-28"
+
+// metaPrefix is prepended to the names of user defined metadata
+const metaPrefix = "x-ms-meta-"
+
+type BlobBackend struct {
+	accountName string
+	accountKey  []byte
+	blockSize   int64
+	cache       *urlcache.URLCache
+	client      *http.Client
+	container   string
+	endpoint    string
+	prefix      string
+	presets     map[string]string
+	sasToken    url.Values
+	store       variant.StoreConfig
+	transformer *transformer.Transformer
+
+	signedURLExpires time.Duration // zero unless signed URLs are enabled
+}
+
+func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*BlobBackend, error) {
+	if c.Container == "" {
+		return nil, errors.New("azure backend: 'Container' is required")
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		if c.AccountName == "" {
+			return nil, errors.New("azure backend: either 'AccountName' or 'Endpoint' is required")
+		}
+		endpoint = "https://" + c.AccountName + ".blob.core.windows.net"
+	}
+
+	blockSize := c.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	} else if blockSize > MaxBlockSize {
+		return nil, errors.Errorf("azure backend: 'BlockSize' must be at most %d bytes", MaxBlockSize)
+	}
+
+	b := &BlobBackend{
+		accountName: c.AccountName,
+		blockSize:   blockSize,
+		cache:       cache,
+		client:      &http.Client{},
+		container:   c.Container,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		prefix:      c.Prefix,
+		presets:     presets,
+		store:       c.Store,
+		transformer: trans,
+	}
+
+	switch {
+	case c.SASToken != "":
+		v, err := url.ParseQuery(strings.TrimPrefix(c.SASToken, "?"))
+		if err != nil {
+			return nil, errors.Wrap(err, `azure backend: failed to parse 'SASToken'`)
+		}
+		b.sasToken = v
+	case c.AccountKey != "":
+		if c.AccountName == "" {
+			return nil, errors.New("azure backend: 'AccountName' is required when using 'AccountKey'")
+		}
+		key, err := base64.StdEncoding.DecodeString(c.AccountKey)
+		if err != nil {
+			return nil, errors.Wrap(err, `azure backend: failed to decode 'AccountKey'`)
+		}
+		b.accountKey = key
+	default:
+		return nil, errors.New("azure backend: either 'AccountKey' or 'SASToken' is required")
+	}
+
+	if c.SignedURLExpires != 0 {
+		// The SAS token given to us may allow writing as well, so it
+		// can't be handed out. Signatures are created with the key
+		if b.accountKey == nil {
+			return nil, errors.New("azure backend: 'AccountKey' is required when using 'SignedURLExpires'")
+		}
+		if c.SignedURLExpires < time.Second {
+			return nil, errors.New("azure backend: 'SignedURLExpires' must be at least 1 second")
+		}
+		b.signedURLExpires = c.SignedURLExpires
+	}
+
+	return b, nil
+}
+
+// makeSourcePath returns the path under which all variants of the
+// image at u are stored
+func (b *BlobBackend) makeSourcePath(u *url.URL) string {
+	// Create a path based on the SHA256 hash of this URL
+	h := sha256.New()
+	io.WriteString(h, u.String())
+	list := make([]string, 0, 3)
+	if b.prefix != "" {
+		list = append(list, b.prefix)
+	}
+	list = append(list, u.Host, hex.EncodeToString(h.Sum(nil)))
+	return path.Join(list...)
+}
+
+func (b *BlobBackend) makeStoragePath(preset string, u *url.URL) string {
+	// The hash of the rule is included, so that a different blob is
+	// used when the preset's rule changes
+	return path.Join(b.makeSourcePath(u), preset, transformer.RuleHash(b.presets[preset]))
+}
+
+func (b *BlobBackend) makeCacheKey(preset string, u *url.URL) string {
+	return urlcache.MakeCacheKey("azure", preset, transformer.RuleHash(b.presets[preset]), u.String())
+}
+
+// blobURL returns the public URL of the blob, which is what we
+// redirect clients to. If p is empty, the URL of the container
+// is returned
+func (b *BlobBackend) blobURL(p string) string {
+	if p == "" {
+		return b.endpoint + "/" + b.container
+	}
+	return b.endpoint + "/" + b.container + "/" + p
+}
+
+// objectURL returns the URL that clients are redirected to for the
+// blob at p. When signed URLs are enabled, this has a shared access
+// signature that allows reading the blob
+func (b *BlobBackend) objectURL(p string) string {
+	if b.signedURLExpires == 0 {
+		return b.blobURL(p)
+	}
+	return b.signedBlobURL(p, time.Now(), b.signedURLExpires)
+}
+
+func (b *BlobBackend) newRequest(ctx context.Context, method, p string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(b.blobURL(p))
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse blob url`)
+	}
+	if b.sasToken != nil {
+		u.RawQuery = b.sasToken.Encode()
+	}
+
+	var rdr io.Reader
+	if body != nil {
+		rdr = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, u.String(), rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create request`)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", storageVersion)
+	return req.WithContext(ctx), nil
+}
+
+// do signs the request if necessary, and sends it
+func (b *BlobBackend) do(req *http.Request) (*http.Response, error) {
+	if b.accountKey != nil {
+		req.Header.Set("Authorization", "SharedKey "+b.accountName+":"+b.sign(req))
+	}
+	return b.client.Do(req)
+}
+
+// sign computes the Shared Key signature of the request. See
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (b *BlobBackend) sign(req *http.Request) string {
+	var contentLength string
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	for _, s := range []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date. Always empty, as we use x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	} {
+		buf.WriteString(s)
+		buf.WriteByte('\n')
+	}
+
+	// Canonicalized headers
+	var names []string
+	for name := range req.Header {
+		if lname := strings.ToLower(name); strings.HasPrefix(lname, "x-ms-") {
+			names = append(names, lname)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(strings.TrimSpace(req.Header.Get(name)))
+		buf.WriteByte('\n')
+	}
+
+	// Canonicalized resource. Note that when talking to the emulator, the
+	// account name is also part of the path, and therefore appears twice
+	buf.WriteByte('/')
+	buf.WriteString(b.accountName)
+	buf.WriteString(req.URL.EscapedPath())
+
+	q := req.URL.Query()
+	var params []string
+	for name := range q {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := q[name]
+		sort.Strings(values)
+		buf.WriteByte('\n')
+		buf.WriteString(strings.ToLower(name))
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(values, ","))
+	}
+
+	h := hmac.New(sha256.New, b.accountKey)
+	h.Write(buf.Bytes())
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (b *BlobBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	p := b.makeStoragePath(preset, u)
+	cacheKey := b.makeCacheKey(preset, u)
+	if cachedURL := b.cache.Lookup(ctx, cacheKey); cachedURL != "" {
+		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
+		if rand.Float32() < 0.25 {
+			log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
+			// The container may not be public, so this is authorized
+			// like any other request to the storage
+			var status int
+			req, err := b.newRequest(ctx, http.MethodHead, p, nil)
+			if err == nil {
+				var res *http.Response
+				if res, err = b.do(req); err == nil {
+					res.Body.Close()
+					status = res.StatusCode
+				}
+			}
+			if err != nil || status != http.StatusOK {
+				log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
+				b.cache.Delete(ctx, cacheKey)
+			}
+		}
+
+		return httputil.RedirectContent(b.objectURL(p)), nil
+	}
+
+	req, err := b.newRequest(ctx, http.MethodHead, p, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create HEAD request`)
+	}
+
+	log.Debugf(ctx, "Making HEAD request to %s...", req.URL)
+	res, err := b.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to make HEAD request for %s`, p)
+	}
+	res.Body.Close()
+
+	log.Debugf(ctx, "HEAD request for %s returns %d", req.URL, res.StatusCode)
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errors.TransformationRequiredError{}
+	default:
+		return nil, errors.Errorf(`HEAD request for %s returned %d`, p, res.StatusCode)
+	}
+
+	return httputil.RedirectContent(b.objectURL(p)), nil
+}
+
+func (b *BlobBackend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+	log.Debugf(ctx, "BlobBackend: transforming image at url %s", u)
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	// Transformation is completely done by the transformer, so just
+	// hand it over to it
+	for preset, rule := range b.presets {
+		t := b.transformer
+		preset := preset
+		rule := rule
+		grp.Go(func() error {
+			st := t.TransformStream(ctx, rule, u.String())
+			defer st.Close()
+
+			// Variants that fit in a single block are uploaded in one go
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			if _, err := io.CopyN(buf, st, b.blockSize+1); err != io.EOF {
+				if err != nil {
+					return errors.Wrap(err, `failed to transform image`)
+				}
+				return b.putBlocks(ctx, u, preset, rule, io.MultiReader(buf, st), st)
+			}
+
+			res, err := st.Result()
+			if err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+
+			// good, done. save it to Azure
+			return b.Put(ctx, u, preset, res.Metadata(preset, rule, u.String()), buf.Bytes())
+		})
+	}
+	return grp.Wait()
+}
+
+// Put stores already transformed content
+func (b *BlobBackend) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	p := b.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Writing to Azure Blob Storage %s...", p)
+
+	req, err := b.newRequest(ctx, http.MethodPut, p, content)
+	if err != nil {
+		return errors.Wrap(err, `failed to create PUT request`)
+	}
+	req.Header.Set("Content-Type", md.ContentType)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	b.setBlobHeaders(req.Header, preset, md)
+
+	resp, err := b.do(req)
+	if err != nil {
+		return errors.Storage(errors.Wrapf(err, `failed to write data to %s`, p))
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Storage(errors.Errorf(`failed to write data to %s: %d`, p, resp.StatusCode))
+	}
+	return b.finishPut(ctx, u, preset, p)
+}
+
+// putBlocks uploads content of unknown size one block at a time, and
+// then commits the blocks along with the metadata, which is only known
+// after all of the content has been read. Blocks that are never
+// committed are discarded by Azure after a week
+func (b *BlobBackend) putBlocks(ctx context.Context, u *url.URL, preset, rule string, content io.Reader, st *transformer.Stream) error {
+	p := b.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Writing to Azure Blob Storage %s in blocks...", p)
+
+	var list blockList
+	buf := make([]byte, b.blockSize)
+	for n := 0; ; n++ {
+		l, err := io.ReadFull(content, buf)
+		if l > 0 {
+			// Block IDs must all be of the same length
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n)))
+			if err := b.putBlock(ctx, p, id, buf[:l]); err != nil {
+				return errors.Storage(errors.Wrapf(err, `failed to write block %d of %s`, n, p))
+			}
+			list.Latest = append(list.Latest, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, `failed to transform image`)
+		}
+	}
+
+	res, err := st.Result()
+	if err != nil {
+		return errors.Wrap(err, `failed to transform image`)
+	}
+	md := res.Metadata(preset, rule, u.String())
+
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode block list`)
+	}
+
+	req, err := b.newRequest(ctx, http.MethodPut, p, append([]byte(xml.Header), body...))
+	if err != nil {
+		return errors.Wrap(err, `failed to create put block list request`)
+	}
+	q := req.URL.Query()
+	q.Set("comp", "blocklist")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("x-ms-blob-content-type", md.ContentType)
+	b.setBlobHeaders(req.Header, preset, md)
+
+	resp, err := b.do(req)
+	if err != nil {
+		return errors.Storage(errors.Wrapf(err, `failed to commit blocks of %s`, p))
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Storage(errors.Errorf(`failed to commit blocks of %s: %d`, p, resp.StatusCode))
+	}
+	return b.finishPut(ctx, u, preset, p)
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+func (b *BlobBackend) putBlock(ctx context.Context, p, id string, content []byte) error {
+	req, err := b.newRequest(ctx, http.MethodPut, p, content)
+	if err != nil {
+		return errors.Wrap(err, `failed to create put block request`)
+	}
+	q := req.URL.Query()
+	q.Set("comp", "block")
+	q.Set("blockid", id)
+	req.URL.RawQuery = q.Encode()
+
+	res, err := b.do(req)
+	if err != nil {
+		return errors.Wrap(err, `failed to send put block request`)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return errors.Errorf(`unexpected response to put block request: %d`, res.StatusCode)
+	}
+	return nil
+}
+
+// setBlobHeaders sets the headers for the properties and metadata
+// of the blob holding the variant
+func (b *BlobBackend) setBlobHeaders(h http.Header, preset string, md *variant.Metadata) {
+	opts := b.store.Options(preset)
+	if opts.CacheControl != "" {
+		h.Set("x-ms-blob-cache-control", opts.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		h.Set("x-ms-blob-content-disposition", opts.ContentDisposition)
+	}
+	for k, v := range md.ObjectMetadata(opts) {
+		h.Set(metaPrefix+k, v)
+	}
+}
+
+// finishPut is called once the blob holding the variant is stored
+func (b *BlobBackend) finishPut(ctx context.Context, u *url.URL, preset, p string) error {
+	if tier := b.store.Options(preset).StorageClass; tier != "" {
+		if err := b.setTier(ctx, p, tier); err != nil {
+			return errors.Storage(errors.Wrapf(err, `failed to set access tier of %s`, p))
+		}
+	}
+
+	// The cached URL is only used as a marker when signed URLs are
+	// enabled, as the actual URL is signed on each request
+	b.cache.Set(ctx, b.makeCacheKey(preset, u), b.blobURL(p))
+	return nil
+}
+
+// setTier sets the access tier (Hot, Cool, or Archive) of the blob.
+// Put Blob only accepts the tier in newer versions of the API than
+// what we speak, so this is done separately
+func (b *BlobBackend) setTier(ctx context.Context, p, tier string) error {
+	req, err := b.newRequest(ctx, http.MethodPut, p, nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create set tier request`)
+	}
+	q := req.URL.Query()
+	q.Set("comp", "tier")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("x-ms-access-tier", tier)
+
+	res, err := b.do(req)
+	if err != nil {
+		return errors.Wrap(err, `failed to send set tier request`)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	default:
+		return errors.Errorf(`unexpected response to set tier request: %d`, res.StatusCode)
+	}
+}
+
+// HealthCheck makes sure that the container can be accessed
+func (b *BlobBackend) HealthCheck(ctx context.Context) error {
+	req, err := b.newRequest(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create list request`)
+	}
+
+	q := req.URL.Query()
+	q.Set("restype", "container")
+	q.Set("comp", "list")
+	q.Set("maxresults", "1")
+	req.URL.RawQuery = q.Encode()
+
+	res, err := b.do(req)
+	if err != nil {
+		return errors.Wrap(err, `failed to list blobs`)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf(`failed to list blobs in %s: %d`, b.container, res.StatusCode)
+	}
+	return nil
+}
+
+// ReadObject returns the content of the blob named p
+func (b *BlobBackend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	req, err := b.newRequest(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create GET request`)
+	}
+
+	res, err := b.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, p)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(`failed to read %s: %d`, p, res.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, p)
+	}
+	return content, nil
+}
+
+// Stat returns the metadata stored along with the blob
+func (b *BlobBackend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	p := b.makeStoragePath(preset, u)
+	req, err := b.newRequest(ctx, http.MethodHead, p, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create HEAD request`)
+	}
+
+	res, err := b.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to fetch metadata for %s`, p)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errors.TransformationRequiredError{}
+	default:
+		return nil, errors.Errorf(`failed to fetch metadata for %s: %d`, p, res.StatusCode)
+	}
+
+	values := make(map[string]string)
+	for name := range res.Header {
+		if lname := strings.ToLower(name); strings.HasPrefix(lname, metaPrefix) {
+			values[strings.TrimPrefix(lname, metaPrefix)] = res.Header.Get(name)
+		}
+	}
+
+	md := &variant.Metadata{
+		ContentType: res.Header.Get("Content-Type"),
+		Path:        p,
+		Size:        res.ContentLength,
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		md.Created = t
+	}
+	md.Decode(values)
+	return md, nil
+}
+
+// listBlobsResult is the response of the List Blobs operation. See
+// https://docs.microsoft.com/en-us/rest/api/storageservices/list-blobs
+type listBlobsResult struct {
+	Blobs []struct {
+		Name       string
+		Properties struct {
+			ContentLength int64  `xml:"Content-Length"`
+			ContentType   string `xml:"Content-Type"`
+			LastModified  string `xml:"Last-Modified"`
+		}
+		Metadata struct {
+			Items []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		}
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+// List returns the variants created from the image at u, which are
+// the blobs under the source path of u
+func (b *BlobBackend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	var list []*variant.Metadata
+	err := b.walk(ctx, b.makeSourcePath(u)+"/", func(md *variant.Metadata) error {
+		if md.SourceURL == "" || md.SourceURL == u.String() {
+			list = append(list, md)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Walk calls fn for each blob under the configured prefix
+func (b *BlobBackend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	var prefix string
+	if b.prefix != "" {
+		prefix = b.prefix + "/"
+	}
+	return b.walk(ctx, prefix, fn)
+}
+
+// walk calls fn for each blob whose name starts with prefix
+func (b *BlobBackend) walk(ctx context.Context, prefix string, fn variant.WalkFunc) error {
+	var marker string
+	for {
+		req, err := b.newRequest(ctx, http.MethodGet, "", nil)
+		if err != nil {
+			return errors.Wrap(err, `failed to create list request`)
+		}
+
+		q := req.URL.Query()
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("include", "metadata")
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		res, err := b.do(req)
+		if err != nil {
+			return errors.Wrap(err, `failed to list blobs`)
+		}
+
+		var result listBlobsResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.Errorf(`failed to list blobs: %d`, res.StatusCode)
+		}
+		if err != nil {
+			return errors.Wrap(err, `failed to decode blob list`)
+		}
+
+		for _, blob := range result.Blobs {
+			values := make(map[string]string)
+			for _, item := range blob.Metadata.Items {
+				values[strings.ToLower(item.XMLName.Local)] = item.Value
+			}
+
+			md := &variant.Metadata{
+				ContentType: blob.Properties.ContentType,
+				Path:        blob.Name,
+				Size:        blob.Properties.ContentLength,
+			}
+			if t, err := http.ParseTime(blob.Properties.LastModified); err == nil {
+				md.Created = t
+			}
+			md.Decode(values)
+
+			if err := fn(md); err != nil {
+				return err
+			}
+		}
+
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// Delete removes all the variants of the image at u, including those
+// created for presets or rules that are no longer configured. Blobs
+// that are already gone are not an error
+func (b *BlobBackend) Delete(ctx context.Context, u *url.URL) error {
+	// delete the cache regardless, because it's better to lose the
+	// cache than to accidentally have one linger
+	for preset := range b.presets {
+		b.cache.Delete(ctx, b.makeCacheKey(preset, u))
+	}
+
+	list, err := b.List(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, `deleting from azure blob storage`)
+	}
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	for _, md := range list {
+		p := md.Path
+		grp.Go(func() error {
+			log.Debugf(ctx, " + DELETE Azure Blob Storage entry %s\n", p)
+
+			req, err := b.newRequest(ctx, http.MethodDelete, p, nil)
+			if err != nil {
+				return errors.Wrap(err, `failed to create DELETE request`)
+			}
+
+			res, err := b.do(req)
+			if err != nil {
+				return errors.Wrapf(err, `failed to delete %s`, p)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNotFound {
+				return errors.Errorf(`failed to delete %s: %d`, p, res.StatusCode)
+			}
+			return nil
+		})
+	}
+
+	return errors.Wrap(grp.Wait(), `deleting from azure blob storage`)
+}
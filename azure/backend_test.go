@@ -0,0 +1,384 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// This is the well known key for the storage emulator (Azurite)
+const devstoreKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestNewBackend(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     Config
+		error bool
+	}{
+		{"missing container", Config{AccountName: "foo", AccountKey: devstoreKey}, true},
+		{"missing credentials", Config{AccountName: "foo", Container: "bar"}, true},
+		{"missing account name", Config{Container: "bar", AccountKey: devstoreKey}, true},
+		{"bad account key", Config{AccountName: "foo", Container: "bar", AccountKey: "!!!"}, true},
+		{"shared key", Config{AccountName: "foo", Container: "bar", AccountKey: devstoreKey}, false},
+		{"sas", Config{Endpoint: "http://127.0.0.1:10000/devstoreaccount1", Container: "bar", SASToken: "?sv=2018-03-28&sig=abc"}, false},
+		{"block size too large", Config{AccountName: "foo", Container: "bar", AccountKey: devstoreKey, BlockSize: MaxBlockSize + 1}, true},
+		{"signed urls", Config{AccountName: "foo", Container: "bar", AccountKey: devstoreKey, SignedURLExpires: time.Hour}, false},
+		{"signed urls with sas", Config{Endpoint: "http://127.0.0.1:10000/devstoreaccount1", Container: "bar", SASToken: "?sv=2018-03-28&sig=abc", SignedURLExpires: time.Hour}, true},
+		{"signed url expiry too short", Config{AccountName: "foo", Container: "bar", AccountKey: devstoreKey, SignedURLExpires: time.Millisecond}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBackend(&tt.c, nil, nil, nil)
+			if tt.error {
+				assert.Error(t, err, "NewBackend should fail")
+			} else {
+				assert.NoError(t, err, "NewBackend should succeed")
+			}
+		})
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if r.URL.Path != "/devstoreaccount1/images/small/example.com/foo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	b, err := NewBackend(&Config{
+		AccountName: "devstoreaccount1",
+		AccountKey:  devstoreKey,
+		Container:   "images",
+		Endpoint:    srv.URL + "/devstoreaccount1/",
+	}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	req, err := b.newRequest(context.Background(), http.MethodPut, "small/example.com/foo", []byte("Hello, World!"))
+	if !assert.NoError(t, err, "newRequest should succeed") {
+		return
+	}
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	res, err := b.do(req)
+	if !assert.NoError(t, err, "do should succeed") {
+		return
+	}
+	res.Body.Close()
+
+	if !assert.Equal(t, http.StatusCreated, res.StatusCode, "status should be 201") {
+		return
+	}
+
+	stringToSign := "PUT\n\n\n13\n\nimage/png\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:" + req.Header.Get("x-ms-date") + "\n" +
+		"x-ms-version:" + storageVersion + "\n" +
+		"/devstoreaccount1/devstoreaccount1/images/small/example.com/foo"
+	key, _ := base64.StdEncoding.DecodeString(devstoreKey)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+
+	if !assert.Equal(t, "SharedKey devstoreaccount1:"+base64.StdEncoding.EncodeToString(h.Sum(nil)), authorization, "signature should match") {
+		return
+	}
+}
+
+func TestSignedBlobURL(t *testing.T) {
+	b, err := NewBackend(&Config{
+		AccountName:      "devstoreaccount1",
+		AccountKey:       devstoreKey,
+		Container:        "images",
+		Endpoint:         "http://127.0.0.1:10000/devstoreaccount1",
+		SignedURLExpires: time.Hour,
+	}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	now := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	signed, err := url.Parse(b.signedBlobURL("example.com/abc/small/0123abcd", now, time.Hour))
+	if !assert.NoError(t, err, "signed URL should be valid") {
+		return
+	}
+	if !assert.Equal(t, "/devstoreaccount1/images/example.com/abc/small/0123abcd", signed.Path, "path should match") {
+		return
+	}
+
+	q := signed.Query()
+	if !assert.Equal(t, "r", q.Get("sp"), "signature should only allow reading") {
+		return
+	}
+	if !assert.Equal(t, "2019-01-02T04:04:05Z", q.Get("se"), "expiry should match") {
+		return
+	}
+	if !assert.Equal(t, "8x6f4zU2q2BlTmgrgwcpMXk2XgmmBNIy5C0kt5u82xg=", q.Get("sig"), "signature should match") {
+		return
+	}
+}
+
+func TestSASToken(t *testing.T) {
+	var query, authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	b, err := NewBackend(&Config{
+		Container: "images",
+		Endpoint:  srv.URL,
+		SASToken:  "?sv=2018-03-28&sig=abc",
+	}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	req, err := b.newRequest(context.Background(), http.MethodHead, "small/example.com/foo", nil)
+	if !assert.NoError(t, err, "newRequest should succeed") {
+		return
+	}
+
+	res, err := b.do(req)
+	if !assert.NoError(t, err, "do should succeed") {
+		return
+	}
+	res.Body.Close()
+
+	if !assert.Equal(t, "sig=abc&sv=2018-03-28", query, "SAS token should be sent") {
+		return
+	}
+	if !assert.Empty(t, authorization, "Authorization header should not be sent") {
+		return
+	}
+}
+
+func TestWalk(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/images" || q.Get("comp") != "list" || q.Get("prefix") != "sharaq/" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		if q.Get("marker") == "" {
+			io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="images">
+  <Blobs>
+    <Blob>
+      <Name>sharaq/small/abc</Name>
+      <Properties>
+        <Last-Modified>Sat, 01 Apr 2017 12:34:56 GMT</Last-Modified>
+        <Content-Length>1234</Content-Length>
+        <Content-Type>image/png</Content-Type>
+      </Properties>
+      <Metadata>
+        <preset>small</preset>
+        <sourceurl>http://example.com/foo.png</sourceurl>
+      </Metadata>
+    </Blob>
+  </Blobs>
+  <NextMarker>next</NextMarker>
+</EnumerationResults>`)
+			return
+		}
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="images">
+  <Blobs>
+    <Blob>
+      <Name>sharaq/big/def</Name>
+      <Properties>
+        <Content-Length>5678</Content-Length>
+      </Properties>
+    </Blob>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`)
+	}))
+	defer srv.Close()
+
+	b, err := NewBackend(&Config{
+		Container: "images",
+		Endpoint:  srv.URL,
+		Prefix:    "sharaq",
+		SASToken:  "?sv=2018-03-28&sig=abc",
+	}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	var list []*variant.Metadata
+	err = b.Walk(context.Background(), func(md *variant.Metadata) error {
+		list = append(list, md)
+		return nil
+	})
+	if !assert.NoError(t, err, "Walk should succeed") {
+		return
+	}
+	if !assert.Len(t, list, 2, "Walk should follow the marker") {
+		return
+	}
+
+	md := list[0]
+	if !assert.Equal(t, "sharaq/small/abc", md.Path, "path should match") {
+		return
+	}
+	if !assert.Equal(t, "small", md.Preset, "preset should match") {
+		return
+	}
+	if !assert.Equal(t, "http://example.com/foo.png", md.SourceURL, "source url should match") {
+		return
+	}
+	if !assert.Equal(t, int64(1234), md.Size, "size should match") {
+		return
+	}
+	if !assert.Equal(t, 2017, md.Created.Year(), "created should match") {
+		return
+	}
+}
+
+func TestList(t *testing.T) {
+	u, _ := url.Parse("http://example.com/foo.png")
+	var prefix string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix = r.URL.Query().Get("prefix")
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="images">
+  <Blobs>
+    <Blob>
+      <Name>sharaq/example.com/abc/small/def</Name>
+      <Metadata>
+        <preset>small</preset>
+        <sourceurl>http://example.com/foo.png</sourceurl>
+      </Metadata>
+    </Blob>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`)
+	}))
+	defer srv.Close()
+
+	b, err := NewBackend(&Config{
+		Container: "images",
+		Endpoint:  srv.URL,
+		Prefix:    "sharaq",
+		SASToken:  "?sv=2018-03-28&sig=abc",
+	}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	list, err := b.List(context.Background(), u)
+	if !assert.NoError(t, err, "List should succeed") {
+		return
+	}
+	if !assert.Equal(t, b.makeSourcePath(u)+"/", prefix, "List should only list the blobs for the URL") {
+		return
+	}
+	if !assert.Len(t, list, 1, "List should return 1 variant") {
+		return
+	}
+}
+
+func TestStoreInBlocks(t *testing.T) {
+	content := bytes.Repeat([]byte("sharaq"), 500)
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(content)
+	}))
+	defer src.Close()
+
+	var mu sync.Mutex
+	blocks := make(map[string][]byte)
+	var list blockList
+	var committed http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		switch q := r.URL.Query(); {
+		case r.Method == http.MethodPut && q.Get("comp") == "block":
+			blocks[q.Get("blockid")] = body
+		case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+			if err := xml.Unmarshal(body, &list); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			committed = r.Header
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return
+	}
+
+	b, err := NewBackend(&Config{
+		BlockSize: 1024,
+		Container: "images",
+		Endpoint:  srv.URL,
+		SASToken:  "?sv=2018-03-28&sig=abc",
+	}, cache, transformer.New(), map[string]string{"original": "0x0"})
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	u, _ := url.Parse(src.URL + "/foo.png")
+	if !assert.NoError(t, b.StoreTransformedContent(context.Background(), u), "StoreTransformedContent should succeed") {
+		return
+	}
+
+	if !assert.Len(t, list.Latest, 3, "content should be split into 3 blocks") {
+		return
+	}
+	var stored []byte
+	for _, id := range list.Latest {
+		stored = append(stored, blocks[id]...)
+	}
+	if !assert.Equal(t, content, stored, "blocks should hold the content") {
+		return
+	}
+
+	h := md5.Sum(content)
+	if !assert.Equal(t, "image/png", committed.Get("x-ms-blob-content-type"), "content type should be set") {
+		return
+	}
+	if !assert.Equal(t, hex.EncodeToString(h[:]), committed.Get(metaPrefix+"etag"), "metadata should be set") {
+		return
+	}
+}
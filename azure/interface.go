@@ -0,0 +1,31 @@
+package azure
+
+import (
+	"time"
+
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+const (
+	// DefaultBlockSize is the default size of the blocks that large
+	// variants are split into when uploading
+	DefaultBlockSize = 8 << 20
+	// MaxBlockSize is the maximum block size allowed by Azure
+	MaxBlockSize = 100 << 20
+)
+
+type Config struct {
+	AccountName string
+	AccountKey  string // base64 encoded shared key. Either this or SASToken is required
+	BlockSize   int64  // variants larger than this are uploaded in blocks of this size. Defaults to DefaultBlockSize
+	SASToken    string // shared access signature, with or without the leading "?"
+	Container   string
+	Prefix      string
+	Endpoint    string              // defaults to https://{AccountName}.blob.core.windows.net
+	Store       variant.StoreConfig // Cache-Control, access tier, etc. for stored blobs
+
+	// if non-zero, clients are redirected to blob URLs with a shared
+	// access signature valid for this long, so that the container does
+	// not have to be public. Requires AccountKey
+	SignedURLExpires time.Duration
+}
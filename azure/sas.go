@@ -0,0 +1,43 @@
+package azure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+)
+
+// sasTimeFormat is the format of the times in shared access signatures
+const sasTimeFormat = "2006-01-02T15:04:05Z"
+
+// signedBlobURL returns the URL of the blob at p with a service shared
+// access signature, which allows reading the blob for the given
+// duration, starting from now. See
+// https://docs.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (b *BlobBackend) signedBlobURL(p string, now time.Time, expires time.Duration) string {
+	expiry := now.UTC().Add(expires).Format(sasTimeFormat)
+
+	// permissions, start, expiry, resource, identifier, IP, protocol,
+	// version, and the response headers to override
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	buf.WriteString("r\n\n")
+	buf.WriteString(expiry)
+	buf.WriteString("\n/blob/" + b.accountName + "/" + b.container + "/" + p)
+	buf.WriteString("\n\n\n\n" + storageVersion + "\n\n\n\n\n")
+
+	h := hmac.New(sha256.New, b.accountKey)
+	h.Write(buf.Bytes())
+
+	q := url.Values{
+		"sv":  {storageVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expiry},
+		"sig": {base64.StdEncoding.EncodeToString(h.Sum(nil))},
+	}
+	return b.blobURL(p) + "?" + q.Encode()
+}
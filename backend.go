@@ -0,0 +1,201 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat-go/sharaq/aws"
+	"github.com/lestrrat-go/sharaq/azure"
+	"github.com/lestrrat-go/sharaq/fs"
+	"github.com/lestrrat-go/sharaq/gcp"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/memory"
+	"github.com/lestrrat-go/sharaq/tiered"
+	"github.com/lestrrat-go/sharaq/variant"
+	"golang.org/x/net/context"
+)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+func init() {
+	RegisterBackend("aws", func(env *BackendEnv) (Backend, error) {
+		b, err := aws.NewBackend(&env.config.Amazon, env.cache, env.transformer, env.presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create aws backend`)
+		}
+		return b, nil
+	})
+	RegisterBackend("azure", func(env *BackendEnv) (Backend, error) {
+		b, err := azure.NewBackend(&env.config.Azure, env.cache, env.transformer, env.presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create azure backend`)
+		}
+		return b, nil
+	})
+	RegisterBackend("gcp", func(env *BackendEnv) (Backend, error) {
+		b, err := gcp.NewBackend(&env.config.Google, env.cache, env.transformer, env.presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create gcp backend`)
+		}
+		return b, nil
+	})
+	RegisterBackend("fs", func(env *BackendEnv) (Backend, error) {
+		b, err := fs.NewBackend(&env.config.FileSystem, env.cache, env.transformer, env.presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create file system backend`)
+		}
+		return b, nil
+	})
+	RegisterBackend("memory", func(env *BackendEnv) (Backend, error) {
+		b, err := memory.NewBackend(&env.config.Memory, env.transformer, env.presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create memory backend`)
+		}
+		return b, nil
+	})
+	RegisterBackend("tiered", newTieredBackend)
+}
+
+type tieredConfig struct {
+	Local  BackendConfig // the tier that is checked first, e.g. "fs"
+	Remote BackendConfig // the tier holding everything, e.g. "aws"
+}
+
+func newTieredBackend(env *BackendEnv) (Backend, error) {
+	var c tieredConfig
+	if err := env.Decode(&c); err != nil {
+		return nil, errors.Wrap(err, `failed to decode tiered backend configuration`)
+	}
+
+	local, err := env.NewBackend(&c.Local)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create local tier`)
+	}
+
+	remote, err := env.NewBackend(&c.Remote)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create remote tier`)
+	}
+
+	b, err := tiered.NewBackend(local, remote, env.transformer, env.presets)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create tiered backend`)
+	}
+	return b, nil
+}
+
+// RegisterBackend makes a storage backend available under the given
+// name, which can then be used as the Backend.Type in the configuration.
+// It is meant to be called from the init function of the package
+// implementing the backend. RegisterBackend panics if the same name
+// is registered twice, or if factory is nil
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("sharaq: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("sharaq: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns a sorted list of the names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	list := make([]string, 0, len(backends))
+	for name := range backends {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Decode populates v using the configuration section for this backend.
+// The section is the object in the Backend configuration whose key
+// matches the backend type, e.g. `"Backend": { "Type": "foo", "foo": { ... } }`.
+// If no such section exists, v is left untouched
+func (e *BackendEnv) Decode(v interface{}) error {
+	for key, section := range e.config.sections {
+		if strings.EqualFold(key, e.config.Type) {
+			return errors.Wrapf(json.Unmarshal(section, v), `failed to decode configuration for backend %s`, e.config.Type)
+		}
+	}
+	return nil
+}
+
+// Cache returns the URL cache shared among backends
+func (e *BackendEnv) Cache() *urlcache.URLCache {
+	return e.cache
+}
+
+// Presets returns the preset name to transformation rule mapping
+func (e *BackendEnv) Presets() map[string]string {
+	return e.presets
+}
+
+// Transform fetches the image at u, applies the transformation
+// rule for the preset, and writes the result to dst. The metadata
+// of the transformed image is returned, which backends should store
+// so that it can be returned from Stat
+func (e *BackendEnv) Transform(ctx context.Context, preset, u string, dst io.Writer) (*variant.Metadata, error) {
+	rule, ok := e.presets[preset]
+	if !ok {
+		return nil, errors.Errorf(`unknown preset %s`, preset)
+	}
+
+	var res transformer.Result
+	res.Content = dst
+	if err := e.transformer.Transform(ctx, rule, u, &res); err != nil {
+		return nil, errors.Wrap(err, `failed to transform image`)
+	}
+	return res.Metadata(preset, rule, u), nil
+}
+
+// NewBackend creates a new backend from the given configuration,
+// sharing the same components as the current backend. This can be
+// used by backends that wrap other backends
+func (e *BackendEnv) NewBackend(c *BackendConfig) (Backend, error) {
+	backendsMu.RLock()
+	factory, ok := backends[c.Type]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf(`invalid storage backend %s`, c.Type)
+	}
+
+	return factory(&BackendEnv{
+		cache:       e.cache,
+		config:      c,
+		presets:     e.presets,
+		transformer: e.transformer,
+	})
+}
+
+func (c *BackendConfig) UnmarshalJSON(data []byte) error {
+	// Decode the well known fields first, and then keep everything
+	// around so that registered backends can decode their own section
+	type backendConfig BackendConfig
+	if err := json.Unmarshal(data, (*backendConfig)(c)); err != nil {
+		return err
+	}
+
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return err
+	}
+	c.sections = sections
+	return nil
+}
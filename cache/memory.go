@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Memory is a process local cache. It is mostly useful for tests,
+// and for running a single sharaq instance without external dependencies
+type Memory struct {
+	mu       sync.Mutex
+	items    map[string]memoryItem
+	maxItems int
+}
+
+// DefaultMemoryMaxItems is the number of items a Memory cache holds
+// when MaxItems is not configured
+const DefaultMemoryMaxItems = 10000
+
+type MemoryConfig struct {
+	MaxItems int
+}
+
+type MemoryOption interface {
+	Configure(*Memory)
+}
+
+type MemoryOptionFunc func(*Memory)
+
+func (f MemoryOptionFunc) Configure(m *Memory) {
+	f(m)
+}
+
+// WithMaxItems limits the number of items held in the cache. Once
+// the limit is reached, expired items are swept, and if that is not
+// enough, the items closest to expiring are dropped
+func WithMaxItems(n int) MemoryOption {
+	return MemoryOptionFunc(func(m *Memory) {
+		if n > 0 {
+			m.maxItems = n
+		}
+	})
+}
+
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemory(options ...MemoryOption) *Memory {
+	m := &Memory{
+		items:    make(map[string]memoryItem),
+		maxItems: DefaultMemoryMaxItems,
+	}
+	for _, o := range options {
+		o.Configure(m)
+	}
+	return m
+}
+
+func (it memoryItem) expired(now time.Time) bool {
+	return !it.expires.IsZero() && now.After(it.expires)
+}
+
+func (m *Memory) Get(_ context.Context, key string, value interface{}) error {
+	m.mu.Lock()
+	it, ok := m.items[key]
+	if ok && it.expired(time.Now()) {
+		delete(m.items, key)
+		ok = false
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return errors.New(`cache miss`)
+	}
+
+	switch value.(type) {
+	case *string:
+		s := value.(*string)
+		*s = string(it.value)
+	case *[]byte:
+		s := value.(*[]byte)
+		*s = append([]byte(nil), it.value...)
+	default:
+		return errors.New(`value must be &string or &[]byte`)
+	}
+
+	return nil
+}
+
+func (m *Memory) newItem(value []byte, expires int32) memoryItem {
+	it := memoryItem{value: append([]byte(nil), value...)}
+	if expires > 0 {
+		it.expires = time.Now().Add(time.Duration(expires) * time.Second)
+	}
+	return it
+}
+
+// makeRoom must be called while holding the lock
+func (m *Memory) makeRoom(key string) {
+	if _, ok := m.items[key]; ok || len(m.items) < m.maxItems {
+		return
+	}
+
+	now := time.Now()
+	for k, it := range m.items {
+		if it.expired(now) {
+			delete(m.items, k)
+		}
+	}
+
+	for len(m.items) >= m.maxItems {
+		var victim string
+		var victimExpires time.Time
+		for k, it := range m.items {
+			// items that never expire are only dropped when there is
+			// nothing else left to drop
+			if victim == "" || (!it.expires.IsZero() && (victimExpires.IsZero() || it.expires.Before(victimExpires))) {
+				victim = k
+				victimExpires = it.expires
+			}
+		}
+		delete(m.items, victim)
+	}
+}
+
+func (m *Memory) Set(_ context.Context, key string, value []byte, expires int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.makeRoom(key)
+	m.items[key] = m.newItem(value, expires)
+	return nil
+}
+
+func (m *Memory) SetNX(_ context.Context, key string, value []byte, expires int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if it, ok := m.items[key]; ok && !it.expired(time.Now()) {
+		return errors.New(`memory: setNX failed`)
+	}
+	m.makeRoom(key)
+	m.items[key] = m.newItem(value, expires)
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, key)
+	return nil
+}
@@ -0,0 +1,81 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var x string
+	c := cache.NewMemory()
+
+	key := "foo"
+	if !assert.Error(t, c.Get(ctx, key, &x), "Get should fail") {
+		return
+	}
+
+	if !assert.NoError(t, c.SetNX(ctx, key, []byte("Hello"), 10), "SetNX should succeed") {
+		return
+	}
+
+	if !assert.Error(t, c.SetNX(ctx, key, []byte("World"), 10), "SetNX should fail") {
+		return
+	}
+
+	if !assert.NoError(t, c.Get(ctx, key, &x), "Get should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, "Hello", x, "items should be equal") {
+		return
+	}
+
+	if !assert.NoError(t, c.Delete(ctx, key), "Delete should succeed") {
+		return
+	}
+
+	if !assert.Error(t, c.Get(ctx, key, &x), "Get should fail") {
+		return
+	}
+}
+
+func TestMemoryMaxItems(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewMemory(cache.WithMaxItems(2))
+
+	if !assert.NoError(t, c.Set(ctx, "forever", []byte("1"), 0), "Set should succeed") {
+		return
+	}
+	if !assert.NoError(t, c.Set(ctx, "soon", []byte("2"), 10), "Set should succeed") {
+		return
+	}
+	if !assert.NoError(t, c.Set(ctx, "later", []byte("3"), 60), "Set should succeed") {
+		return
+	}
+
+	var x string
+	if !assert.Error(t, c.Get(ctx, "soon", &x), "item closest to expiring should have been dropped") {
+		return
+	}
+	for _, key := range []string{"forever", "later"} {
+		if !assert.NoError(t, c.Get(ctx, key, &x), "Get should succeed for %s", key) {
+			return
+		}
+	}
+
+	// overwriting an existing key does not drop anything
+	if !assert.NoError(t, c.Set(ctx, "later", []byte("4"), 60), "Set should succeed") {
+		return
+	}
+	if !assert.NoError(t, c.Get(ctx, "forever", &x), "Get should succeed") {
+		return
+	}
+}
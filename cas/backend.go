@@ -0,0 +1,198 @@
+package cas
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+// Backend stores variants by the hash of the source image instead of
+// its URL, so that URLs pointing to the same image share the variants,
+// and the image is only transformed once. The URL cache maps each URL
+// to the hash of the image it points to.
+type Backend struct {
+	cache       *urlcache.URLCache
+	presets     map[string]string
+	storage     Storage
+	transformer *transformer.Transformer
+}
+
+func NewBackend(storage Storage, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*Backend, error) {
+	return &Backend{
+		cache:       cache,
+		presets:     presets,
+		storage:     storage,
+		transformer: trans,
+	}, nil
+}
+
+// URL returns the URL under which the variants of the source image
+// with the given hash are stored
+func URL(hash string) *url.URL {
+	return &url.URL{
+		Scheme: Scheme,
+		Host:   "sha256",
+		Path:   "/" + hash,
+	}
+}
+
+func makeCacheKey(u *url.URL) string {
+	return urlcache.MakeCacheKey("cas", u.String())
+}
+
+// resolve returns the URL that the variants of the image at u are
+// stored under, or nil if it is not known yet. URLs returned by
+// URL, such as those found in the metadata, are returned as is
+func (b *Backend) resolve(ctx context.Context, u *url.URL) *url.URL {
+	if u.Scheme == Scheme {
+		return u
+	}
+
+	if hash := b.cache.Lookup(ctx, makeCacheKey(u)); hash != "" {
+		return withOptions(URL(hash), u)
+	}
+	return nil
+}
+
+// withOptions returns cu with the options of signed requests, which
+// are kept in the fragment of u. Variants created with options are
+// stored separately from those created for the same image without them
+func withOptions(cu *url.URL, u *url.URL) *url.URL {
+	cu.Fragment = u.Fragment
+	return cu
+}
+
+func (b *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	cu := b.resolve(ctx, u)
+	if cu == nil {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return b.storage.Get(ctx, cu, preset)
+}
+
+// StoreTransformedContent fetches the image at u, and transforms it
+// for the presets whose variants have not been stored for an image
+// with the same content yet
+func (b *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+	log.Debugf(ctx, "cas backend: transforming image at url %s", u)
+
+	src, err := b.transformer.Fetch(ctx, u.String())
+	if err != nil {
+		return errors.Wrap(err, `failed to fetch image`)
+	}
+	cu := withOptions(URL(src.Hash), u)
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	for preset, rule := range b.presets {
+		preset := preset
+		rule := rule
+		grp.Go(func() error {
+			if _, err := b.storage.Stat(ctx, cu, preset); err == nil {
+				log.Debugf(ctx, "cas backend: %s (%s) is already stored as %s", u, preset, cu)
+				return nil
+			}
+
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+
+			if err := b.transformer.TransformSource(ctx, rule, src, &res); err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+
+			return b.storage.Put(ctx, cu, preset, res.Metadata(preset, rule, cu.String()), buf.Bytes())
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+
+	// Only point the URL to the variants once they are all there
+	return errors.Wrap(b.cache.Set(ctx, makeCacheKey(u), src.Hash), `failed to cache content hash`)
+}
+
+// Delete deletes the variants of the image at u. As they are shared,
+// this affects all URLs pointing to the same image, which will have
+// their variants regenerated when they are next requested
+func (b *Backend) Delete(ctx context.Context, u *url.URL) error {
+	cu := b.resolve(ctx, u)
+	if u.Scheme != Scheme {
+		b.cache.Delete(ctx, makeCacheKey(u))
+	}
+
+	if cu == nil {
+		log.Debugf(ctx, "cas backend: content hash for %s is unknown, nothing to delete", u)
+		return nil
+	}
+	return b.storage.Delete(ctx, cu)
+}
+
+// ReadObject reads the object at p from the storage
+func (b *Backend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	r, ok := b.storage.(ObjectReader)
+	if !ok {
+		return nil, errors.Errorf(`storage %T can not read objects`, b.storage)
+	}
+	return r.ReadObject(ctx, p)
+}
+
+// HealthCheck checks the health of the storage
+func (b *Backend) HealthCheck(ctx context.Context) error {
+	if hc, ok := b.storage.(HealthChecker); ok {
+		return hc.HealthCheck(ctx)
+	}
+	return nil
+}
+
+func (b *Backend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	cu := b.resolve(ctx, u)
+	if cu == nil {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return b.storage.Stat(ctx, cu, preset)
+}
+
+// List returns the variants of the image at u. The SourceURL of
+// each variant is the URL it is stored under
+func (b *Backend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	l, ok := b.storage.(Lister)
+	if !ok {
+		return nil, errors.Errorf("cas backend: storage %T can not list variants", b.storage)
+	}
+
+	cu := b.resolve(ctx, u)
+	if cu == nil {
+		return nil, nil
+	}
+	return l.List(ctx, cu)
+}
+
+func (b *Backend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	w, ok := b.storage.(Walker)
+	if !ok {
+		return errors.Errorf("cas backend: storage %T can not enumerate variants", b.storage)
+	}
+	return w.Walk(ctx, fn)
+}
+
+// Close closes the storage, if it needs to be closed
+func (b *Backend) Close() error {
+	if c, ok := b.storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package cas_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/cas"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/memory"
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// countingStorage counts the number of variants stored
+type countingStorage struct {
+	*memory.Backend
+	puts int
+}
+
+func (s *countingStorage) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	s.puts++
+	return s.Backend.Put(ctx, u, preset, md, content)
+}
+
+func TestBackend(t *testing.T) {
+	var img bytes.Buffer
+	if !assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 100, 100))), "png.Encode should succeed") {
+		return
+	}
+
+	// Every path serves the same image
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer srv.Close()
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return
+	}
+
+	trans := transformer.New()
+	presets := map[string]string{"small": "10x10"}
+	m, err := memory.NewBackend(&memory.Config{}, trans, presets)
+	if !assert.NoError(t, err, "memory.NewBackend should succeed") {
+		return
+	}
+
+	storage := &countingStorage{Backend: m}
+	b, err := cas.NewBackend(storage, cache, trans, presets)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u1, _ := url.Parse(srv.URL + "/foo.png")
+	u2, _ := url.Parse(srv.URL + "/foo.png?v=2")
+
+	if _, err := b.Get(ctx, u1, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Get should require transformation") {
+		return
+	}
+
+	for _, u := range []*url.URL{u1, u2} {
+		if !assert.NoError(t, b.StoreTransformedContent(ctx, u), "StoreTransformedContent should succeed") {
+			return
+		}
+		if _, err := b.Get(ctx, u, "small"); !assert.NoError(t, err, "Get should succeed") {
+			return
+		}
+	}
+
+	if !assert.Equal(t, 1, storage.puts, "image should only be transformed once") {
+		return
+	}
+
+	md1, err := b.Stat(ctx, u1, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	md2, err := b.Stat(ctx, u2, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, md1, md2, "variants should be shared") {
+		return
+	}
+	if !assert.Equal(t, cas.Scheme, md1.SourceURL[:len(cas.Scheme)], "variant should be stored under a content addressed URL") {
+		return
+	}
+
+	list, err := b.List(ctx, u2)
+	if !assert.NoError(t, err, "List should succeed") {
+		return
+	}
+	if !assert.Len(t, list, 1, "there should be 1 variant") {
+		return
+	}
+
+	// Signed options are kept in the fragment, and the variants created
+	// with them are stored separately
+	u3, _ := url.Parse(srv.URL + "/foo.png#20x20")
+	if !assert.NoError(t, b.StoreTransformedContent(ctx, u3), "StoreTransformedContent should succeed") {
+		return
+	}
+	md3, err := b.Stat(ctx, u3, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, 20, md3.Width, "options should be applied") {
+		return
+	}
+	if !assert.Equal(t, md1.SourceURL+"#20x20", md3.SourceURL, "variant should be stored under the content addressed URL with the options") {
+		return
+	}
+	if md, err := b.Stat(ctx, u1, "small"); !assert.NoError(t, err, "Stat should succeed") || !assert.Equal(t, 10, md.Width, "variant without options should not change") {
+		return
+	}
+
+	// Deleting removes the shared variants
+	if !assert.NoError(t, b.Delete(ctx, u1), "Delete should succeed") {
+		return
+	}
+	if _, err := b.Get(ctx, u1, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Get should require transformation") {
+		return
+	}
+	if _, err := b.Get(ctx, u2, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Get should require transformation") {
+		return
+	}
+}
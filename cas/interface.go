@@ -0,0 +1,49 @@
+package cas
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/sharaq/variant"
+	"golang.org/x/net/context"
+)
+
+// Scheme is the scheme of the URLs that variants are stored under.
+// See URL
+const Scheme = "cas"
+
+// Storage is where the variants are actually stored. It has the same
+// method set as sharaq.Backend, and must also be able to tell which
+// variants exist, and to store content that has already been
+// transformed
+type Storage interface {
+	Get(context.Context, *url.URL, string) (http.Handler, error)
+	StoreTransformedContent(context.Context, *url.URL) error
+	Delete(context.Context, *url.URL) error
+	Stat(context.Context, *url.URL, string) (*variant.Metadata, error)
+	Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error
+}
+
+// Lister is implemented by storages that can list the variants
+// created from an image
+type Lister interface {
+	List(context.Context, *url.URL) ([]*variant.Metadata, error)
+}
+
+// Walker is implemented by storages that can enumerate every variant
+// they store
+type Walker interface {
+	Walk(context.Context, variant.WalkFunc) error
+}
+
+// HealthChecker is implemented by storages that can check if they
+// are usable
+type HealthChecker interface {
+	HealthCheck(context.Context) error
+}
+
+// ObjectReader is implemented by storages that can read arbitrary
+// objects, such as overlay images
+type ObjectReader interface {
+	ReadObject(context.Context, string) ([]byte, error)
+}
@@ -4,7 +4,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/lestrrat-go/sharaq"
@@ -18,6 +20,10 @@ func main() {
 }
 
 func _main() int {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		return _migrate(os.Args[2:])
+	}
+
 	cfgfile := flag.String("config", "sharaq.json", "config file")
 	showVersion := flag.Bool("version", false, "show sharaq version")
 	flag.Parse()
@@ -50,3 +56,72 @@ func _main() int {
 
 	return 0
 }
+
+// _migrate copies the variants in the configured backend to the
+// backend described in the file given by -to
+func _migrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	dstfile := fs.String("to", "", "file containing the destination backend configuration")
+	concurrency := fs.Int("concurrency", 4, "number of variants to copy at the same time")
+	checkpoint := fs.String("checkpoint", "", "file to record progress in, so that an interrupted migration can be resumed")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	verify := fs.Bool("verify", false, "read back copied variants and compare checksums")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *dstfile == "" {
+		log.Debugf(ctx, "-to is required")
+		return 1
+	}
+
+	var config sharaq.Config
+	if err := config.ParseFile(*cfgfile); err != nil {
+		log.Debugf(ctx, "Failed to parse '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	var dst sharaq.BackendConfig
+	f, err := os.Open(*dstfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to open '%s': %s", *dstfile, err)
+		return 1
+	}
+	err = json.NewDecoder(f).Decode(&dst)
+	f.Close()
+	if err != nil {
+		log.Debugf(ctx, "Failed to parse '%s': %s", *dstfile, err)
+		return 1
+	}
+
+	s, err := sharaq.NewServer(&config)
+	if err != nil {
+		log.Debugf(ctx, "Failed to instantiate server: %s", err)
+		return 1
+	}
+
+	if err := s.Initialize(); err != nil {
+		log.Debugf(ctx, "Failed to initialize server: %s", err)
+		return 1
+	}
+
+	stats, err := s.Migrate(ctx, &dst, &sharaq.MigrateOptions{
+		Checkpoint:  *checkpoint,
+		Concurrency: *concurrency,
+		DryRun:      *dryRun,
+		Verify:      *verify,
+	})
+	if stats != nil {
+		fmt.Fprintf(os.Stdout, "copied: %d, skipped: %d, failed: %d\n", stats.Copied, stats.Skipped, stats.Failed)
+	}
+	if err != nil {
+		log.Debugf(ctx, "Failed to migrate: %s", err)
+		return 1
+	}
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -5,11 +5,100 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 )
 
+// Presets maps the names of presets to their transformation rules.
+// In the configuration, each preset is either the rule itself, or a
+// PresetConfig object, which is converted to the rule
+type Presets map[string]string
+
+// PresetConfig is the structured form of a preset. The encoder options
+// are appended to Rule, so that
+//
+//	{"Rule": "400x400", "Quality": 80, "Progressive": true}
+//
+// is the same as "400x400,q80,progressive"
+type PresetConfig struct {
+	Rule           string
+	Quality        int    // quality of JPEG images, from 1 to 100
+	Progressive    bool   // if true, JPEG images are encoded as progressive JPEG
+	Subsampling    string // chroma subsampling of JPEG images: "444", "422" or "420"
+	PNGCompression string // compression level of PNG images: "default", "fast", "best" or "none"
+	Palette        int    // number of colors PNG images are reduced to, from 2 to 256
+}
+
+// String returns the rule of the preset
+func (c PresetConfig) String() string {
+	opts := []string{c.Rule}
+	if c.Quality != 0 {
+		opts = append(opts, fmt.Sprintf("q%d", c.Quality))
+	}
+	if c.Progressive {
+		opts = append(opts, "progressive")
+	}
+	if c.Subsampling != "" {
+		opts = append(opts, "sub"+c.Subsampling)
+	}
+	if c.PNGCompression != "" && c.PNGCompression != "default" {
+		opts = append(opts, "png"+c.PNGCompression)
+	}
+	if c.Palette != 0 {
+		opts = append(opts, fmt.Sprintf("pal%d", c.Palette))
+	}
+	return strings.TrimPrefix(strings.Join(opts, ","), ",")
+}
+
+func (c PresetConfig) validate() error {
+	if c.Quality != 0 && (c.Quality < 1 || c.Quality > 100) {
+		return fmt.Errorf("Quality must be between 1 and 100")
+	}
+	switch c.Subsampling {
+	case "", "444", "422", "420":
+	default:
+		return fmt.Errorf("Subsampling must be one of 444, 422 or 420")
+	}
+	switch c.PNGCompression {
+	case "", "default", "fast", "best", "none":
+	default:
+		return fmt.Errorf("PNGCompression must be one of default, fast, best or none")
+	}
+	if c.Palette != 0 && (c.Palette < 2 || c.Palette > 256) {
+		return fmt.Errorf("Palette must be between 2 and 256")
+	}
+	return nil
+}
+
+func (p *Presets) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	presets := make(Presets, len(raw))
+	for name, v := range raw {
+		var rule string
+		if err := json.Unmarshal(v, &rule); err == nil {
+			presets[name] = rule
+			continue
+		}
+
+		var c PresetConfig
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("error: preset %s must be a rule or an object: %s", name, err)
+		}
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("error: invalid preset %s: %s", name, err)
+		}
+		presets[name] = c.String()
+	}
+	*p = presets
+	return nil
+}
+
 func (c *Config) ParseFile(f string) error {
 	fh, err := os.Open(f)
 	if err != nil {
@@ -0,0 +1,43 @@
+// +build !appengine
+
+package sharaq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetConfig(t *testing.T) {
+	var c Config
+	src := `{"Presets":{
+		"small": "100x100",
+		"large": {"Rule": "1200x", "Quality": 80, "Progressive": true, "Subsampling": "444"},
+		"icon": {"Rule": "64", "PNGCompression": "best", "Palette": 64},
+		"original": {}
+	}}`
+	if !assert.NoError(t, c.Parse(strings.NewReader(src)), "Parse should succeed") {
+		return
+	}
+
+	expected := Presets{
+		"small":    "100x100",
+		"large":    "1200x,q80,progressive,sub444",
+		"icon":     "64,pngbest,pal64",
+		"original": "",
+	}
+	assert.Equal(t, expected, c.Presets, "presets should be converted to rules")
+
+	for _, preset := range []string{
+		`{"Rule": "100", "Quality": 101}`,
+		`{"Rule": "100", "Subsampling": "411"}`,
+		`{"Rule": "100", "PNGCompression": "fastest"}`,
+		`{"Rule": "100", "Palette": 1}`,
+		`100`,
+	} {
+		var c Config
+		src := `{"Presets":{"bad":` + preset + `}}`
+		assert.Error(t, c.Parse(strings.NewReader(src)), "Parse should fail for %s", preset)
+	}
+}
@@ -1,71 +1,185 @@
 package fs
 
 import (
-	"io"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/crc64"
 	"github.com/lestrrat-go/sharaq/internal/errors"
 	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/variant"
 )
 
 type Backend struct {
 	root        string
 	cache       *urlcache.URLCache
+	closeOnce   sync.Once
+	done        chan struct{}
 	imageTTL    time.Duration
+	index       *index
+	maxSize     int64
 	presets     map[string]string
+	store       variant.StoreConfig
 	transformer *transformer.Transformer
 }
 
+// DefaultCleanupInterval is used when ImageTTL or MaxSize is specified,
+// but CleanupInterval is not
+const DefaultCleanupInterval = 5 * time.Minute
+
 func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*Backend, error) {
 	root := c.Root
 	if root == "" {
 		return nil, errors.New("fs backend: 'Root' is required")
 	}
-	log.Debugf(context.Background(), "Backend: storing files under %s", root)
-	return &Backend{
+	if c.MaxSize < 0 {
+		return nil, errors.New("fs backend: 'MaxSize' must not be negative")
+	}
+
+	ctx := context.Background()
+	log.Debugf(ctx, "Backend: storing files under %s", root)
+
+	idx := newIndex()
+	if err := idx.load(root); err != nil {
+		return nil, errors.Wrapf(err, `fs backend: failed to scan %s`, root)
+	}
+	log.Debugf(ctx, "Backend: found %d bytes worth of files under %s", idx.size, root)
+
+	f := &Backend{
 		root:        root,
 		cache:       cache,
+		done:        make(chan struct{}),
 		imageTTL:    c.ImageTTL,
+		index:       idx,
+		maxSize:     c.MaxSize,
 		presets:     presets,
+		store:       c.Store,
 		transformer: trans,
-	}, nil
+	}
+
+	if f.imageTTL > 0 || f.maxSize > 0 {
+		interval := c.CleanupInterval
+		if interval <= 0 {
+			interval = DefaultCleanupInterval
+		}
+		go f.cleanupLoop(interval)
+	}
+
+	return f, nil
+}
+
+// Close stops the periodic cleanup of the storage root
+func (f *Backend) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	return nil
+}
+
+func (f *Backend) cleanupLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+			f.CleanStorageRoot()
+		}
+	}
 }
 
 func (f *Backend) EncodeFilename(preset string, urlstr string) string {
 	// we are not going to be storing the requested path directly...
-	// need to encode it
-	return filepath.Join(f.root, util.HashedPath(preset, urlstr))
+	// need to encode it. The hash of the rule is included, so that a
+	// different file is used when the preset's rule changes
+	return filepath.Join(f.sourceDir(urlstr), crc64.EncodeString(preset, transformer.RuleHash(f.presets[preset])))
+}
+
+// sourceDir returns the directory holding all variants of the image
+// at urlstr
+func (f *Backend) sourceDir(urlstr string) string {
+	return filepath.Join(f.root, util.HashedPath(urlstr))
+}
+
+func (f *Backend) makeCacheKey(preset string, u *url.URL) string {
+	return urlcache.MakeCacheKey("fs", preset, transformer.RuleHash(f.presets[preset]), u.String())
 }
 
-type fileServer string
+// metadataSuffix is appended to the name of the content file to
+// get the name of the file holding its metadata
+const metadataSuffix = ".json"
+
+type fileServer struct {
+	path string
+	opts variant.StoreOptions
+}
 
 func (s fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debugf(util.RequestCtx(r), "Serving file %s", s)
-	http.ServeFile(w, r, string(s))
+	log.Debugf(util.RequestCtx(r), "Serving file %s", s.path)
+	if md, err := readMetadata(s.path); err == nil {
+		if md.ContentType != "" {
+			w.Header().Set("Content-Type", md.ContentType)
+		}
+		if md.ETag != "" {
+			w.Header().Set("ETag", `"`+md.ETag+`"`)
+		}
+	}
+	if v := s.opts.CacheControl; v != "" {
+		w.Header().Set("Cache-Control", v)
+	}
+	if v := s.opts.ContentDisposition; v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+	http.ServeFile(w, r, s.path)
+}
+
+// readMetadata reads the metadata stored next to the file at path
+func readMetadata(path string) (*variant.Metadata, error) {
+	data, err := ioutil.ReadFile(path + metadataSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var md variant.Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, errors.Wrapf(err, `failed to decode metadata for %s`, path)
+	}
+	return &md, nil
 }
 
 func (f *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
-	cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
+	cacheKey := f.makeCacheKey(preset, u)
 	if cachedFile := f.cache.Lookup(ctx, cacheKey); cachedFile != "" {
 		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedFile)
-		return fileServer(cachedFile), nil
+		if f.index.touch(cachedFile) {
+			return fileServer{path: cachedFile, opts: f.store.Options(preset)}, nil
+		}
+		// The file has been evicted
+		f.cache.Delete(ctx, cacheKey)
 	}
 
 	path := f.EncodeFilename(preset, u.String())
-	if _, err := os.Stat(path); err == nil {
+	if fi, err := os.Stat(path); err == nil {
 		// HIT. Serve this guy after filling the cache
-		return fileServer(path), nil
+		if !f.index.touch(path) {
+			// somebody else put it there
+			f.index.add(path, fi.Size()+metadataSize(path))
+		}
+		return fileServer{path: path, opts: f.store.Options(preset)}, nil
 	}
 
 	return nil, errors.TransformationRequiredError{}
@@ -93,74 +207,255 @@ func (f *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error
 				return errors.Wrap(err, `failed to transform`)
 			}
 
-			path := f.EncodeFilename(preset, u.String())
-			log.Debugf(ctx, "Saving to %s...", path)
+			return f.Put(ctx, u, preset, res.Metadata(preset, rule, u.String()), buf.Bytes())
+		})
+	}
+	return grp.Wait()
+}
 
-			dir := filepath.Dir(path)
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
-					return errors.Wrapf(err, `failed to create directory %s`, filepath.Dir(path))
-				}
-			}
+// Put stores already transformed content. The metadata is stored
+// in a separate file next to the content.
+//
+// Both files are first written to temporary files, which are then
+// renamed, so readers never see partially written files
+func (f *Backend) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	path := f.EncodeFilename(preset, u.String())
+	log.Debugf(ctx, "Saving to %s...", path)
 
-			fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return errors.Wrapf(err, `failed to open file %s`, path)
-			}
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); err != nil {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			return errors.Storage(errors.Wrapf(err, `failed to create directory %s`, dir))
+		}
+	}
 
-			defer fh.Close()
-			if _, err := io.Copy(fh, buf); err != nil {
-				return errors.Wrapf(err, `failed to write content to %s`, path)
+	md2 := *md
+	md2.Path = ""
+	md2.Size = int64(len(content))
+	mdbuf, err := json.Marshal(&md2)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode metadata`)
+	}
+
+	size := int64(len(content) + len(mdbuf))
+	if f.maxSize > 0 && size > f.maxSize {
+		return errors.Storage(errors.Errorf(`variant %s is %d bytes, larger than MaxSize (%d)`, path, size, f.maxSize))
+	}
+
+	// Metadata goes first, so that the content is never served
+	// without it
+	if err := writeFile(path+metadataSuffix, mdbuf); err != nil {
+		return errors.Storage(errors.Wrap(err, `failed to write metadata`))
+	}
+	if err := writeFile(path, content); err != nil {
+		return errors.Storage(errors.Wrap(err, `failed to write content`))
+	}
+
+	f.index.add(path, size)
+	if f.maxSize > 0 {
+		evicted := f.index.evict(f.maxSize)
+		f.removeFiles(ctx, evicted)
+		for _, p := range evicted {
+			if p == path {
+				// no point in caching a path that is already gone
+				return nil
 			}
-			cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
-			f.cache.Set(ctx, cacheKey, path)
-			return nil
-		})
+		}
 	}
 
-	// Cleanup disk
-	go f.CleanStorageRoot()
-	return grp.Wait()
+	f.cache.Set(ctx, f.makeCacheKey(preset, u), path)
+	return nil
 }
 
-func (f *Backend) Delete(ctx context.Context, u *url.URL) error {
-	var grp *errgroup.Group
-	grp, ctx = errgroup.WithContext(ctx)
+// writeFile atomically writes content to path
+func writeFile(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	fh, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return errors.Wrapf(err, `failed to create temporary file in %s`, dir)
+	}
+	tmpname := fh.Name()
+	// no op if the rename succeeds
+	defer os.Remove(tmpname)
 
-	for preset := range f.presets {
-		preset := preset
-		grp.Go(func() error {
-			path := f.EncodeFilename(preset, u.String())
-			log.Debugf(ctx, " + DELETE filesystem entry %s\n", path)
-			if err := os.Remove(path); err != nil {
-				return errors.Wrapf(err, `failed to remove path %s`, path)
-			}
+	if _, err := fh.Write(content); err != nil {
+		fh.Close()
+		return errors.Wrapf(err, `failed to write content to %s`, tmpname)
+	}
 
-			// fallthrough here regardless, because it's better to lose the
-			// cache than to accidentally have one linger
-			f.cache.Delete(context.Background(), urlcache.MakeCacheKey("fs", preset, u.String()))
-			return nil
-		})
+	if err := fh.Close(); err != nil {
+		return errors.Wrapf(err, `failed to close %s`, tmpname)
 	}
 
-	return errors.Wrap(grp.Wait(), `deleting from file system`)
+	// ioutil.TempFile creates files with 0600
+	if err := os.Chmod(tmpname, 0644); err != nil {
+		return errors.Wrapf(err, `failed to change mode of %s`, tmpname)
+	}
+
+	if err := os.Rename(tmpname, path); err != nil {
+		return errors.Wrapf(err, `failed to rename %s to %s`, tmpname, path)
+	}
+	return nil
 }
 
-func (f *Backend) CleanStorageRoot() error {
-	if f.imageTTL <= 0 {
-		return nil
+// HealthCheck makes sure that files can be created under the root
+// directory
+func (f *Backend) HealthCheck(ctx context.Context) error {
+	fh, err := ioutil.TempFile(f.root, tempPrefix)
+	if err != nil {
+		return errors.Wrapf(err, `failed to create temporary file in %s`, f.root)
+	}
+	fh.Close()
+	return errors.Wrapf(os.Remove(fh.Name()), `failed to remove %s`, fh.Name())
+}
+
+// ReadObject returns the content of the file at p, relative to the
+// root directory. p can not refer to files outside of the root
+func (f *Backend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	// cleaning the path as an absolute one drops any leading ".."
+	path := filepath.Join(f.root, filepath.Clean(string(filepath.Separator)+filepath.FromSlash(p)))
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, path)
+	}
+	return content, nil
+}
+
+// Stat returns the metadata of the variant. Variants stored before
+// metadata was recorded only have the information available from
+// the file system
+func (f *Backend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	path := f.EncodeFilename(preset, u.String())
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to stat %s`, path)
+	}
+
+	md, err := readMetadata(path)
+	if err != nil {
+		log.Debugf(ctx, "Backend: no metadata for %s: %s", path, err)
+		md = &variant.Metadata{
+			Created: fi.ModTime(),
+			Preset:  preset,
+		}
+	}
+	md.Path = path
+	md.Size = fi.Size()
+	return md, nil
+}
+
+// List returns the variants created from the image at u, which are
+// the files in the directory for u. Files that were stored without
+// metadata only have the information available from the file system
+func (f *Backend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	dir := f.sourceDir(u.String())
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, `failed to read directory %s`, dir)
+	}
+
+	var list []*variant.Metadata
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), tempPrefix) || strings.HasSuffix(fi.Name(), metadataSuffix) {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		md, err := readMetadata(path)
+		if err != nil {
+			md = &variant.Metadata{Created: fi.ModTime()}
+		} else if md.SourceURL != "" && md.SourceURL != u.String() {
+			// the hash of another URL collided
+			continue
+		}
+		md.Path = path
+		md.Size = fi.Size()
+		list = append(list, md)
 	}
+	return list, nil
+}
 
-	filepath.Walk(f.root, func(path string, info os.FileInfo, err error) error {
+// Walk calls fn for each file under the storage root. Files that
+// were stored without metadata only have the information available
+// from the file system
+func (f *Backend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	return filepath.Walk(f.root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tempPrefix) || strings.HasSuffix(path, metadataSuffix) {
 			return nil
 		}
 
-		if time.Since(info.ModTime()) > f.imageTTL {
-			os.Remove(path)
+		md, err := readMetadata(path)
+		if err != nil {
+			md = &variant.Metadata{Created: info.ModTime()}
 		}
-		return nil
+		md.Path = path
+		md.Size = info.Size()
+		return fn(md)
 	})
+}
+
+// Delete removes all the variants of the image at u, including those
+// created for presets or rules that are no longer configured. Files
+// that are already gone are not an error
+func (f *Backend) Delete(ctx context.Context, u *url.URL) error {
+	// delete the cache regardless, because it's better to lose the
+	// cache than to accidentally have one linger
+	for preset := range f.presets {
+		f.cache.Delete(ctx, f.makeCacheKey(preset, u))
+	}
+
+	list, err := f.List(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, `deleting from file system`)
+	}
 
+	for _, md := range list {
+		log.Debugf(ctx, " + DELETE filesystem entry %s\n", md.Path)
+		f.index.remove(md.Path)
+		for _, p := range []string{md.Path, md.Path + metadataSuffix} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, `failed to remove path %s`, p)
+			}
+		}
+	}
 	return nil
 }
+
+// CleanStorageRoot removes files that are older than ImageTTL, and
+// then removes the least recently used files until the total size
+// fits in MaxSize. This is called periodically, but it may also be
+// called explicitly
+func (f *Backend) CleanStorageRoot() error {
+	ctx := context.Background()
+	if f.imageTTL > 0 {
+		f.removeFiles(ctx, f.index.expire(time.Now().Add(-1*f.imageTTL)))
+	}
+	if f.maxSize > 0 {
+		f.removeFiles(ctx, f.index.evict(f.maxSize))
+	}
+	return nil
+}
+
+func (f *Backend) removeFiles(ctx context.Context, list []string) {
+	for _, path := range list {
+		log.Debugf(ctx, "Backend: evicting %s", path)
+		for _, p := range []string{path, path + metadataSuffix} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.Debugf(ctx, "Backend: failed to remove %s: %s", p, err)
+			}
+		}
+	}
+}
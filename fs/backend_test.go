@@ -0,0 +1,330 @@
+package fs_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/fs"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newBackend(t *testing.T, c *fs.Config) (*fs.Backend, bool) {
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return nil, false
+	}
+
+	b, err := fs.NewBackend(c, cache, nil, map[string]string{"small": "100x100"})
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return nil, false
+	}
+	return b, true
+}
+
+func TestPut(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	b, ok := newBackend(t, &fs.Config{Root: root})
+	if !ok {
+		return
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png")
+	if !assert.NoError(t, b.Put(ctx, u, "small", &variant.Metadata{ContentType: "image/png"}, []byte("Hello, World!")), "Put should succeed") {
+		return
+	}
+
+	// Overwriting with shorter content should not leave garbage behind
+	if !assert.NoError(t, b.Put(ctx, u, "small", &variant.Metadata{ContentType: "image/png"}, []byte("Hello")), "Put should succeed") {
+		return
+	}
+
+	content, err := ioutil.ReadFile(b.EncodeFilename("small", u.String()))
+	if !assert.NoError(t, err, "ioutil.ReadFile should succeed") {
+		return
+	}
+	if !assert.Equal(t, "Hello", string(content), "content should match") {
+		return
+	}
+
+	md, err := b.Stat(ctx, u, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, "image/png", md.ContentType, "content type should match") {
+		return
+	}
+	if !assert.Equal(t, int64(5), md.Size, "size should match") {
+		return
+	}
+
+	u2, _ := url.Parse("http://example.com/bar.png")
+	if _, err := b.Stat(ctx, u2, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Stat should fail for missing variant") {
+		return
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if !assert.NoError(t, err, "ioutil.ReadDir should succeed") {
+		return
+	}
+	if !assert.Len(t, files, 1, "there should be no temporary files") {
+		return
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	u1, _ := url.Parse("http://example.com/1.png")
+	u2, _ := url.Parse("http://example.com/2.png")
+	u3, _ := url.Parse("http://example.com/3.png")
+
+	// Find out how much space each variant takes, metadata included
+	b, ok := newBackend(t, &fs.Config{Root: root})
+	if !ok {
+		return
+	}
+	if !assert.NoError(t, b.Put(ctx, u1, "small", &variant.Metadata{ContentType: "image/png"}, []byte("abcd")), "Put should succeed") {
+		return
+	}
+	b.Close()
+	entrySize := diskUsage(t, root)
+
+	// Room for two variants, but not three
+	maxSize := 2*entrySize + entrySize/2
+	b, ok = newBackend(t, &fs.Config{Root: root, MaxSize: maxSize})
+	if !ok {
+		return
+	}
+
+	for _, u := range []*url.URL{u1, u2} {
+		if !assert.NoError(t, b.Put(ctx, u, "small", &variant.Metadata{ContentType: "image/png"}, []byte("abcd")), "Put should succeed") {
+			return
+		}
+	}
+
+	// touch u1, so that u2 becomes the least recently used
+	if _, err := b.Get(ctx, u1, "small"); !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, b.Put(ctx, u3, "small", &variant.Metadata{ContentType: "image/png"}, []byte("efgh")), "Put should succeed") {
+		return
+	}
+
+	if _, err := b.Get(ctx, u2, "small"); !assert.True(t, errors.IsTransformationRequired(err), "u2 should have been evicted") {
+		return
+	}
+	if !assert.True(t, diskUsage(t, root) <= maxSize, "files, including metadata, should fit in MaxSize") {
+		return
+	}
+
+	for _, u := range []*url.URL{u1, u3} {
+		if _, err := b.Get(ctx, u, "small"); !assert.NoError(t, err, "Get should succeed") {
+			return
+		}
+	}
+
+	// too large to be stored at all
+	err = b.Put(ctx, u2, "small", &variant.Metadata{ContentType: "image/png"}, make([]byte, maxSize))
+	if !assert.True(t, errors.IsStorageFailure(err), "Put should fail with a storage failure") {
+		return
+	}
+	if _, err := b.Get(ctx, u2, "small"); !assert.True(t, errors.IsTransformationRequired(err), "u2 should not be stored") {
+		return
+	}
+	for _, u := range []*url.URL{u1, u3} {
+		if _, err := b.Get(ctx, u, "small"); !assert.NoError(t, err, "Get should succeed") {
+			return
+		}
+	}
+	b.Close()
+
+	// A new backend should pick up the existing files, and evict
+	// them as necessary
+	old := time.Now().Add(-1 * time.Hour)
+	if !assert.NoError(t, os.Chtimes(b.EncodeFilename("small", u1.String()), old, old), "os.Chtimes should succeed") {
+		return
+	}
+
+	b, ok = newBackend(t, &fs.Config{Root: root, ImageTTL: time.Minute})
+	if !ok {
+		return
+	}
+	defer b.Close()
+
+	if !assert.NoError(t, b.CleanStorageRoot(), "CleanStorageRoot should succeed") {
+		return
+	}
+
+	if _, err := b.Get(ctx, u1, "small"); !assert.True(t, errors.IsTransformationRequired(err), "u1 should have expired") {
+		return
+	}
+	if _, err := b.Get(ctx, u3, "small"); !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+}
+
+// diskUsage returns the total size of the files under root
+func diskUsage(t *testing.T, root string) int64 {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	assert.NoError(t, err, "filepath.Walk should succeed")
+	return size
+}
+
+func TestRuleChange(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png")
+
+	b, err := fs.NewBackend(&fs.Config{Root: root}, cache, nil, map[string]string{"small": "300x400"})
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return
+	}
+	defer b.Close()
+
+	if !assert.NoError(t, b.Put(ctx, u, "small", &variant.Metadata{ContentType: "image/png"}, []byte("abcd")), "Put should succeed") {
+		return
+	}
+
+	// Same cache, but the rule for the preset has changed
+	b2, err := fs.NewBackend(&fs.Config{Root: root}, cache, nil, map[string]string{"small": "320x400"})
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return
+	}
+	defer b2.Close()
+
+	if _, err := b2.Get(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "variant should be regenerated after the rule changes") {
+		return
+	}
+}
+
+func TestDelete(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png")
+
+	b, err := fs.NewBackend(&fs.Config{Root: root}, cache, nil, map[string]string{"small": "300x400"})
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return
+	}
+	defer b.Close()
+
+	md := &variant.Metadata{ContentType: "image/png", Preset: "small", SourceURL: u.String()}
+	if !assert.NoError(t, b.Put(ctx, u, "small", md, []byte("abcd")), "Put should succeed") {
+		return
+	}
+
+	// The rule for "small" has changed, and "big" was never stored
+	b2, err := fs.NewBackend(&fs.Config{Root: root}, cache, nil, map[string]string{"small": "320x400", "big": "800x600"})
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return
+	}
+	defer b2.Close()
+
+	if !assert.NoError(t, b2.Delete(ctx, u), "Delete should succeed") {
+		return
+	}
+	if _, err := os.Stat(b.EncodeFilename("small", u.String())); !assert.True(t, os.IsNotExist(err), "variant for the old rule should be deleted") {
+		return
+	}
+
+	if !assert.NoError(t, b2.Delete(ctx, u), "Delete should succeed when there is nothing to delete") {
+		return
+	}
+}
+
+func TestWalk(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	b, ok := newBackend(t, &fs.Config{Root: root})
+	if !ok {
+		return
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	u1, _ := url.Parse("http://example.com/1.png")
+	u2, _ := url.Parse("http://example.com/2.png")
+	for _, u := range []*url.URL{u1, u2} {
+		md := &variant.Metadata{ContentType: "image/png", Preset: "small", SourceURL: u.String()}
+		if !assert.NoError(t, b.Put(ctx, u, "small", md, []byte("abcd")), "Put should succeed") {
+			return
+		}
+	}
+
+	var count int
+	err = b.Walk(ctx, func(md *variant.Metadata) error {
+		count++
+		return nil
+	})
+	if !assert.NoError(t, err, "Walk should succeed") {
+		return
+	}
+	if !assert.Equal(t, 2, count, "Walk should visit each variant once") {
+		return
+	}
+
+	list, err := b.List(ctx, u2)
+	if !assert.NoError(t, err, "List should succeed") {
+		return
+	}
+	if !assert.Len(t, list, 1, "List should return 1 variant") {
+		return
+	}
+	if !assert.Equal(t, b.EncodeFilename("small", u2.String()), list[0].Path, "path should match") {
+		return
+	}
+}
@@ -0,0 +1,190 @@
+package fs
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempPrefix is prepended to the name of files that are being
+// written. They are renamed to their final names once complete
+const tempPrefix = ".tmp-"
+
+// index keeps track of the files under the storage root, so that
+// we can evict them without walking the entire tree. Each entry
+// accounts for both the content and the metadata file next to it
+type index struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	size    int64
+}
+
+type indexEntry struct {
+	path     string
+	size     int64
+	accessed time.Time
+	modified time.Time
+}
+
+func newIndex() *index {
+	return &index{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// load populates the index with the files that already exist under
+// root. We don't know when these were last accessed, so the
+// modification time is used instead
+func (idx *index) load(root string) error {
+	var list []*indexEntry
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// leftovers from a previous run that died while writing
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			os.Remove(path)
+			return nil
+		}
+
+		// metadata is accounted for along with the content
+		if strings.HasSuffix(path, metadataSuffix) {
+			return nil
+		}
+
+		list = append(list, &indexEntry{
+			path:     path,
+			size:     info.Size() + metadataSize(path),
+			accessed: info.ModTime(),
+			modified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].accessed.Before(list[j].accessed)
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, e := range list {
+		idx.addLocked(e)
+	}
+	return nil
+}
+
+// metadataSize returns the size of the metadata file for the file at
+// path, or 0 if there is none
+func metadataSize(path string) int64 {
+	if fi, err := os.Stat(path + metadataSuffix); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+// add records the file at path. size should include the size of
+// its metadata file
+func (idx *index) add(path string, size int64) {
+	now := time.Now()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(path)
+	idx.addLocked(&indexEntry{
+		path:     path,
+		size:     size,
+		accessed: now,
+		modified: now,
+	})
+}
+
+func (idx *index) addLocked(e *indexEntry) {
+	idx.entries[e.path] = idx.lru.PushFront(e)
+	idx.size += e.size
+}
+
+// touch marks the file as being used. It returns false if the file
+// is not known to the index
+func (idx *index) touch(path string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	elem, ok := idx.entries[path]
+	if !ok {
+		return false
+	}
+
+	elem.Value.(*indexEntry).accessed = time.Now()
+	idx.lru.MoveToFront(elem)
+	return true
+}
+
+func (idx *index) remove(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(path)
+}
+
+func (idx *index) removeLocked(path string) {
+	elem, ok := idx.entries[path]
+	if !ok {
+		return
+	}
+
+	idx.lru.Remove(elem)
+	delete(idx.entries, path)
+	idx.size -= elem.Value.(*indexEntry).size
+}
+
+// evict removes the least recently used entries from the index until
+// the total size fits in maxSize. The paths that were removed from the
+// index are returned, so the caller can remove the actual files
+func (idx *index) evict(maxSize int64) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var evicted []string
+	for idx.size > maxSize && idx.lru.Len() > 0 {
+		e := idx.lru.Back().Value.(*indexEntry)
+		idx.removeLocked(e.path)
+		evicted = append(evicted, e.path)
+	}
+	return evicted
+}
+
+// expire removes the entries that were modified before the deadline
+// from the index, and returns their paths
+func (idx *index) expire(deadline time.Time) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var expired []string
+	for elem := idx.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if e := elem.Value.(*indexEntry); e.modified.Before(deadline) {
+			idx.removeLocked(e.path)
+			expired = append(expired, e.path)
+		}
+		elem = next
+	}
+	return expired
+}
@@ -1,8 +1,15 @@
 package fs
 
-import "time"
+import (
+	"time"
+
+	"github.com/lestrrat-go/sharaq/variant"
+)
 
 type Config struct {
-	Root     string
-	ImageTTL time.Duration
+	Root            string
+	ImageTTL        time.Duration       // remove images older than this
+	MaxSize         int64               // maximum number of bytes to store, including metadata files. Least recently used images are removed first
+	CleanupInterval time.Duration       // how often to look for images to remove. Defaults to DefaultCleanupInterval
+	Store           variant.StoreConfig // only CacheControl and ContentDisposition are used, as response headers
 }
@@ -3,7 +3,9 @@ package gcp
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -14,6 +16,7 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
@@ -22,24 +25,92 @@ import (
 	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
 )
 
 type StorageBackend struct {
-	bucketName  string
-	cache       *urlcache.URLCache
-	prefix      string
-	presets     map[string]string
-	transformer *transformer.Transformer
+	bucketName       string
+	cache            *urlcache.URLCache
+	chunkSize        int
+	prefix           string
+	presets          map[string]string
+	signer           *urlSigner // nil unless signed URLs are enabled
+	signedURLExpires time.Duration
+	store            variant.StoreConfig
+	transformer      *transformer.Transformer
+}
+
+// serviceAccountKey holds the fields of a service account key file
+// that are required to sign URLs
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
 }
 
 func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*StorageBackend, error) {
-	return &StorageBackend{
+	b := &StorageBackend{
 		bucketName:  c.BucketName,
 		cache:       cache,
+		chunkSize:   c.ChunkSize,
 		prefix:      c.Prefix,
 		presets:     presets,
+		store:       c.Store,
 		transformer: trans,
-	}, nil
+	}
+	if b.chunkSize <= 0 {
+		b.chunkSize = DefaultChunkSize
+	}
+
+	if c.SignedURLExpires != 0 {
+		if c.SignedURLExpires < time.Second || c.SignedURLExpires > MaxSignedURLExpires {
+			return nil, errors.Errorf("gcp backend: 'SignedURLExpires' must be between 1 second and %s", MaxSignedURLExpires)
+		}
+		if c.CredentialsFile == "" {
+			return nil, errors.New("gcp backend: 'CredentialsFile' is required for signed URLs")
+		}
+
+		data, err := ioutil.ReadFile(c.CredentialsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, `gcp backend: failed to read %s`, c.CredentialsFile)
+		}
+
+		var key serviceAccountKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, errors.Wrapf(err, `gcp backend: failed to parse %s`, c.CredentialsFile)
+		}
+		if key.ClientEmail == "" || key.PrivateKey == "" {
+			return nil, errors.Errorf("gcp backend: %s is not a service account key", c.CredentialsFile)
+		}
+		signer, err := newURLSigner(key.ClientEmail, key.PrivateKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, `gcp backend: invalid private key in %s`, c.CredentialsFile)
+		}
+		b.signer = signer
+		b.signedURLExpires = c.SignedURLExpires
+	}
+
+	return b, nil
+}
+
+// publicURL returns the URL of the object at p in the public bucket.
+// This is always https, as the scheme of the source URL may be anything
+// (e.g. cas://)
+func (s *StorageBackend) publicURL(p string) string {
+	return "https://storage.googleapis.com/" + s.bucketName + "/" + p
+}
+
+// objectURL returns the URL to access the object at p. When signed
+// URLs are enabled, this is a V4 signed URL for the given method
+func (s *StorageBackend) objectURL(method, p string) (string, error) {
+	if s.signer == nil {
+		return s.publicURL(p), nil
+	}
+
+	signed, err := s.signer.sign(method, s.bucketName, p, time.Now(), s.signedURLExpires)
+	if err != nil {
+		return "", errors.Wrapf(err, `failed to sign URL for %s`, p)
+	}
+	return signed, nil
 }
 
 func (s *StorageBackend) getClient(ctx context.Context) (*storage.Client, error) {
@@ -56,9 +127,19 @@ func (s *StorageBackend) getClient(ctx context.Context) (*storage.Client, error)
 }
 
 func (s *StorageBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
-	cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
+	cacheKey := s.makeCacheKey(preset, u)
 	if cachedURL := s.cache.Lookup(ctx, cacheKey); cachedURL != "" {
 		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
+		if s.signer != nil {
+			// The cached URL is only a marker. Sign a new one every time
+			p := s.makeStoragePath(preset, u)
+			signedURL, err := s.objectURL(http.MethodGet, p)
+			if err != nil {
+				return nil, errors.Wrap(err, `failed to create signed URL`)
+			}
+			return httputil.RedirectContent(signedURL), nil
+		}
+
 		if rand.Float32() < 0.25 {
 			log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
 			res, err := http.Head(cachedURL)
@@ -78,26 +159,44 @@ func (s *StorageBackend) Get(ctx context.Context, u *url.URL, preset string) (ht
 
 	path := s.makeStoragePath(preset, u)
 	if _, err := cl.Bucket(s.bucketName).Object(path).Attrs(ctx); err != nil {
+		if err != storage.ErrObjectNotExist {
+			return nil, errors.Wrapf(err, `failed to fetch attributes for %s`, path)
+		}
 		log.Debugf(ctx, "content at %s does not exist, request transformation", path)
 		return nil, errors.TransformationRequiredError{}
 	}
 
-	specificURL := u.Scheme + "://storage.googleapis.com/" + s.bucketName + "/" + path
+	specificURL, err := s.objectURL(http.MethodGet, path)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create object URL`)
+	}
 	return httputil.RedirectContent(specificURL), nil
 }
 
-func (s *StorageBackend) makeStoragePath(preset string, u *url.URL) string {
+// makeSourcePath returns the path under which all variants of the
+// image at u are stored
+func (s *StorageBackend) makeSourcePath(u *url.URL) string {
 	// Create a path based on the SHA256 hash of this URL
 	h := sha256.New()
 	io.WriteString(h, u.String())
-	list := make([]string, 0, 4)
+	list := make([]string, 0, 3)
 	if s.prefix != "" {
 		list = append(list, s.prefix)
 	}
-	list = append(list, preset, u.Host, hex.EncodeToString(h.Sum(nil)))
+	list = append(list, u.Host, hex.EncodeToString(h.Sum(nil)))
 	return path.Join(list...)
 }
 
+func (s *StorageBackend) makeStoragePath(preset string, u *url.URL) string {
+	// The hash of the rule is included, so that a different object is
+	// used when the preset's rule changes
+	return path.Join(s.makeSourcePath(u), preset, transformer.RuleHash(s.presets[preset]))
+}
+
+func (s *StorageBackend) makeCacheKey(preset string, u *url.URL) string {
+	return urlcache.MakeCacheKey("gcp", preset, transformer.RuleHash(s.presets[preset]), u.String())
+}
+
 func (s *StorageBackend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
 	log.Debugf(ctx, "StorageBackend: transforming image at url %s", u)
 
@@ -118,44 +217,243 @@ func (s *StorageBackend) StoreTransformedContent(ctx context.Context, u *url.URL
 		preset := preset
 		rule := rule
 		grp.Go(func() error {
+			st := t.TransformStream(ctx, rule, u.String())
+			defer st.Close()
+
+			// Variants that fit in a single chunk are uploaded in one go
 			buf := bbpool.Get()
 			defer bbpool.Release(buf)
 
-			var res transformer.Result
-			res.Content = buf
+			if _, err := io.CopyN(buf, st, int64(s.chunkSize)+1); err != io.EOF {
+				if err != nil {
+					return errors.Wrap(err, `failed to transform image`)
+				}
+				return s.putStream(ctx, bkt, u, preset, rule, io.MultiReader(buf, st), st)
+			}
 
-			err := t.Transform(ctx, rule, u.String(), &res)
+			res, err := st.Result()
 			if err != nil {
 				return errors.Wrap(err, `failed to transform image`)
 			}
 
 			// good, done. save it to Google Storage
-			p := s.makeStoragePath(preset, u)
-			log.Debugf(ctx, "Writing to Google Storage %s...", p)
+			return s.put(ctx, bkt, u, preset, res.Metadata(preset, rule, u.String()), buf.Bytes())
+		})
+	}
+	return grp.Wait()
+}
 
-			wc := bkt.Object(p).NewWriter(ctx)
+// Put stores already transformed content
+func (s *StorageBackend) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for Put`)
+	}
+	return s.put(ctx, cl.Bucket(s.bucketName), u, preset, md, content)
+}
 
-			wc.ContentType = res.ContentType
-			wc.ACL = []storage.ACLRule{
-				{storage.AllUsers, storage.RoleReader},
-			}
+func (s *StorageBackend) put(ctx context.Context, bkt *storage.BucketHandle, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	p := s.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Writing to Google Storage %s...", p)
 
-			if _, err := io.Copy(wc, buf); err != nil {
-				return errors.Wrapf(err, `failed to write data to %s`, p)
-			}
+	wc := s.newWriter(ctx, bkt, p, preset, md)
+	if _, err := wc.Write(content); err != nil {
+		wc.Close()
+		return errors.Storage(errors.Wrapf(err, `failed to write data to %s`, p))
+	}
 
-			if err := wc.Close(); err != nil {
-				return errors.Wrap(err, `failed to properly close writer for google storage`)
-			}
-			cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
-			specificURL := u.Scheme + "://storage.googleapis.com/" + s.bucketName + "/" + s.makeStoragePath(preset, u)
-			s.cache.Set(ctx, cacheKey, specificURL, urlcache.WithExpires(10*time.Minute))
+	if err := wc.Close(); err != nil {
+		return errors.Storage(errors.Wrap(err, `failed to properly close writer for google storage`))
+	}
+	s.setCache(ctx, preset, u, p)
+	return nil
+}
+
+// putStream uploads content of unknown size, one chunk at a time. The
+// ETag of the content is only known after all of it has been read, so
+// it is not stored in the object metadata
+func (s *StorageBackend) putStream(ctx context.Context, bkt *storage.BucketHandle, u *url.URL, preset, rule string, content io.Reader, st *transformer.Stream) error {
+	p := s.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Streaming to Google Storage %s...", p)
+
+	hdr, err := st.Header()
+	if err != nil {
+		return errors.Wrap(err, `failed to transform image`)
+	}
+
+	wc := s.newWriter(ctx, bkt, p, preset, hdr.Metadata(preset, rule, u.String()))
+	if _, err := io.Copy(storageWriter{wc}, content); err != nil {
+		wc.CloseWithError(err)
+		if errors.IsStorageFailure(err) {
+			return errors.Storage(errors.Wrapf(err, `failed to write data to %s`, p))
+		}
+		return errors.Wrap(err, `failed to transform image`)
+	}
+
+	if _, err := st.Result(); err != nil {
+		wc.CloseWithError(err)
+		return errors.Wrap(err, `failed to transform image`)
+	}
+
+	if err := wc.Close(); err != nil {
+		return errors.Storage(errors.Wrap(err, `failed to properly close writer for google storage`))
+	}
+	s.setCache(ctx, preset, u, p)
+	return nil
+}
+
+// storageWriter marks errors from writing to Google Storage as storage
+// failures, so that they can be told apart from errors reading the
+// transformed content when copying
+type storageWriter struct {
+	w io.Writer
+}
+
+func (w storageWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	return n, errors.Storage(err)
+}
+
+// newWriter creates a writer for the object holding the variant
+func (s *StorageBackend) newWriter(ctx context.Context, bkt *storage.BucketHandle, p, preset string, md *variant.Metadata) *storage.Writer {
+	wc := bkt.Object(p).NewWriter(ctx)
+	wc.ChunkSize = s.chunkSize
+
+	opts := s.store.Options(preset)
+	wc.CacheControl = opts.CacheControl
+	wc.ContentDisposition = opts.ContentDisposition
+	wc.StorageClass = opts.StorageClass
+	wc.ContentType = md.ContentType
+	wc.Metadata = md.ObjectMetadata(opts)
+	if s.signer == nil {
+		wc.ACL = []storage.ACLRule{
+			{Entity: storage.AllUsers, Role: storage.RoleReader},
+		}
+	}
+	return wc
+}
+
+func (s *StorageBackend) setCache(ctx context.Context, preset string, u *url.URL, p string) {
+	s.cache.Set(ctx, s.makeCacheKey(preset, u), s.publicURL(p), urlcache.WithExpires(10*time.Minute))
+}
+
+// HealthCheck makes sure that the bucket can be accessed
+func (s *StorageBackend) HealthCheck(ctx context.Context) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for HealthCheck`)
+	}
+
+	it := cl.Bucket(s.bucketName).Objects(ctx, &storage.Query{Prefix: s.prefix})
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return errors.Wrapf(err, `failed to list objects in %s`, s.bucketName)
+	}
+	return nil
+}
+
+// ReadObject returns the content of the object named p. The prefix
+// is not prepended, as p is the full name of the object
+func (s *StorageBackend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to get client for ReadObject`)
+	}
+
+	rdr, err := cl.Bucket(s.bucketName).Object(p).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, p)
+	}
+	defer rdr.Close()
+
+	content, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s`, p)
+	}
+	return content, nil
+}
+
+// Stat returns the metadata stored along with the object
+func (s *StorageBackend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to get client for Stat`)
+	}
+
+	p := s.makeStoragePath(preset, u)
+	attrs, err := cl.Bucket(s.bucketName).Object(p).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch attributes for %s`, p)
+	}
+
+	return attrsToMetadata(attrs), nil
+}
+
+func attrsToMetadata(attrs *storage.ObjectAttrs) *variant.Metadata {
+	md := &variant.Metadata{
+		ContentType: attrs.ContentType,
+		Created:     attrs.Created,
+		Path:        attrs.Name,
+		Size:        attrs.Size,
+	}
+	md.Decode(attrs.Metadata)
+	return md
+}
+
+// List returns the variants created from the image at u, which are
+// the objects under the source path of u
+func (s *StorageBackend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	var list []*variant.Metadata
+	err := s.walk(ctx, s.makeSourcePath(u)+"/", func(md *variant.Metadata) error {
+		if md.SourceURL == "" || md.SourceURL == u.String() {
+			list = append(list, md)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Walk calls fn for each object under the configured prefix
+func (s *StorageBackend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	var prefix string
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	return s.walk(ctx, prefix, fn)
+}
+
+// walk calls fn for each object whose name starts with prefix
+func (s *StorageBackend) walk(ctx context.Context, prefix string, fn variant.WalkFunc) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for Walk`)
+	}
+
+	q := storage.Query{Prefix: prefix}
+	it := cl.Bucket(s.bucketName).Objects(ctx, &q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
 			return nil
-		})
+		}
+		if err != nil {
+			return errors.Wrap(err, `failed to list objects`)
+		}
+
+		if err := fn(attrsToMetadata(attrs)); err != nil {
+			return err
+		}
 	}
-	return grp.Wait()
 }
 
+// Delete removes all the variants of the image at u, including those
+// created for presets or rules that are no longer configured. Objects
+// that are already gone are not an error
 func (s *StorageBackend) Delete(ctx context.Context, u *url.URL) error {
 	cl, err := s.getClient(ctx)
 	if err != nil {
@@ -164,19 +462,28 @@ func (s *StorageBackend) Delete(ctx context.Context, u *url.URL) error {
 
 	bkt := cl.Bucket(s.bucketName)
 
+	// delete the cache regardless, because it's better to lose the
+	// cache than to accidentally have one linger
+	for preset := range s.presets {
+		s.cache.Delete(ctx, s.makeCacheKey(preset, u))
+	}
+
+	list, err := s.List(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, `deleting from google storage`)
+	}
+
 	var grp *errgroup.Group
 	grp, ctx = errgroup.WithContext(ctx)
 
-	for preset := range s.presets {
-		preset := preset
+	for _, md := range list {
+		p := md.Path
 		grp.Go(func() error {
-			// delete the cache regardless, because it's better to lose the
-			// cache than to accidentally have one linger
-			defer s.cache.Delete(ctx, urlcache.MakeCacheKey(preset, u.String()))
-
-			p := s.makeStoragePath(preset, u)
 			log.Debugf(ctx, " + DELETE Google Storage entry %s\n", p)
-			return bkt.Object(p).Delete(ctx)
+			if err := bkt.Object(p).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+			return nil
 		})
 	}
 
@@ -1,6 +1,20 @@
 package gcp
 
+import (
+	"time"
+
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+// DefaultChunkSize is the default size of the chunks that large
+// variants are split into when uploading
+const DefaultChunkSize = 16 << 20
+
 type Config struct {
-	BucketName string `env:"bucket_name"`
-	Prefix string
+	BucketName       string `env:"bucket_name"`
+	ChunkSize        int    // variants larger than this are uploaded in chunks of this size, using a resumable upload. Defaults to DefaultChunkSize
+	Prefix           string
+	SignedURLExpires time.Duration       // if non-zero, objects are private and clients are redirected to signed URLs valid for this long
+	CredentialsFile  string              // service account key (JSON) used to sign URLs. Required for signed URLs
+	Store            variant.StoreConfig // Cache-Control, storage class, etc. for stored objects
 }
@@ -0,0 +1,147 @@
+package gcp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// MaxSignedURLExpires is the longest expiry that Google Storage
+// accepts for V4 signed URLs
+const MaxSignedURLExpires = 7 * 24 * time.Hour
+
+const signingHost = "storage.googleapis.com"
+
+// urlSigner creates V4 signed URLs using the private key of a service
+// account. See https://cloud.google.com/storage/docs/access-control/signing-urls-manually
+//
+// The storage package can only create V2 signed URLs, so this is done
+// by hand, the same way the aws package presigns S3 URLs
+type urlSigner struct {
+	clientEmail string
+	key         *rsa.PrivateKey
+}
+
+func newURLSigner(clientEmail, privateKey string) (*urlSigner, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New(`no PEM encoded private key found`)
+	}
+
+	// service account keys are PKCS#8, but accept PKCS#1 as well
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsakey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New(`private key is not an RSA key`)
+		}
+		key = rsakey
+	} else {
+		rsakey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to parse private key`)
+		}
+		key = rsakey
+	}
+
+	return &urlSigner{
+		clientEmail: clientEmail,
+		key:         key,
+	}, nil
+}
+
+// sign returns a URL for the object at p in bucket that is valid for
+// the given duration, starting from now
+func (s *urlSigner) sign(method, bucket, p string, now time.Time, expires time.Duration) (string, error) {
+	now = now.UTC()
+	q := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {s.clientEmail + "/" + credentialScope(now)},
+		"X-Goog-Date":          {now.Format("20060102T150405Z")},
+		"X-Goog-Expires":       {strconv.FormatInt(int64(expires/time.Second), 10)},
+		"X-Goog-SignedHeaders": {"host"},
+	}
+	canonicalPath := uriEncode("/"+bucket+"/"+p, false)
+	canonicalQuery := canonicalQueryString(q)
+
+	h := sha256.Sum256([]byte(stringToSign(method, canonicalPath, canonicalQuery, now)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", errors.Wrap(err, `failed to sign URL`)
+	}
+
+	return "https://" + signingHost + canonicalPath + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+func credentialScope(now time.Time) string {
+	return now.Format("20060102") + "/auto/storage/goog4_request"
+}
+
+func stringToSign(method, canonicalPath, canonicalQuery string, now time.Time) string {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	buf.WriteString(method)
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalPath)
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalQuery)
+	buf.WriteString("\nhost:")
+	buf.WriteString(signingHost)
+	buf.WriteString("\n\nhost\nUNSIGNED-PAYLOAD")
+	h := sha256.Sum256(buf.Bytes())
+
+	return "GOOG4-RSA-SHA256\n" + now.Format("20060102T150405Z") + "\n" + credentialScope(now) + "\n" + hex.EncodeToString(h[:])
+}
+
+func canonicalQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			list = append(list, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(list, "&")
+}
+
+// uriEncode percent encodes everything but unreserved characters, and
+// optionally slashes
+func uriEncode(s string, encodeSlash bool) string {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	const hexdigits = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hexdigits[c>>4])
+			buf.WriteByte(hexdigits[c&15])
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,81 @@
+package gcp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPrivateKey returns a PKCS#8 encoded RSA key, like the ones found
+// in service account key files
+func testPrivateKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey failed: %s", err)
+	}
+	return der
+}
+
+func TestSign(t *testing.T) {
+	der := testPrivateKey(t)
+	s, err := newURLSigner("sharaq@example.iam.gserviceaccount.com", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	if !assert.NoError(t, err, "newURLSigner should succeed") {
+		return
+	}
+
+	now := time.Date(2018, 2, 27, 13, 25, 40, 0, time.UTC)
+	signed, err := s.sign("GET", "foo", "example.com/abc def/small/0123", now, time.Hour)
+	if !assert.NoError(t, err, "sign should succeed") {
+		return
+	}
+
+	u, err := url.Parse(signed)
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "storage.googleapis.com", u.Host, "host should match") {
+		return
+	}
+	if !assert.Equal(t, "/foo/example.com/abc%20def/small/0123", u.EscapedPath(), "path should be encoded") {
+		return
+	}
+
+	q := u.Query()
+	if !assert.Equal(t, "GOOG4-RSA-SHA256", q.Get("X-Goog-Algorithm"), "algorithm should match") {
+		return
+	}
+	if !assert.Equal(t, "sharaq@example.iam.gserviceaccount.com/20180227/auto/storage/goog4_request", q.Get("X-Goog-Credential"), "credential should match") {
+		return
+	}
+	if !assert.Equal(t, "20180227T132540Z", q.Get("X-Goog-Date"), "date should match") {
+		return
+	}
+	if !assert.Equal(t, "3600", q.Get("X-Goog-Expires"), "expires should match") {
+		return
+	}
+
+	sig, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+	if !assert.NoError(t, err, "signature should be hex encoded") {
+		return
+	}
+	q.Del("X-Goog-Signature")
+
+	h := sha256.Sum256([]byte(stringToSign("GET", u.EscapedPath(), canonicalQueryString(q), now)))
+	pub := &s.key.PublicKey
+	if !assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig), "signature should verify") {
+		return
+	}
+}
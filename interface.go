@@ -1,28 +1,38 @@
 package sharaq
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/url"
 	"regexp"
 	"time"
 
 	"github.com/lestrrat-go/sharaq/aws"
+	"github.com/lestrrat-go/sharaq/azure"
 	"github.com/lestrrat-go/sharaq/fs"
 	"github.com/lestrrat-go/sharaq/gcp"
+	"github.com/lestrrat-go/sharaq/internal/breaker"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/memory"
+	"github.com/lestrrat-go/sharaq/purge"
+	"github.com/lestrrat-go/sharaq/variant"
 	"golang.org/x/net/context"
 )
 
 type Server struct {
-	backend     Backend
-	config      *Config
-	cache       *urlcache.URLCache
-	bucketName  string
-	logConfig   *LogConfig
-	tokens      map[string]struct{} // tokens required to accept administrative requests
-	transformer *transformer.Transformer
-	whitelist   []*regexp.Regexp
+	backend      Backend
+	breaker      *breaker.Breaker // nil unless circuit breaking is configured
+	config       *Config
+	cache        *urlcache.URLCache
+	presets      map[string]string // the configured presets, with overlays pinned to their content
+	bucketName   string
+	customPurger purge.Purger // set via SetPurger. takes precedence over the configuration
+	logConfig    *LogConfig
+	purger       purge.Purger        // nil if purging is not configured
+	tokens       map[string]struct{} // tokens required to accept administrative requests
+	transformer  *transformer.Transformer
+	whitelist    []*regexp.Regexp
 }
 
 type Backend interface {
@@ -31,6 +41,57 @@ type Backend interface {
 	Delete(context.Context, *url.URL) error
 }
 
+// Stater is implemented by backends that record the metadata of the
+// variants they store. Stat returns the metadata of the variant for
+// the given preset, or errors.TransformationRequiredError if it does
+// not exist
+type Stater interface {
+	Stat(context.Context, *url.URL, string) (*variant.Metadata, error)
+}
+
+// Lister is implemented by backends that can list the variants created
+// from the given URL, including those for presets or rules that are no
+// longer configured. It is used by the /variants endpoint
+type Lister interface {
+	List(context.Context, *url.URL) ([]*variant.Metadata, error)
+}
+
+// Walker is implemented by backends that can enumerate every variant
+// they store. The source backend of a migration must implement this
+type Walker interface {
+	Walk(context.Context, variant.WalkFunc) error
+}
+
+// HealthChecker is implemented by backends that can check if they
+// are usable, e.g. that the bucket exists and the credentials are
+// valid. It is used by the readiness endpoint. Backends that do not
+// implement this are assumed to be always usable
+type HealthChecker interface {
+	HealthCheck(context.Context) error
+}
+
+// ObjectReader is implemented by backends that can read arbitrary
+// objects from their storage, such as overlay images kept in the same
+// bucket as the variants. Overlays configured as "backend:{path}" are
+// read with it
+type ObjectReader interface {
+	ReadObject(context.Context, string) ([]byte, error)
+}
+
+// BackendFactory creates a new Backend. It is registered with
+// RegisterBackend, and invoked when the configured backend type
+// matches the name it was registered under.
+type BackendFactory func(*BackendEnv) (Backend, error)
+
+// BackendEnv holds the configuration and the components that
+// a BackendFactory needs to create a Backend
+type BackendEnv struct {
+	cache       *urlcache.URLCache
+	config      *BackendConfig
+	presets     map[string]string
+	transformer *transformer.Transformer
+}
+
 type LogConfig struct {
 	LogFile      string
 	LinkName     string
@@ -40,20 +101,41 @@ type LogConfig struct {
 }
 
 type BackendConfig struct {
-	Amazon     aws.Config // AWS specific config
-	Type       string     // "aws" or "gcp" ("fs" for local debugging)
-	FileSystem fs.Config  // File system specific config
-	Google     gcp.Config `env:"gcp"` // Google specific config
+	Amazon     aws.Config    // AWS specific config
+	Azure      azure.Config  // Azure specific config
+	Type       string        // "aws", "azure", "gcp", "fs" (for local debugging), "memory" (for tests), or any name passed to RegisterBackend
+	FileSystem fs.Config     // File system specific config
+	Google     gcp.Config    `env:"gcp"` // Google specific config
+	Memory     memory.Config // In-memory storage specific config
+
+	sections map[string]json.RawMessage // raw configuration, for backends registered via RegisterBackend
+}
+
+const (
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerTimeout   = 30 * time.Second
+)
+
+// CircuitBreakerConfig configures the circuit breaker around the
+// storage backend
+type CircuitBreakerConfig struct {
+	Threshold int           // consecutive failures before the backend is considered down. Defaults to DefaultCircuitBreakerThreshold
+	Timeout   time.Duration // how long to wait before trying the backend again. Defaults to DefaultCircuitBreakerTimeout
 }
 
 type Config struct {
-	filename  string
-	AccessLog *LogConfig // access log. if nil, logs to stderr
-	Backend   BackendConfig
-	Debug     bool
-	Listen    string // listen on this address. default is 0.0.0.0:9090
-	Presets   map[string]string
-	Tokens    []string
-	URLCache  *urlcache.Config
-	Whitelist []string
+	filename         string
+	AccessLog        *LogConfig // access log. if nil, logs to stderr
+	Backend          BackendConfig
+	CircuitBreaker   *CircuitBreakerConfig // if specified, requests are redirected to the original image while the backend is down
+	ContentAddressed bool                  // if true, variants are stored by the hash of the source image, and shared among URLs pointing to it
+	Debug            bool
+	Listen           string            // listen on this address. default is 0.0.0.0:9090
+	Overlays         map[string]string // overlay images referred to by presets, by name. values are file paths, http(s) URLs, or "backend:{path}" for objects in the storage backend
+	Presets          Presets           // preset names to their rules, given as strings or PresetConfig objects
+	Purge            *purge.HTTPConfig // if specified, CDN caches are purged via HTTP when images are deleted or regenerated
+	SigningKey       string            // secret that the options of signed requests are signed with. if empty, requests with options are rejected
+	Tokens           []string
+	URLCache         *urlcache.Config
+	Whitelist        []string
 }
@@ -0,0 +1,77 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker opens the circuit after a number of consecutive failures.
+// While the circuit is open, calls are rejected, except for a single
+// call per timeout period, which is let through to find out if the
+// backend has recovered. A successful call closes the circuit.
+type Breaker struct {
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openedAt  time.Time
+	threshold int
+	timeout   time.Duration
+	now       func() time.Time
+}
+
+// New creates a Breaker that opens after threshold consecutive
+// failures, and probes the backend every timeout while open
+func New(threshold int, timeout time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		timeout:   timeout,
+		now:       time.Now,
+	}
+}
+
+// Allow returns true if a call should be made. The result of the call
+// must be reported using Success or Failure
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	if now := b.now(); now.Sub(b.openedAt) >= b.timeout {
+		// Let this one through. Others are rejected until it
+		// reports back, or until the timeout passes again
+		b.openedAt = now
+		return true
+	}
+	return false
+}
+
+// Success reports a successful call, and closes the circuit
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+}
+
+// Failure reports a failed call
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.open || b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = b.now()
+	}
+}
+
+// Open returns true if the circuit is open
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
@@ -0,0 +1,52 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	b := New(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if !assert.True(t, b.Allow(), "circuit should be closed after 1 failure") {
+		return
+	}
+
+	b.Failure()
+	if !assert.True(t, b.Open(), "circuit should be open after 2 failures") {
+		return
+	}
+	if !assert.False(t, b.Allow(), "calls should be rejected while open") {
+		return
+	}
+
+	now = now.Add(time.Minute)
+	if !assert.True(t, b.Allow(), "a call should be let through after the timeout") {
+		return
+	}
+	if !assert.False(t, b.Allow(), "only a single call should be let through") {
+		return
+	}
+
+	b.Failure()
+	if !assert.False(t, b.Allow(), "circuit should stay open if the probe fails") {
+		return
+	}
+
+	now = now.Add(time.Minute)
+	if !assert.True(t, b.Allow(), "a call should be let through after the timeout") {
+		return
+	}
+	b.Success()
+	if !assert.False(t, b.Open(), "circuit should be closed after a success") {
+		return
+	}
+	if !assert.True(t, b.Allow(), "calls should be allowed once closed") {
+		return
+	}
+}
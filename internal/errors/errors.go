@@ -36,6 +36,49 @@ func IsTransformationRequired(err error) bool {
 	return false
 }
 
+type storageFailure interface {
+	StorageFailure() bool
+}
+
+// StorageError is an error returned by the storage of a backend, as
+// opposed to errors caused by the source image
+type StorageError struct {
+	Err error
+}
+
+func (e StorageError) Error() string {
+	return e.Err.Error()
+}
+func (e StorageError) Cause() error {
+	return e.Err
+}
+func (e StorageError) StorageFailure() bool {
+	return true
+}
+
+// Storage wraps err in a StorageError. nil is returned if err is nil
+func Storage(err error) error {
+	if err == nil {
+		return nil
+	}
+	return StorageError{Err: err}
+}
+
+func IsStorageFailure(err error) bool {
+	for err != nil {
+		if sf, ok := err.(storageFailure); ok {
+			return sf.StorageFailure()
+		}
+
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
 func New(s string) error {
 	return daverr.New(s)
 }
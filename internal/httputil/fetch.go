@@ -0,0 +1,86 @@
+package httputil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// Fetch retrieves the content served by h, which is usually a handler
+// returned from a backend's Get method. Backends that store content
+// elsewhere redirect the client to it, in which case the redirect
+// is followed
+func Fetch(ctx context.Context, h http.Handler) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, `failed to create request`)
+	}
+
+	rec := newResponseRecorder()
+	h.ServeHTTP(rec, req.WithContext(ctx))
+
+	switch {
+	case rec.status == http.StatusOK:
+		return rec.body.Bytes(), rec.header.Get("Content-Type"), nil
+	case rec.status >= 300 && rec.status < 400 && rec.header.Get("Location") != "":
+		location := rec.header.Get("Location")
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		if err != nil {
+			return nil, "", errors.Wrap(err, `failed to create request`)
+		}
+
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, `failed to fetch %s`, location)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return nil, "", errors.Errorf(`failed to fetch %s: %d`, location, res.StatusCode)
+		}
+
+		content, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, `failed to read content from %s`, location)
+		}
+		return content, res.Header.Get("Content-Type"), nil
+	default:
+		return nil, "", errors.Errorf(`unexpected response: %d`, rec.status)
+	}
+}
+
+// responseRecorder captures the response from an http.Handler. This
+// is used instead of httptest.ResponseRecorder, as importing
+// net/http/httptest registers command line flags
+type responseRecorder struct {
+	body   bytes.Buffer
+	header http.Header
+	status int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header: make(http.Header),
+	}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
@@ -0,0 +1,69 @@
+package transformer
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// transformAnimation transforms every frame of the animated GIF g.
+// Frames in a GIF may only cover part of the image, and are drawn on
+// top of what the previous frames left behind, so each frame is first
+// composed into the full image as it is displayed. The transformed
+// frames are full images, which replace each other. As they contain
+// the colors of the previous frames as well, each of them gets a
+// palette created from its own colors, instead of the local palette
+// of the source frame
+func (t *Transformer) transformAnimation(dst io.Writer, g *gif.GIF, opt Options) error {
+	b := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if b.Empty() {
+		for _, frame := range g.Image {
+			b = b.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewNRGBA(b)
+	out := &gif.GIF{
+		Delay:     g.Delay,
+		LoopCount: g.LoopCount,
+	}
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		// All frames must be cropped the same way
+		if i == 0 {
+			opt = smartFocus(canvas, opt)
+		}
+
+		m, err := t.transformFrame(imaging.Clone(canvas), opt)
+		if err != nil {
+			return err
+		}
+		// leave room for the transparent color added by quantize
+		out.Image = append(out.Image, quantize(m, medianCut(m, 255)))
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return gif.EncodeAll(dst, out)
+}
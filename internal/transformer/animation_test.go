@@ -0,0 +1,144 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTransformAnimation(t *testing.T) {
+	// use simpler filter while testing that won't skew colors
+	resampleFilter = imaging.Box
+
+	palette := color.Palette{red, green, blue, yellow}
+	frame := func(r image.Rectangle, c color.NRGBA) *image.Paletted {
+		m := image.NewPaletted(r, palette)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.Set(x, y, c)
+			}
+		}
+		return m
+	}
+
+	// A red 4x4 image, with a blue square drawn on the bottom right,
+	// which is then replaced with a green square on the top left
+	var src bytes.Buffer
+	err := gif.EncodeAll(&src, &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), red),
+			frame(image.Rect(2, 2, 4, 4), blue),
+			frame(image.Rect(0, 0, 2, 2), green),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone},
+		LoopCount: 3,
+	})
+	if !assert.NoError(t, err, "gif.EncodeAll should succeed") {
+		return
+	}
+
+	t.Run("all frames", func(t *testing.T) {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(src.Bytes()), ParseOptions("2x2")), "transform should succeed") {
+			return
+		}
+
+		g, err := gif.DecodeAll(dst)
+		if !assert.NoError(t, err, "gif.DecodeAll should succeed") {
+			return
+		}
+		if !assert.Len(t, g.Image, 3, "all frames should be kept") {
+			return
+		}
+		if !assert.Equal(t, []int{10, 20, 30}, g.Delay, "delays should be kept") {
+			return
+		}
+		if !assert.Equal(t, 3, g.LoopCount, "loop count should be kept") {
+			return
+		}
+
+		want := [][]color.NRGBA{
+			{red, red, red, red},
+			{red, red, red, blue},
+			{green, red, red, red}, // the blue square is disposed of
+		}
+		for i, m := range g.Image {
+			if !assert.Equal(t, image.Rect(0, 0, 2, 2), m.Bounds(), "frame %d should be resized", i) {
+				return
+			}
+			got := []color.NRGBA{
+				color.NRGBAModel.Convert(m.At(0, 0)).(color.NRGBA),
+				color.NRGBAModel.Convert(m.At(1, 0)).(color.NRGBA),
+				color.NRGBAModel.Convert(m.At(0, 1)).(color.NRGBA),
+				color.NRGBAModel.Convert(m.At(1, 1)).(color.NRGBA),
+			}
+			if !assert.Equal(t, want[i], got, "frame %d should match", i) {
+				return
+			}
+		}
+	})
+
+	t.Run("poster", func(t *testing.T) {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(src.Bytes()), ParseOptions("2x2,poster")), "transform should succeed") {
+			return
+		}
+
+		g, err := gif.DecodeAll(dst)
+		if !assert.NoError(t, err, "gif.DecodeAll should succeed") {
+			return
+		}
+		assert.Len(t, g.Image, 1, "only the first frame should be kept")
+	})
+
+	t.Run("local palettes", func(t *testing.T) {
+		// The second frame only has blue and yellow in its palette,
+		// but the red of the first frame is still visible in it
+		first := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green})
+		second := image.NewPaletted(image.Rect(2, 2, 4, 4), color.Palette{blue, yellow})
+		var local bytes.Buffer
+		err := gif.EncodeAll(&local, &gif.GIF{
+			Image: []*image.Paletted{first, second},
+			Delay: []int{10, 10},
+		})
+		if !assert.NoError(t, err, "gif.EncodeAll should succeed") {
+			return
+		}
+
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(local.Bytes()), ParseOptions("2x2")), "transform should succeed") {
+			return
+		}
+
+		g, err := gif.DecodeAll(dst)
+		if !assert.NoError(t, err, "gif.DecodeAll should succeed") {
+			return
+		}
+		if !assert.Len(t, g.Image, 2, "all frames should be kept") {
+			return
+		}
+		m := g.Image[1]
+		if !assert.Equal(t, red, color.NRGBAModel.Convert(m.At(0, 0)).(color.NRGBA), "colors of previous frames should be kept") {
+			return
+		}
+		if !assert.Equal(t, blue, color.NRGBAModel.Convert(m.At(1, 1)).(color.NRGBA), "colors of the frame should be kept") {
+			return
+		}
+	})
+}
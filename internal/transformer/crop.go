@@ -0,0 +1,299 @@
+package transformer
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Gravity specifies which part of the image is kept when it is cropped
+// to fill the requested dimensions
+type Gravity int
+
+const (
+	GravityCenter Gravity = iota // the default
+	GravityTop
+	GravityBottom
+	GravityLeft
+	GravityRight
+	GravityTopLeft
+	GravityTopRight
+	GravityBottomLeft
+	GravityBottomRight
+	GravityFocus // around the focal point in Options
+	GravitySmart // the part with the most detail
+)
+
+var gravityNames = map[Gravity]string{
+	GravityCenter:      "center",
+	GravityTop:         "top",
+	GravityBottom:      "bottom",
+	GravityLeft:        "left",
+	GravityRight:       "right",
+	GravityTopLeft:     "topleft",
+	GravityTopRight:    "topright",
+	GravityBottomLeft:  "bottomleft",
+	GravityBottomRight: "bottomright",
+	GravitySmart:       "smart",
+}
+
+var gravityAnchors = map[Gravity]imaging.Anchor{
+	GravityTop:         imaging.Top,
+	GravityBottom:      imaging.Bottom,
+	GravityLeft:        imaging.Left,
+	GravityRight:       imaging.Right,
+	GravityTopLeft:     imaging.TopLeft,
+	GravityTopRight:    imaging.TopRight,
+	GravityBottomLeft:  imaging.BottomLeft,
+	GravityBottomRight: imaging.BottomRight,
+}
+
+func (g Gravity) String() string {
+	return gravityNames[g]
+}
+
+// parseGravity returns the Gravity named s
+func parseGravity(s string) (Gravity, bool) {
+	for g, name := range gravityNames {
+		if name == s {
+			return g, true
+		}
+	}
+	return GravityCenter, false
+}
+
+// parseFocus parses a focal point in the form "fp{x}:{y}", where x and
+// y are relative coordinates between 0 and 1
+func parseFocus(s string) (float64, float64, bool) {
+	xy := strings.SplitN(strings.TrimPrefix(s, "fp"), ":", 2)
+	if len(xy) != 2 {
+		return 0, 0, false
+	}
+
+	x, err := strconv.ParseFloat(xy[0], 64)
+	if err != nil || x < 0 || x > 1 {
+		return 0, 0, false
+	}
+	y, err := strconv.ParseFloat(xy[1], 64)
+	if err != nil || y < 0 || y > 1 {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+func formatFocus(x, y float64) string {
+	return fmt.Sprintf("fp%v:%v", x, y)
+}
+
+// parseCrop parses one of the crop rectangle options
+func parseCrop(options *Options, opt string) {
+	v, err := strconv.ParseFloat(opt[2:], 64)
+	if err != nil || v < 0 {
+		return
+	}
+
+	switch opt[:2] {
+	case "cx":
+		options.CropX = v
+	case "cy":
+		options.CropY = v
+	case "cw":
+		options.CropWidth = v
+	case "ch":
+		options.CropHeight = v
+	}
+}
+
+// cropRect returns the region of an image with bounds b to crop to, as
+// specified in opt
+func cropRect(b image.Rectangle, opt Options) image.Rectangle {
+	size := func(v float64, n int) int {
+		if 0 < v && v < 1 {
+			return int(float64(n) * v)
+		}
+		return int(v)
+	}
+
+	x := size(opt.CropX, b.Dx())
+	y := size(opt.CropY, b.Dy())
+	w := size(opt.CropWidth, b.Dx())
+	if w == 0 {
+		w = b.Dx() - x
+	}
+	h := size(opt.CropHeight, b.Dy())
+	if h == 0 {
+		h = b.Dy() - y
+	}
+
+	return image.Rect(x, y, x+w, y+h).Add(b.Min).Intersect(b)
+}
+
+// cropImage crops m to the crop rectangle in opt, if any
+func cropImage(m image.Image, opt Options) image.Image {
+	if opt.CropX == 0 && opt.CropY == 0 && opt.CropWidth == 0 && opt.CropHeight == 0 {
+		return m
+	}
+	if r := cropRect(m.Bounds(), opt); !r.Empty() {
+		return imaging.Crop(m, r)
+	}
+	return m
+}
+
+// smartFocus returns opt with GravitySmart replaced by the focal point
+// of the area that smartCrop keeps in m. This is used to crop all the
+// frames of an animation the same way
+func smartFocus(m image.Image, opt Options) Options {
+	if opt.Gravity != GravitySmart {
+		return opt
+	}
+
+	m = cropImage(m, opt)
+	b := m.Bounds()
+	w, h := resizeDimensions(b, opt)
+	if w > b.Dx() {
+		w = b.Dx()
+	}
+	if h > b.Dy() {
+		h = b.Dy()
+	}
+
+	opt.Gravity = GravityFocus
+	opt.FocusX, opt.FocusY = 0.5, 0.5
+	if w != 0 && h != 0 {
+		r := smartCrop(m, w, h)
+		opt.FocusX = float64(r.Min.X-b.Min.X+r.Dx()/2) / float64(b.Dx())
+		opt.FocusY = float64(r.Min.Y-b.Min.Y+r.Dy()/2) / float64(b.Dy())
+	}
+	return opt
+}
+
+// fill resizes and crops m to exactly w by h pixels, keeping the part
+// of the image specified by the gravity in opt
+func fill(m image.Image, w, h int, opt Options) image.Image {
+	switch opt.Gravity {
+	case GravityCenter:
+		return imaging.Thumbnail(m, w, h, opt.resampler())
+	case GravityFocus:
+		return imaging.Resize(imaging.Crop(m, focusCrop(m.Bounds(), w, h, opt.FocusX, opt.FocusY)), w, h, opt.resampler())
+	case GravitySmart:
+		return imaging.Resize(imaging.Crop(m, smartCrop(m, w, h)), w, h, opt.resampler())
+	}
+	return imaging.Fill(m, w, h, gravityAnchors[opt.Gravity], opt.resampler())
+}
+
+// cropSize returns the largest size within b that has the aspect
+// ratio of w by h
+func cropSize(b image.Rectangle, w, h int) (int, int) {
+	if b.Dx()*h > b.Dy()*w {
+		return b.Dy() * w / h, b.Dy()
+	}
+	return b.Dx(), b.Dx() * h / w
+}
+
+// focusCrop returns the largest rectangle within b with the aspect
+// ratio of w by h, centered on the focal point (x, y) as much as
+// possible
+func focusCrop(b image.Rectangle, w, h int, x, y float64) image.Rectangle {
+	cw, ch := cropSize(b, w, h)
+	left := clamp(int(x*float64(b.Dx()))-cw/2, 0, b.Dx()-cw)
+	top := clamp(int(y*float64(b.Dy()))-ch/2, 0, b.Dy()-ch)
+	return image.Rect(left, top, left+cw, top+ch).Add(b.Min)
+}
+
+// smartAnalysisSize is the maximum size of the image analyzed by
+// smartCrop. Larger images are scaled down first
+const smartAnalysisSize = 256
+
+// smartCrop returns the largest rectangle within m with the aspect
+// ratio of w by h, that contains the most edges. Areas with a lot of
+// edges tend to be the subject of the image, while backgrounds such
+// as the sky are usually flat
+func smartCrop(m image.Image, w, h int) image.Rectangle {
+	b := m.Bounds()
+	cw, ch := cropSize(b, w, h)
+
+	small := m
+	if b.Dx() > smartAnalysisSize || b.Dy() > smartAnalysisSize {
+		small = imaging.Fit(m, smartAnalysisSize, smartAnalysisSize, imaging.Box)
+	}
+	gray := imaging.Grayscale(small)
+	sw, sh := gray.Bounds().Dx(), gray.Bounds().Dy()
+
+	// The crop spans the whole image in one direction, so only the
+	// sums of the edges per column (or row) are needed
+	horizontal := cw < b.Dx()
+	var sums []int
+	if horizontal {
+		sums = make([]int, sw)
+	} else {
+		sums = make([]int, sh)
+	}
+	for y := 0; y < sh-1; y++ {
+		for x := 0; x < sw-1; x++ {
+			v := int(gray.Pix[y*gray.Stride+x*4])
+			dx := v - int(gray.Pix[y*gray.Stride+(x+1)*4])
+			dy := v - int(gray.Pix[(y+1)*gray.Stride+x*4])
+			e := abs(dx) + abs(dy)
+			if horizontal {
+				sums[x] += e
+			} else {
+				sums[y] += e
+			}
+		}
+	}
+
+	size, length := ch, b.Dy()
+	if horizontal {
+		size, length = cw, b.Dx()
+	}
+	window := size * len(sums) / length
+	if window < 1 || window >= len(sums) {
+		return focusCrop(b, w, h, 0.5, 0.5)
+	}
+
+	// Slide the crop across the image. The center wins ties, so that
+	// images without any detail are cropped as usual
+	energy := func(offset int) int {
+		var total int
+		for _, s := range sums[offset : offset+window] {
+			total += s
+		}
+		return total
+	}
+	center := (len(sums) - window) / 2
+	best, bestEnergy := center, energy(center)
+	for offset := 0; offset <= len(sums)-window; offset++ {
+		if e := energy(offset); e > bestEnergy {
+			best, bestEnergy = offset, e
+		}
+	}
+	if best == center {
+		return focusCrop(b, w, h, 0.5, 0.5)
+	}
+
+	pos := clamp(best*length/len(sums), 0, length-size)
+	if horizontal {
+		return image.Rect(pos, 0, pos+cw, ch).Add(b.Min)
+	}
+	return image.Rect(0, pos, cw, pos+ch).Add(b.Min)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
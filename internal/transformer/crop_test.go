@@ -0,0 +1,136 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFill(t *testing.T) {
+	// use simpler filter while testing that won't skew colors
+	resampleFilter = imaging.Box
+
+	// 4x2, red on the left, blue on the right
+	src := newImage(4, 2, red, red, blue, blue, red, red, blue, blue)
+
+	tests := []struct {
+		rule string
+		want image.Image
+	}{
+		{"1x1,left", newImage(1, 1, red)},
+		{"1x1,right", newImage(1, 1, blue)},
+		{"1x1,bottomleft", newImage(1, 1, red)},
+		{"1x1,fp0:0.5", newImage(1, 1, red)},
+		{"1x1,fp1:0.5", newImage(1, 1, blue)},
+	}
+
+	for _, tt := range tests {
+		if got := transformImage(src, ParseOptions(tt.rule)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("transformImage(%q) returned image %#v, want %#v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestFocusCrop(t *testing.T) {
+	b := image.Rect(0, 0, 400, 200)
+
+	tests := []struct {
+		x, y float64
+		want image.Rectangle
+	}{
+		{0.5, 0.5, image.Rect(100, 0, 300, 200)},
+		{0, 0, image.Rect(0, 0, 200, 200)},
+		{0.3, 0.5, image.Rect(20, 0, 220, 200)},
+		{1, 1, image.Rect(200, 0, 400, 200)},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, focusCrop(b, 100, 100, tt.x, tt.y), "focusCrop(%v, %v) should match", tt.x, tt.y)
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// flat, except for a checkered area
+	checkered := func(w, h int, area image.Rectangle) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := color.NRGBA{128, 128, 128, 255}
+				if (image.Point{x, y}).In(area) && (x+y)%2 == 0 {
+					c = color.NRGBA{255, 255, 255, 255}
+				}
+				m.Set(x, y, c)
+			}
+		}
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		detail image.Rectangle
+		w, h   int
+		size   image.Point
+	}{
+		{"detail on the right", image.Rect(220, 0, 280, 100), 1, 1, image.Pt(100, 100)},
+		{"detail at the top", image.Rect(0, 10, 100, 60), 1, 1, image.Pt(100, 100)},
+		{"same aspect ratio", image.Rect(220, 0, 280, 100), 3, 1, image.Pt(300, 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := 300, 100
+			if tt.detail.Dx() == 100 {
+				w, h = 100, 300
+			}
+			got := smartCrop(checkered(w, h, tt.detail), tt.w, tt.h)
+			if !assert.Equal(t, tt.size, got.Size(), "size should match") {
+				return
+			}
+			assert.True(t, tt.detail.In(got), "crop %v should contain %v", got, tt.detail)
+		})
+	}
+
+	t.Run("large image", func(t *testing.T) {
+		detail := image.Rect(0, 0, 300, 400)
+		got := smartCrop(checkered(1200, 400, detail), 1, 1)
+		assert.True(t, detail.In(got), "crop %v should contain %v", got, detail)
+	})
+
+	t.Run("no detail", func(t *testing.T) {
+		got := smartCrop(checkered(300, 100, image.Rectangle{}), 1, 1)
+		assert.Equal(t, image.Rect(100, 0, 200, 100), got, "crop should be centered")
+	})
+}
+
+func TestSignedCropRectangle(t *testing.T) {
+	// use simpler filter while testing that won't skew colors
+	resampleFilter = imaging.Box
+
+	// 4x2, red on the left, blue on the right
+	src := newImage(4, 2, red, red, blue, blue, red, red, blue, blue)
+
+	// the crop rectangle of signed options takes precedence over the
+	// one in the preset rule
+	tests := []struct {
+		rule  string
+		extra string
+		want  image.Image
+	}{
+		{"1x1", "cx2,cy0,cw2,ch2", newImage(1, 1, blue)},
+		{"1x1", "cx0.5,cw0.5", newImage(1, 1, blue)},
+		{"1x1,cx0,cw2", "cx2", newImage(1, 1, blue)},
+		{"1x1,cx2,cw2", "cx0", newImage(1, 1, red)},
+	}
+
+	for _, tt := range tests {
+		if got := transformImage(src, ParseOptions(MergeOptions(tt.rule, tt.extra))); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("transformImage(%q + %q) returned image %#v, want %#v", tt.rule, tt.extra, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package transformer
+
+import (
+	"encoding/binary"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// orientationTag is the EXIF tag holding the orientation of the image
+const orientationTag = 0x0112
+
+// exifOrientation returns the value of the EXIF Orientation tag
+// (1 through 8) of the JPEG or TIFF image in data. 1, which means
+// that no correction is necessary, is returned if the image does
+// not have the tag, or if it can't be parsed
+func exifOrientation(data []byte) int {
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8 {
+		return jpegOrientation(data[2:])
+	}
+	return tiffOrientation(data)
+}
+
+// jpegOrientation looks for the APP1 segment holding the EXIF
+// metadata, which comes before the image data
+func jpegOrientation(data []byte) int {
+	for len(data) >= 4 {
+		if data[0] != 0xFF {
+			return 1
+		}
+
+		marker := data[1]
+		switch {
+		case marker == 0xFF:
+			// fill byte
+			data = data[1:]
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8):
+			// markers without a length
+			data = data[2:]
+			continue
+		case marker == 0xD9 || marker == 0xDA:
+			// end of image, or start of the image data
+			return 1
+		}
+
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if l < 2 || len(data) < 2+l {
+			return 1
+		}
+
+		if seg := data[4 : 2+l]; marker == 0xE1 && len(seg) >= 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(seg[6:])
+		}
+		data = data[2+l:]
+	}
+	return 1
+}
+
+// tiffOrientation reads the Orientation tag from the first IFD of the
+// TIFF structure in data, which is also how EXIF metadata is stored
+func tiffOrientation(data []byte) int {
+	order, offset := findOrientation(data)
+	if offset < 0 {
+		return 1
+	}
+	if v := int(order.Uint16(data[offset:])); v >= 1 && v <= 8 {
+		return v
+	}
+	return 1
+}
+
+// resetOrientation sets the Orientation tag in the TIFF structure in
+// data to 1, if it exists. This is done to EXIF metadata that is kept
+// in images that have already been rotated according to it
+func resetOrientation(data []byte) {
+	if order, offset := findOrientation(data); offset >= 0 {
+		order.PutUint16(data[offset:], 1)
+	}
+}
+
+// findOrientation returns the byte order of the TIFF structure in
+// data, and the offset of the value of the Orientation tag in its
+// first IFD. The offset is -1 if the tag can't be found
+func findOrientation(data []byte) (binary.ByteOrder, int) {
+	if len(data) < 8 {
+		return nil, -1
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, -1
+	}
+
+	offset := int(order.Uint32(data[4:8]))
+	if offset < 8 || offset+2 > len(data) {
+		return nil, -1
+	}
+
+	count := int(order.Uint16(data[offset:]))
+	pos := offset + 2
+	for i := 0; i < count && pos+12 <= len(data); i++ {
+		entry := data[pos : pos+12]
+		if order.Uint16(entry[0:2]) != orientationTag {
+			pos += 12
+			continue
+		}
+
+		// The value must be a single SHORT, which is stored in the
+		// first 2 bytes of the value field
+		if order.Uint16(entry[2:4]) != 3 || order.Uint32(entry[4:8]) != 1 {
+			return nil, -1
+		}
+		return order, pos + 8
+	}
+	return nil, -1
+}
+
+// orient rotates and flips m according to the EXIF orientation, so
+// that the image is upright
+func orient(m image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(m)
+	case 3:
+		return imaging.Rotate180(m)
+	case 4:
+		return imaging.FlipV(m)
+	case 5:
+		return imaging.Transpose(m)
+	case 6:
+		return imaging.Rotate270(m)
+	case 7:
+		return imaging.Transverse(m)
+	case 8:
+		return imaging.Rotate90(m)
+	}
+	return m
+}
@@ -0,0 +1,110 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newTIFFHeader creates a TIFF structure whose first IFD only
+// contains the Orientation tag
+func newTIFFHeader(order binary.ByteOrder, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, order, uint32(8)) // offset of the first IFD
+	binary.Write(&buf, order, uint16(1)) // number of entries
+	binary.Write(&buf, order, uint16(orientationTag))
+	binary.Write(&buf, order, uint16(3)) // SHORT
+	binary.Write(&buf, order, uint32(1)) // count
+	binary.Write(&buf, order, orientation)
+	binary.Write(&buf, order, uint16(0)) // padding
+	binary.Write(&buf, order, uint32(0)) // no next IFD
+	return buf.Bytes()
+}
+
+// newJPEG encodes m as a JPEG, with an EXIF segment holding the
+// orientation inserted right after the SOI marker
+func newJPEG(t *testing.T, m image.Image, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if !assert.NoError(t, jpeg.Encode(&buf, m, nil), "jpeg.Encode should succeed") {
+		t.FailNow()
+	}
+	encoded := buf.Bytes()
+
+	exif := append([]byte("Exif\x00\x00"), newTIFFHeader(binary.BigEndian, orientation)...)
+	var out bytes.Buffer
+	out.Write(encoded[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(exif)+2))
+	out.Write(exif)
+	out.Write(encoded[2:])
+	return out.Bytes()
+}
+
+func TestExifOrientation(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 2))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected int
+	}{
+		{"empty", nil, 1},
+		{"garbage", []byte("Hello, World!"), 1},
+		{"tiff, little endian", newTIFFHeader(binary.LittleEndian, 6), 6},
+		{"tiff, big endian", newTIFFHeader(binary.BigEndian, 8), 8},
+		{"tiff, bad value", newTIFFHeader(binary.LittleEndian, 9), 1},
+		{"truncated tiff", newTIFFHeader(binary.LittleEndian, 6)[:12], 1},
+		{"jpeg", newJPEG(t, m, 3), 3},
+		{"jpeg without exif", newJPEG(t, m, 1)[:2], 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, exifOrientation(tt.data), "orientation should match")
+		})
+	}
+}
+
+func TestTransformOrientation(t *testing.T) {
+	// 4x2, but should be displayed rotated 90 degrees clockwise
+	src := newJPEG(t, image.NewRGBA(image.Rect(0, 0, 4, 2)), 6)
+
+	tests := []struct {
+		name     string
+		opt      Options
+		expected image.Rectangle
+	}{
+		{"auto orient", Options{Width: 100}, image.Rect(0, 0, 2, 4)},
+		{"noorient", Options{Width: 100, NoAutoOrient: true}, image.Rect(0, 0, 4, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := bbpool.Get()
+			defer bbpool.Release(dst)
+
+			if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(src), tt.opt), "transform should succeed") {
+				return
+			}
+
+			cfg, err := jpeg.DecodeConfig(dst)
+			if !assert.NoError(t, err, "jpeg.DecodeConfig should succeed") {
+				return
+			}
+			assert.Equal(t, tt.expected, image.Rect(0, 0, cfg.Width, cfg.Height), "dimensions should match")
+		})
+	}
+}
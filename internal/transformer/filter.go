@@ -0,0 +1,73 @@
+package transformer
+
+import (
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// parseFilter parses one of the filter options. false is returned if
+// opt is not a filter option
+func parseFilter(options *Options, opt string) bool {
+	value := func(prefix string, min, max float64) (float64, bool) {
+		v, err := strconv.ParseFloat(strings.TrimPrefix(opt, prefix), 64)
+		if err != nil || v < min || v > max {
+			return 0, false
+		}
+		return v, true
+	}
+
+	switch {
+	case opt == "gray":
+		options.Grayscale = true
+	case strings.HasPrefix(opt, "blur"):
+		if v, ok := value("blur", 0, 100); ok {
+			options.Blur = v
+		}
+	case strings.HasPrefix(opt, "sharpen"):
+		if v, ok := value("sharpen", 0, 100); ok {
+			options.Sharpen = v
+		}
+	case strings.HasPrefix(opt, "brightness"):
+		if v, ok := value("brightness", -100, 100); ok {
+			options.Brightness = v
+		}
+	case strings.HasPrefix(opt, "contrast"):
+		if v, ok := value("contrast", -100, 100); ok {
+			options.Contrast = v
+		}
+	case strings.HasPrefix(opt, "gamma"):
+		if v, ok := value("gamma", 0, 10); ok && v > 0 {
+			options.Gamma = v
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// filter applies the filters specified in opt to m, in the following
+// order: grayscale, brightness, contrast, gamma, sharpen, blur
+func filter(m image.Image, opt Options) image.Image {
+	if opt.Grayscale {
+		m = imaging.Grayscale(m)
+	}
+	if opt.Brightness != 0 {
+		m = imaging.AdjustBrightness(m, opt.Brightness)
+	}
+	if opt.Contrast != 0 {
+		m = imaging.AdjustContrast(m, opt.Contrast)
+	}
+	if opt.Gamma != 0 && opt.Gamma != 1 {
+		m = imaging.AdjustGamma(m, opt.Gamma)
+	}
+	if opt.Sharpen > 0 {
+		m = imaging.Sharpen(m, opt.Sharpen)
+	}
+	if opt.Blur > 0 {
+		m = imaging.Blur(m, opt.Blur)
+	}
+	return m
+}
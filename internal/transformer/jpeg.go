@@ -0,0 +1,579 @@
+package transformer
+
+// The JPEG encoder of the standard library only writes baseline JPEG
+// images with 4:2:0 chroma subsampling. This file implements the
+// encoder used when progressive encoding or another subsampling ratio
+// is requested. It uses the same quantization and Huffman tables as
+// the standard library (section K of the JPEG specification), so that
+// images look the same, whichever encoder is used.
+//
+// Progressive images are encoded using spectral selection only: the DC
+// coefficients of all components come first, followed by the low
+// frequency AC coefficients of the luma, the AC coefficients of the
+// chroma, and then the rest of the luma.
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// Subsampling is the chroma subsampling of JPEG images
+type Subsampling int
+
+const (
+	Subsampling420 Subsampling = iota // chroma at half the width and height. The default
+	Subsampling422                    // chroma at half the width
+	Subsampling444                    // no subsampling
+)
+
+var subsamplingNames = map[Subsampling]string{
+	Subsampling420: "sub420",
+	Subsampling422: "sub422",
+	Subsampling444: "sub444",
+}
+
+func (s Subsampling) String() string {
+	return subsamplingNames[s]
+}
+
+func parseSubsampling(s string) (Subsampling, bool) {
+	for sub, name := range subsamplingNames {
+		if name == s {
+			return sub, true
+		}
+	}
+	return Subsampling420, false
+}
+
+// jpegOptions are the parameters of JPEG encoding
+type jpegOptions struct {
+	Quality     int
+	Progressive bool
+	Subsampling Subsampling
+}
+
+// writeJPEG encodes m as a JPEG image. Baseline 4:2:0 images are
+// encoded with the standard library, the rest with jpegEncoder
+func writeJPEG(w io.Writer, m image.Image, o *jpegOptions) error {
+	if o == nil {
+		return jpeg.Encode(w, m, nil)
+	}
+	if !o.Progressive && o.Subsampling == Subsampling420 {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: o.Quality})
+	}
+
+	b := m.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New(`image is too large to encode`)
+	}
+
+	e := jpegEncoder{w: bufio.NewWriter(w)}
+	e.encode(m, o)
+	return e.err
+}
+
+// unzig maps from the zig-zag ordering to the natural ordering
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// unscaledQuant are the quantization tables of section K.1 in zig-zag
+// order, for luminance and chrominance respectively
+var unscaledQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table of section K.3. count[i] is the
+// number of codes of length i+1 bits, and value the decoded values
+type huffmanSpec struct {
+	class, id byte
+	count     [16]byte
+	value     []byte
+}
+
+// the luminance DC, luminance AC, chrominance DC and chrominance AC
+// tables, in that order
+var huffmanSpecs = [4]huffmanSpec{
+	{
+		0, 0,
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		1, 0,
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		0, 1,
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		1, 1,
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCodes maps each value of a huffmanSpec to its code, with the
+// length of the code in the upper 8 bits
+type huffmanCodes [256]uint32
+
+var huffmanTables [4]huffmanCodes
+
+// dctCos[x][u] is cos((2x+1)uπ/16), scaled by 1/√2 when u is 0
+var dctCos [8][8]float64
+
+func init() {
+	for i, s := range huffmanSpecs {
+		code, k := uint32(0), 0
+		for n, count := range s.count {
+			for j := byte(0); j < count; j++ {
+				huffmanTables[i][s.value[k]] = uint32(n+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+			if u == 0 {
+				c /= math.Sqrt2
+			}
+			dctCos[x][u] = c
+		}
+	}
+}
+
+// jpegBlock holds the 64 coefficients of an 8x8 block, in zig-zag order
+type jpegBlock [64]int32
+
+// jpegComponent is a component of the image, and its coefficients
+type jpegComponent struct {
+	id      byte
+	h, v    int // sampling factors
+	quant   int // index of the quantization table
+	huffman int // index of the DC Huffman table. The AC table follows it
+	// width and height in blocks, as stored in the interleaved scans,
+	// and as covered by the image, for the non-interleaved scans
+	bw, bh       int
+	blocksX      int
+	blocksY      int
+	coefficients []jpegBlock
+}
+
+type jpegEncoder struct {
+	w     *bufio.Writer
+	err   error
+	bits  uint32
+	nBits uint32
+	quant [2][64]byte
+}
+
+func (e *jpegEncoder) encode(m image.Image, o *jpegOptions) {
+	e.setQuality(o.Quality)
+
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	components := e.components(m, o.Subsampling)
+
+	e.write([]byte{0xff, 0xd8})
+	e.writeDQT(len(components))
+	e.writeSOF(width, height, components, o.Progressive)
+	e.writeDHT(len(components))
+	if o.Progressive {
+		e.writeScan(components, 0, 0)
+		if len(components) == 1 {
+			e.writeScan(components, 1, 5)
+			e.writeScan(components, 6, 63)
+		} else {
+			e.writeScan(components[:1], 1, 5)
+			e.writeScan(components[1:2], 1, 63)
+			e.writeScan(components[2:], 1, 63)
+			e.writeScan(components[:1], 6, 63)
+		}
+	} else {
+		e.writeScan(components, 0, 63)
+	}
+	e.write([]byte{0xff, 0xd9})
+
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+}
+
+// setQuality scales the quantization tables the same way as the
+// standard library does
+func (e *jpegEncoder) setQuality(quality int) {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			x := (int(unscaledQuant[i][j])*scale + 50) / 100
+			if x < 1 {
+				x = 1
+			} else if x > 255 {
+				x = 255
+			}
+			e.quant[i][j] = byte(x)
+		}
+	}
+}
+
+// components converts m to the components of the JPEG image, and
+// computes their coefficients. Grayscale images have one component,
+// and the rest have three, with the chroma subsampled as requested
+func (e *jpegEncoder) components(m image.Image, sub Subsampling) []*jpegComponent {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	var planes [3][]byte
+	var components []*jpegComponent
+	if g, ok := m.(*image.Gray); ok {
+		planes[0] = make([]byte, width*height)
+		for y := 0; y < height; y++ {
+			copy(planes[0][y*width:], g.Pix[g.PixOffset(b.Min.X, b.Min.Y+y):][:width])
+		}
+		components = []*jpegComponent{{id: 1, h: 1, v: 1}}
+	} else {
+		for i := range planes {
+			planes[i] = make([]byte, width*height)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				i := y*width + x
+				planes[0][i], planes[1][i], planes[2][i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			}
+		}
+
+		h, v := 2, 2
+		switch sub {
+		case Subsampling422:
+			v = 1
+		case Subsampling444:
+			h, v = 1, 1
+		}
+		components = []*jpegComponent{
+			{id: 1, h: h, v: v},
+			{id: 2, h: 1, v: 1, quant: 1, huffman: 2},
+			{id: 3, h: 1, v: 1, quant: 1, huffman: 2},
+		}
+	}
+
+	hmax, vmax := components[0].h, components[0].v
+	mcusX := (width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (height + 8*vmax - 1) / (8 * vmax)
+	for i, c := range components {
+		// each sample of the component is the average of sx by sy
+		// pixels. Pixels past the edges repeat the last ones
+		sx, sy := hmax/c.h, vmax/c.v
+		c.bw, c.bh = mcusX*c.h, mcusY*c.v
+		c.blocksX = ((width+sx-1)/sx + 7) / 8
+		c.blocksY = ((height+sy-1)/sy + 7) / 8
+		c.coefficients = make([]jpegBlock, c.bw*c.bh)
+
+		var samples [64]float64
+		for by := 0; by < c.bh; by++ {
+			for bx := 0; bx < c.bw; bx++ {
+				for j := 0; j < 8; j++ {
+					for k := 0; k < 8; k++ {
+						sum := 0
+						for dy := 0; dy < sy; dy++ {
+							py := clamp((by*8+j)*sy+dy, 0, height-1)
+							for dx := 0; dx < sx; dx++ {
+								px := clamp((bx*8+k)*sx+dx, 0, width-1)
+								sum += int(planes[i][py*width+px])
+							}
+						}
+						samples[j*8+k] = float64(sum)/float64(sx*sy) - 128
+					}
+				}
+				e.transformBlock(&c.coefficients[by*c.bw+bx], &samples, c.quant)
+			}
+		}
+	}
+	return components
+}
+
+// transformBlock computes the quantized DCT coefficients of the
+// samples, which are in natural order. The rows are transformed
+// first, and then the columns
+func (e *jpegEncoder) transformBlock(dst *jpegBlock, samples *[64]float64, quant int) {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += samples[y*8+x] * dctCos[x][u]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	for zig, natural := range unzig {
+		u, v := natural%8, natural/8
+		sum := 0.0
+		for y := 0; y < 8; y++ {
+			sum += rows[y*8+u] * dctCos[y][v]
+		}
+		dst[zig] = int32(math.Floor(sum/4/float64(e.quant[quant][zig]) + 0.5))
+	}
+}
+
+func (e *jpegEncoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *jpegEncoder) writeMarkerHeader(marker byte, length int) {
+	e.write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+}
+
+func (e *jpegEncoder) writeDQT(ncomponents int) {
+	tables := 2
+	if ncomponents == 1 {
+		tables = 1
+	}
+	e.writeMarkerHeader(0xdb, 2+tables*65)
+	for i := 0; i < tables; i++ {
+		e.write([]byte{byte(i)})
+		e.write(e.quant[i][:])
+	}
+}
+
+// writeSOF writes the SOF0 (baseline) or SOF2 (progressive) marker
+func (e *jpegEncoder) writeSOF(width, height int, components []*jpegComponent, progressive bool) {
+	marker := byte(0xc0)
+	if progressive {
+		marker = 0xc2
+	}
+	e.writeMarkerHeader(marker, 8+3*len(components))
+	e.write([]byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(components))})
+	for _, c := range components {
+		e.write([]byte{c.id, byte(c.h<<4 | c.v), byte(c.quant)})
+	}
+}
+
+func (e *jpegEncoder) writeDHT(ncomponents int) {
+	specs := huffmanSpecs[:]
+	if ncomponents == 1 {
+		specs = specs[:2]
+	}
+
+	length := 2
+	for _, s := range specs {
+		length += 1 + 16 + len(s.value)
+	}
+	e.writeMarkerHeader(0xc4, length)
+	for _, s := range specs {
+		e.write([]byte{s.class<<4 | s.id})
+		e.write(s.count[:])
+		e.write(s.value)
+	}
+}
+
+// writeScan writes the coefficients from ss to se (in zig-zag order)
+// of the given components. Scans of more than one component are
+// interleaved, and scans of a single component cover only the blocks
+// within the image
+func (e *jpegEncoder) writeScan(components []*jpegComponent, ss, se int) {
+	e.writeMarkerHeader(0xda, 6+2*len(components))
+	e.write([]byte{byte(len(components))})
+	for _, c := range components {
+		id := byte(c.huffman / 2)
+		e.write([]byte{c.id, id<<4 | id})
+	}
+	e.write([]byte{byte(ss), byte(se), 0})
+
+	// the DC coefficients are encoded as the difference from the
+	// previous block of the same component
+	prev := make([]int32, len(components))
+	if len(components) == 1 {
+		c := components[0]
+		for by := 0; by < c.blocksY; by++ {
+			for bx := 0; bx < c.blocksX; bx++ {
+				e.writeBlock(&c.coefficients[by*c.bw+bx], c, ss, se, &prev[0])
+			}
+		}
+	} else {
+		c0 := components[0]
+		for my := 0; my < c0.bh/c0.v; my++ {
+			for mx := 0; mx < c0.bw/c0.h; mx++ {
+				for i, c := range components {
+					for j := 0; j < c.v; j++ {
+						for k := 0; k < c.h; k++ {
+							e.writeBlock(&c.coefficients[(my*c.v+j)*c.bw+mx*c.h+k], c, ss, se, &prev[i])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// pad the last byte with 1s
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// writeBlock writes the coefficients from ss to se of b. Runs of zeros
+// until se are written as an end of block
+func (e *jpegEncoder) writeBlock(b *jpegBlock, c *jpegComponent, ss, se int, prevDC *int32) {
+	if ss == 0 {
+		e.emitValue(c.huffman, 0, b[0]-*prevDC)
+		*prevDC = b[0]
+		ss = 1
+	}
+	if se == 0 {
+		return
+	}
+
+	ac, run := c.huffman+1, int32(0)
+	for zig := ss; zig <= se; zig++ {
+		if b[zig] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitHuffman(ac, 0xf0)
+			run -= 16
+		}
+		e.emitValue(ac, run, b[zig])
+		run = 0
+	}
+	if run > 0 {
+		e.emitHuffman(ac, 0x00)
+	}
+}
+
+// emit writes the lowest n bits of bits, stuffing a zero byte after
+// each 0xff byte
+func (e *jpegEncoder) emit(bits, n uint32) {
+	n += e.nBits
+	bits <<= 32 - n
+	bits |= e.bits
+	for n >= 8 {
+		b := byte(bits >> 24)
+		e.write([]byte{b})
+		if b == 0xff {
+			e.write([]byte{0})
+		}
+		bits <<= 8
+		n -= 8
+	}
+	e.bits, e.nBits = bits, n
+}
+
+func (e *jpegEncoder) emitHuffman(table int, value byte) {
+	code := huffmanTables[table][value]
+	e.emit(code&(1<<24-1), code>>24)
+}
+
+// emitValue writes the run of zeros followed by value. The Huffman
+// code carries the run and the number of bits of the value, which
+// follows it as is if positive, and minus one if negative
+func (e *jpegEncoder) emitValue(table int, run, value int32) {
+	a, bits := value, value
+	if a < 0 {
+		a, bits = -value, value-1
+	}
+	n := uint32(0)
+	for a > 0 {
+		n++
+		a >>= 1
+	}
+	e.emitHuffman(table, byte(run<<4)|byte(n))
+	if n > 0 {
+		e.emit(uint32(bits)&(1<<n-1), n)
+	}
+}
@@ -0,0 +1,76 @@
+package transformer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJPEG(t *testing.T) {
+	// odd sizes, so that the blocks and MCUs at the edges are partial
+	colored := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	gray := image.NewGray(image.Rect(0, 0, 37, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			colored.Set(x, y, color.NRGBA{uint8(x * 6), uint8(y * 12), uint8(255 - x*6), 255})
+			gray.Set(x, y, color.Gray{uint8((x + y) * 4)})
+		}
+	}
+
+	tests := []struct {
+		Image       image.Image
+		Options     jpegOptions
+		Marker      byte
+		Subsampling image.YCbCrSubsampleRatio
+	}{
+		{colored, jpegOptions{Quality: 90}, 0xc0, image.YCbCrSubsampleRatio420},
+		{colored, jpegOptions{Quality: 90, Subsampling: Subsampling444}, 0xc0, image.YCbCrSubsampleRatio444},
+		{colored, jpegOptions{Quality: 90, Subsampling: Subsampling422}, 0xc0, image.YCbCrSubsampleRatio422},
+		{colored, jpegOptions{Quality: 90, Progressive: true}, 0xc2, image.YCbCrSubsampleRatio420},
+		{colored, jpegOptions{Quality: 90, Progressive: true, Subsampling: Subsampling444}, 0xc2, image.YCbCrSubsampleRatio444},
+		{colored, jpegOptions{Quality: 90, Progressive: true, Subsampling: Subsampling422}, 0xc2, image.YCbCrSubsampleRatio422},
+		{gray, jpegOptions{Quality: 90, Progressive: true}, 0xc2, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprintf("%T/%+v", tt.Image, tt.Options), func(t *testing.T) {
+			var buf bytes.Buffer
+			if !assert.NoError(t, writeJPEG(&buf, tt.Image, &tt.Options), "writeJPEG should succeed") {
+				return
+			}
+			if !assert.True(t, bytes.Contains(buf.Bytes(), []byte{0xff, tt.Marker}), "image should have the SOF marker %x", tt.Marker) {
+				return
+			}
+
+			decoded, err := jpeg.Decode(&buf)
+			if !assert.NoError(t, err, "jpeg.Decode should succeed") {
+				return
+			}
+			if !assert.Equal(t, tt.Image.Bounds(), decoded.Bounds(), "bounds should match") {
+				return
+			}
+			if ycbcr, ok := decoded.(*image.YCbCr); ok {
+				assert.Equal(t, tt.Subsampling, ycbcr.SubsampleRatio, "subsampling should match")
+			}
+
+			// the image should look the same, give or take the loss
+			var diff, n int
+			b := decoded.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					r1, g1, b1, _ := tt.Image.At(x, y).RGBA()
+					r2, g2, b2, _ := decoded.At(x, y).RGBA()
+					diff += abs(int(r1>>8)-int(r2>>8)) + abs(int(g1>>8)-int(g2>>8)) + abs(int(b1>>8)-int(b2>>8))
+					n += 3
+				}
+			}
+			assert.True(t, diff/n < 4, "average difference should be small (%d)", diff/n)
+		})
+	}
+}
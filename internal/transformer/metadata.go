@@ -0,0 +1,291 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+)
+
+// MetadataPolicy specifies which metadata of the source image is kept
+// in the transformed image. Encoders do not write any metadata, so
+// everything else is stripped
+type MetadataPolicy int
+
+const (
+	StripMetadata  MetadataPolicy = iota // keep nothing (the default)
+	KeepICCProfile                       // keep the ICC color profile only
+	KeepMetadata                         // keep the ICC color profile, EXIF, XMP, IPTC and comments
+)
+
+func (p MetadataPolicy) String() string {
+	switch p {
+	case KeepICCProfile:
+		return "keepicc"
+	case KeepMetadata:
+		return "keepmeta"
+	}
+	return "strip"
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// jpegSegment is a marker segment in a JPEG image
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// pngChunk is an ancillary chunk in a PNG image
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// keepJPEG returns true if a JPEG segment with the given marker and
+// payload should be kept under the policy
+func (p MetadataPolicy) keepJPEG(marker byte, payload []byte) bool {
+	if marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")) {
+		return p != StripMetadata
+	}
+	if p != KeepMetadata {
+		return false
+	}
+
+	switch marker {
+	case 0xE1, 0xED, 0xFE: // EXIF and XMP, IPTC, comments
+		return true
+	}
+	return false
+}
+
+// keepPNG returns true if a PNG chunk of the given type should be
+// kept under the policy
+func (p MetadataPolicy) keepPNG(typ string) bool {
+	switch typ {
+	case "iCCP":
+		return p != StripMetadata
+	case "eXIf", "tEXt", "zTXt", "iTXt":
+		return p == KeepMetadata
+	}
+	return false
+}
+
+// isJPEGMetadata returns true if a JPEG segment with the given marker
+// and payload holds metadata that is subject to the policy
+func isJPEGMetadata(marker byte, payload []byte) bool {
+	switch marker {
+	case 0xE1, 0xED, 0xFE:
+		return true
+	case 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	}
+	return false
+}
+
+// isPNGMetadata returns true if a PNG chunk of the given type holds
+// metadata that is subject to the policy
+func isPNGMetadata(typ string) bool {
+	switch typ {
+	case "iCCP", "eXIf", "tEXt", "zTXt", "iTXt":
+		return true
+	}
+	return false
+}
+
+// stripMetadata copies the image in data to dst as is, except for
+// the metadata that should not be kept under the policy. Only JPEG
+// and PNG images carry metadata, so anything else is copied verbatim
+func stripMetadata(dst io.Writer, data []byte, policy MetadataPolicy) error {
+	out := bbpool.Get()
+	defer bbpool.Release(out)
+
+	switch {
+	case len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8:
+		out.Write(data[:2])
+		data = data[2:]
+	loop:
+		for len(data) >= 4 && data[0] == 0xFF {
+			marker := data[1]
+			switch {
+			case marker == 0xFF:
+				out.WriteByte(0xFF)
+				data = data[1:]
+				continue
+			case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8):
+				out.Write(data[:2])
+				data = data[2:]
+				continue
+			case marker == 0xD9 || marker == 0xDA:
+				break loop
+			}
+
+			l := int(binary.BigEndian.Uint16(data[2:4]))
+			if l < 2 || len(data) < 2+l {
+				break
+			}
+			if payload := data[4 : 2+l]; !isJPEGMetadata(marker, payload) || policy.keepJPEG(marker, payload) {
+				out.Write(data[:2+l])
+			}
+			data = data[2+l:]
+		}
+	case bytes.HasPrefix(data, pngSignature):
+		out.Write(pngSignature)
+		data = data[len(pngSignature):]
+		for len(data) >= 12 {
+			l := int(binary.BigEndian.Uint32(data[:4]))
+			if l < 0 || len(data) < 12+l {
+				break
+			}
+			if typ := string(data[4:8]); !isPNGMetadata(typ) || policy.keepPNG(typ) {
+				out.Write(data[:12+l])
+			}
+			data = data[12+l:]
+		}
+	}
+	// the image data, and anything that could not be parsed
+	out.Write(data)
+
+	_, err := out.WriteTo(dst)
+	return err
+}
+
+// jpegMetadata returns the segments in the JPEG image in data that
+// should be kept under the policy. If the image has been rotated
+// according to its EXIF orientation, reset should be true
+func jpegMetadata(data []byte, policy MetadataPolicy, reset bool) []jpegSegment {
+	if policy == StripMetadata || len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	var segments []jpegSegment
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xFF {
+		marker := data[1]
+		switch {
+		case marker == 0xFF:
+			data = data[1:]
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8):
+			data = data[2:]
+			continue
+		case marker == 0xD9 || marker == 0xDA:
+			return segments
+		}
+
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if l < 2 || len(data) < 2+l {
+			return segments
+		}
+
+		if payload := data[4 : 2+l]; policy.keepJPEG(marker, payload) {
+			payload = append([]byte(nil), payload...)
+			if reset && marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				resetOrientation(payload[6:])
+			}
+			segments = append(segments, jpegSegment{marker: marker, payload: payload})
+		}
+		data = data[2+l:]
+	}
+	return segments
+}
+
+// pngMetadata returns the chunks in the PNG image in data that should
+// be kept under the policy. If the image has been rotated according to
+// its EXIF orientation, reset should be true
+func pngMetadata(data []byte, policy MetadataPolicy, reset bool) []pngChunk {
+	if policy == StripMetadata || !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+
+	var chunks []pngChunk
+	data = data[len(pngSignature):]
+	for len(data) >= 12 {
+		l := int(binary.BigEndian.Uint32(data[:4]))
+		if l < 0 || len(data) < 12+l {
+			return chunks
+		}
+
+		typ := string(data[4:8])
+		if typ == "IDAT" || typ == "IEND" {
+			return chunks
+		}
+
+		if policy.keepPNG(typ) {
+			chunk := pngChunk{typ: typ, data: append([]byte(nil), data[8:8+l]...)}
+			if reset && typ == "eXIf" {
+				resetOrientation(chunk.data)
+			}
+			chunks = append(chunks, chunk)
+		}
+		data = data[12+l:]
+	}
+	return chunks
+}
+
+// encodeJPEG encodes m, and inserts the segments right after the SOI
+// marker
+func encodeJPEG(dst io.Writer, m image.Image, o *jpegOptions, segments []jpegSegment) error {
+	if len(segments) == 0 {
+		return writeJPEG(dst, m, o)
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if err := writeJPEG(buf, m, o); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
+
+	out := bbpool.Get()
+	defer bbpool.Release(out)
+	out.Write(encoded[:2])
+	for _, s := range segments {
+		out.Write([]byte{0xFF, s.marker})
+		binary.Write(out, binary.BigEndian, uint16(len(s.payload)+2))
+		out.Write(s.payload)
+	}
+	out.Write(encoded[2:])
+
+	_, err := out.WriteTo(dst)
+	return err
+}
+
+// encodePNG encodes m using enc, and inserts the chunks right after the
+// IHDR chunk, so that they come before the image data as required
+func encodePNG(dst io.Writer, m image.Image, enc *png.Encoder, chunks []pngChunk) error {
+	if len(chunks) == 0 {
+		return enc.Encode(dst, m)
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if err := enc.Encode(buf, m); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
+
+	// signature, followed by the length, type, data and CRC of IHDR
+	ihdr := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded[len(pngSignature):]))
+
+	out := bbpool.Get()
+	defer bbpool.Release(out)
+	out.Write(encoded[:ihdr])
+	for _, c := range chunks {
+		binary.Write(out, binary.BigEndian, uint32(len(c.data)))
+		crc := crc32.NewIEEE()
+		io.WriteString(crc, c.typ)
+		crc.Write(c.data)
+		out.WriteString(c.typ)
+		out.Write(c.data)
+		binary.Write(out, binary.BigEndian, crc.Sum32())
+	}
+	out.Write(encoded[ihdr:])
+
+	_, err := out.WriteTo(dst)
+	return err
+}
@@ -0,0 +1,171 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTransformMetadata(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	icc := []byte("ICC_PROFILE\x00\x01\x01dummy profile")
+	exif := append([]byte("Exif\x00\x00"), newTIFFHeader(binary.BigEndian, 6)...)
+	upright := append([]byte("Exif\x00\x00"), newTIFFHeader(binary.BigEndian, 1)...)
+
+	var jpegSrc bytes.Buffer
+	segments := []jpegSegment{
+		{marker: 0xE1, payload: exif},
+		{marker: 0xE2, payload: icc},
+		{marker: 0xFE, payload: []byte("(c) sharaq")},
+	}
+	if !assert.NoError(t, encodeJPEG(&jpegSrc, m, nil, segments), "encodeJPEG should succeed") {
+		return
+	}
+
+	var pngSrc bytes.Buffer
+	chunks := []pngChunk{
+		{typ: "iCCP", data: []byte("dummy\x00\x00profile")},
+		{typ: "tEXt", data: []byte("Copyright\x00sharaq")},
+		{typ: "eXIf", data: newTIFFHeader(binary.LittleEndian, 6)},
+	}
+	if !assert.NoError(t, encodePNG(&pngSrc, m, &png.Encoder{}, chunks), "encodePNG should succeed") {
+		return
+	}
+
+	t.Run("jpeg", func(t *testing.T) {
+		tests := []struct {
+			rule     string
+			expected []jpegSegment
+		}{
+			{"100", nil},
+			{"100,strip", nil},
+			{"100,keepicc", segments[1:2]},
+			{"100,keepmeta", []jpegSegment{{marker: 0xE1, payload: upright}, segments[1], segments[2]}},
+			{"100,keepmeta,noorient", segments},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.rule, func(t *testing.T) {
+				dst := bbpool.Get()
+				defer bbpool.Release(dst)
+
+				if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(jpegSrc.Bytes()), ParseOptions(tt.rule)), "transform should succeed") {
+					return
+				}
+				if _, _, err := image.Decode(bytes.NewReader(dst.Bytes())); !assert.NoError(t, err, "transformed image should be valid") {
+					return
+				}
+				assert.Equal(t, tt.expected, jpegMetadata(dst.Bytes(), KeepMetadata, false), "metadata should match")
+			})
+		}
+	})
+
+	t.Run("png", func(t *testing.T) {
+		tests := []struct {
+			rule     string
+			expected []pngChunk
+		}{
+			{"100", nil},
+			{"100,keepicc", chunks[:1]},
+			{"100,keepmeta", []pngChunk{chunks[0], chunks[1], {typ: "eXIf", data: newTIFFHeader(binary.LittleEndian, 1)}}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.rule, func(t *testing.T) {
+				dst := bbpool.Get()
+				defer bbpool.Release(dst)
+
+				if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(pngSrc.Bytes()), ParseOptions(tt.rule)), "transform should succeed") {
+					return
+				}
+				if _, _, err := image.Decode(bytes.NewReader(dst.Bytes())); !assert.NoError(t, err, "transformed image should be valid") {
+					return
+				}
+				assert.Equal(t, tt.expected, pngMetadata(dst.Bytes(), KeepMetadata, false), "metadata should match")
+			})
+		}
+	})
+}
+
+func TestPassthroughMetadata(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	icc := []byte("ICC_PROFILE\x00\x01\x01dummy profile")
+	upright := append([]byte("Exif\x00\x00"), newTIFFHeader(binary.BigEndian, 1)...)
+
+	encode := func(segments []jpegSegment, chunks []pngChunk) ([]byte, []byte, bool) {
+		var jpegBuf, pngBuf bytes.Buffer
+		if !assert.NoError(t, encodeJPEG(&jpegBuf, m, nil, segments), "encodeJPEG should succeed") {
+			return nil, nil, false
+		}
+		if !assert.NoError(t, encodePNG(&pngBuf, m, &png.Encoder{}, chunks), "encodePNG should succeed") {
+			return nil, nil, false
+		}
+		return jpegBuf.Bytes(), pngBuf.Bytes(), true
+	}
+
+	jpegSrc, pngSrc, ok := encode(
+		[]jpegSegment{{marker: 0xE1, payload: upright}, {marker: 0xE2, payload: icc}},
+		[]pngChunk{{typ: "iCCP", data: []byte("dummy\x00\x00profile")}, {typ: "eXIf", data: newTIFFHeader(binary.LittleEndian, 1)}},
+	)
+	if !ok {
+		return
+	}
+	jpegBare, pngBare, ok := encode(nil, nil)
+	if !ok {
+		return
+	}
+
+	tests := []struct {
+		name     string
+		src      []byte
+		expected []byte
+	}{
+		{"jpeg", jpegSrc, jpegBare},
+		{"png", pngSrc, pngBare},
+		{"other", []byte("not an image"), []byte("not an image")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := bbpool.Get()
+			defer bbpool.Release(dst)
+
+			if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(tt.src), ParseOptions("0x0")), "transform should succeed") {
+				return
+			}
+			assert.Equal(t, tt.expected, dst.Bytes(), "only the metadata should be removed")
+		})
+	}
+
+	// The orientation would be lost along with the EXIF metadata, so
+	// the image is rotated instead
+	rotated := append([]byte("Exif\x00\x00"), newTIFFHeader(binary.BigEndian, 6)...)
+	jpegSrc, _, ok = encode([]jpegSegment{{marker: 0xE1, payload: rotated}}, nil)
+	if !ok {
+		return
+	}
+
+	dst := bbpool.Get()
+	defer bbpool.Release(dst)
+	if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(jpegSrc), ParseOptions("0x0")), "transform should succeed") {
+		return
+	}
+	if !assert.Nil(t, jpegMetadata(dst.Bytes(), KeepMetadata, false), "metadata should be removed") {
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(dst.Bytes()))
+	if !assert.NoError(t, err, "transformed image should be valid") {
+		return
+	}
+	if !assert.Equal(t, 2, cfg.Width, "image should be rotated") {
+		return
+	}
+}
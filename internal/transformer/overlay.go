@@ -0,0 +1,190 @@
+package transformer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// overlay is an image composited onto transformed images, such as a
+// watermark
+type overlay struct {
+	image image.Image
+	hash  string // identifies the content of the image
+}
+
+// AddOverlay registers the image in content as the overlay with the
+// given name, which can then be referred to with the "wm:{name}" option.
+// Overlays should be added before they are used
+func (t *Transformer) AddOverlay(name string, content []byte) error {
+	if name == "" || strings.ContainsAny(name, ",@") {
+		return errors.Errorf(`invalid overlay name %q`, name)
+	}
+
+	m, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return errors.Wrapf(err, `failed to decode overlay %s`, name)
+	}
+
+	h := sha256.Sum256(content)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.overlays == nil {
+		t.overlays = make(map[string]*overlay)
+	}
+	t.overlays[name] = &overlay{
+		image: m,
+		hash:  hex.EncodeToString(h[:4]),
+	}
+	return nil
+}
+
+// BindOverlays returns rule with the overlay it refers to, if any,
+// pinned to the current content of the overlay. This changes the
+// RuleHash of the rule when the overlay image changes, so that the
+// variants are regenerated. An error is returned if the overlay
+// does not exist
+func (t *Transformer) BindOverlays(rule string) (string, error) {
+	opts := ParseOptions(rule)
+	if opts.Watermark == "" {
+		return rule, nil
+	}
+
+	o := t.overlay(opts.Watermark)
+	if o == nil {
+		return "", errors.Errorf(`overlay %s does not exist`, overlayName(opts.Watermark))
+	}
+	opts.Watermark = overlayName(opts.Watermark) + "@" + o.hash
+	return opts.String(), nil
+}
+
+// overlay returns the overlay referred to by name, which may be pinned
+// by BindOverlays. nil is returned if it does not exist
+func (t *Transformer) overlay(name string) *overlay {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.overlays[overlayName(name)]
+}
+
+// overlayName strips the content hash appended by BindOverlays
+func overlayName(name string) string {
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// parseOverlay parses one of the watermark options. false is returned
+// if opt is not a watermark option
+func parseOverlay(options *Options, opt string) bool {
+	kv := strings.SplitN(opt, ":", 2)
+	if len(kv) != 2 || !strings.HasPrefix(kv[0], "wm") {
+		return false
+	}
+
+	switch kv[0] {
+	case "wm":
+		options.Watermark = kv[1]
+	case "wmpos":
+		if g, ok := parseGravity(kv[1]); ok && g != GravitySmart {
+			options.WatermarkGravity = g
+		}
+	case "wmmargin":
+		if v, err := strconv.Atoi(kv[1]); err == nil && v >= 0 {
+			options.WatermarkMargin = v
+		}
+	case "wmscale":
+		if v, err := strconv.ParseFloat(kv[1], 64); err == nil && v > 0 && v <= 1 {
+			options.WatermarkScale = v
+		}
+	case "wmopacity":
+		if v, err := strconv.ParseFloat(kv[1], 64); err == nil && v > 0 && v <= 1 {
+			options.WatermarkOpacity = v
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// formatOverlay appends the watermark options to buf
+func formatOverlay(buf *bytes.Buffer, o Options) {
+	if o.Watermark == "" {
+		return
+	}
+
+	buf.WriteString(",wm:" + o.Watermark)
+	if o.WatermarkGravity != GravityCenter {
+		buf.WriteString(",wmpos:" + o.WatermarkGravity.String())
+	}
+	if o.WatermarkMargin != 0 {
+		buf.WriteString(",wmmargin:" + strconv.Itoa(o.WatermarkMargin))
+	}
+	if o.WatermarkScale != 0 {
+		buf.WriteString(",wmscale:" + strconv.FormatFloat(o.WatermarkScale, 'g', -1, 64))
+	}
+	if o.WatermarkOpacity != 0 {
+		buf.WriteString(",wmopacity:" + strconv.FormatFloat(o.WatermarkOpacity, 'g', -1, 64))
+	}
+}
+
+// composite draws the overlay onto m as specified in opt
+func (o *overlay) composite(m image.Image, opt Options) image.Image {
+	b := m.Bounds()
+	ov := o.image
+	if opt.WatermarkScale > 0 {
+		if w := int(float64(b.Dx()) * opt.WatermarkScale); w > 0 {
+			ov = imaging.Resize(ov, w, 0, opt.resampler())
+		}
+	}
+
+	// position of the overlay along each axis: -1 for the start, 0 for
+	// the center, and 1 for the end
+	var h, v int
+	switch opt.WatermarkGravity {
+	case GravityTop:
+		v = -1
+	case GravityBottom:
+		v = 1
+	case GravityLeft:
+		h = -1
+	case GravityRight:
+		h = 1
+	case GravityTopLeft:
+		h, v = -1, -1
+	case GravityTopRight:
+		h, v = 1, -1
+	case GravityBottomLeft:
+		h, v = -1, 1
+	case GravityBottomRight:
+		h, v = 1, 1
+	}
+
+	position := func(dir, size, osize int) int {
+		switch dir {
+		case -1:
+			return opt.WatermarkMargin
+		case 1:
+			return size - osize - opt.WatermarkMargin
+		}
+		return (size - osize) / 2
+	}
+	ob := ov.Bounds()
+	pt := image.Pt(position(h, b.Dx(), ob.Dx()), position(v, b.Dy(), ob.Dy()))
+
+	opacity := opt.WatermarkOpacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	return imaging.Overlay(m, ov, pt, opacity)
+}
@@ -0,0 +1,107 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func encodePNGImage(t *testing.T, m image.Image) []byte {
+	var buf bytes.Buffer
+	if !assert.NoError(t, png.Encode(&buf, m), "png.Encode should succeed") {
+		t.FailNow()
+	}
+	return buf.Bytes()
+}
+
+func TestOverlay(t *testing.T) {
+	// use simpler filter while testing that won't skew colors
+	resampleFilter = imaging.Box
+
+	trans := New()
+	if !assert.Error(t, trans.AddOverlay("bad,name", encodePNGImage(t, newImage(1, 1, red))), "AddOverlay should fail for invalid names") {
+		return
+	}
+	if !assert.Error(t, trans.AddOverlay("logo", []byte("not an image")), "AddOverlay should fail for invalid images") {
+		return
+	}
+	if !assert.NoError(t, trans.AddOverlay("logo", encodePNGImage(t, newImage(2, 2, red))), "AddOverlay should succeed") {
+		return
+	}
+
+	t.Run("BindOverlays", func(t *testing.T) {
+		rule, err := trans.BindOverlays("100,fit")
+		if !assert.NoError(t, err, "BindOverlays should succeed") || !assert.Equal(t, "100,fit", rule, "rules without overlays should not change") {
+			return
+		}
+
+		bound, err := trans.BindOverlays("100,wm:logo")
+		if !assert.NoError(t, err, "BindOverlays should succeed") {
+			return
+		}
+		if !assert.Equal(t, "logo", overlayName(ParseOptions(bound).Watermark), "overlay name should be kept") {
+			return
+		}
+
+		// Replacing the overlay changes the rule hash
+		other := New()
+		if !assert.NoError(t, other.AddOverlay("logo", encodePNGImage(t, newImage(2, 2, blue))), "AddOverlay should succeed") {
+			return
+		}
+		rebound, err := other.BindOverlays("100,wm:logo")
+		if !assert.NoError(t, err, "BindOverlays should succeed") {
+			return
+		}
+		if !assert.NotEqual(t, RuleHash(bound), RuleHash(rebound), "rule hash should change with the overlay") {
+			return
+		}
+
+		_, err = trans.BindOverlays("100,wm:unknown")
+		assert.Error(t, err, "BindOverlays should fail for unknown overlays")
+	})
+
+	t.Run("composite", func(t *testing.T) {
+		tests := []struct {
+			rule string
+			want image.Image
+		}{
+			{"wm:logo", newImage(4, 4, blue, blue, blue, blue, blue, red, red, blue, blue, red, red, blue, blue, blue, blue, blue)},
+			{"wm:logo,wmpos:topleft", newImage(4, 4, red, red, blue, blue, red, red, blue, blue, blue, blue, blue, blue, blue, blue, blue, blue)},
+			{"wm:logo,wmpos:bottomright,wmmargin:1,wmscale:0.25", newImage(4, 4, blue, blue, blue, blue, blue, blue, blue, blue, blue, blue, red, blue, blue, blue, blue, blue)},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.rule, func(t *testing.T) {
+				dst := bbpool.Get()
+				defer bbpool.Release(dst)
+
+				src := bytes.NewReader(encodePNGImage(t, newImage(4, 4, blue)))
+				if !assert.NoError(t, trans.transform(context.Background(), dst, src, ParseOptions(tt.rule)), "transform should succeed") {
+					return
+				}
+
+				got, err := png.Decode(dst)
+				if !assert.NoError(t, err, "png.Decode should succeed") {
+					return
+				}
+				assert.Equal(t, tt.want, imaging.Clone(got), "image should match")
+			})
+		}
+	})
+
+	t.Run("unknown overlay", func(t *testing.T) {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		src := bytes.NewReader(encodePNGImage(t, newImage(4, 4, blue)))
+		assert.Error(t, trans.transform(context.Background(), dst, src, ParseOptions("wm:unknown")), "transform should fail")
+	})
+}
@@ -0,0 +1,67 @@
+package transformer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// defaultFlattenColor is the color that transparent areas become when
+// an image is encoded as JPEG, unless a background color is specified
+var defaultFlattenColor = color.NRGBA{255, 255, 255, 255}
+
+// parseColor parses a color in the form "bg{rgb}", "bg{rrggbb}" or
+// "bg{rrggbbaa}"
+func parseColor(s string) (color.NRGBA, bool) {
+	s = s[2:]
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	if len(s) != 8 {
+		return color.NRGBA{}, false
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{b[0], b[1], b[2], b[3]}, true
+}
+
+func formatColor(c color.NRGBA) string {
+	if c.A == 255 {
+		return fmt.Sprintf("bg%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("bg%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// pad places m at the center of a w by h canvas filled with bg
+func pad(m image.Image, w, h int, bg color.NRGBA) image.Image {
+	return imaging.PasteCenter(imaging.New(w, h, bg), m)
+}
+
+// flatten draws m over an opaque background, as JPEG images can't be
+// transparent. Opaque images are returned as is
+func flatten(m image.Image, bg color.NRGBA) image.Image {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return m
+	}
+
+	if bg.A == 0 {
+		bg = defaultFlattenColor
+	}
+	bg.A = 255
+
+	dst := imaging.New(m.Bounds().Dx(), m.Bounds().Dy(), bg)
+	draw.Draw(dst, dst.Bounds(), m, m.Bounds().Min, draw.Over)
+	return dst
+}
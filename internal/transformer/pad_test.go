@@ -0,0 +1,36 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	half := color.NRGBA{0, 0, 255, 128}
+
+	tests := []struct {
+		name string
+		bg   color.NRGBA
+		want color.NRGBA
+	}{
+		{"default", transparent, color.NRGBA{127, 127, 255, 255}},
+		{"black", color.NRGBA{0, 0, 0, 255}, color.NRGBA{0, 0, 128, 255}},
+		{"background alpha is ignored", color.NRGBA{0, 0, 0, 1}, color.NRGBA{0, 0, 128, 255}},
+	}
+
+	for _, tt := range tests {
+		got := flatten(newImage(2, 1, red, half), tt.bg)
+		if want := newImage(2, 1, red, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: flatten returned image %#v, want %#v", tt.name, got, want)
+		}
+	}
+
+	// opaque images are returned as is
+	m := newImage(1, 1, red)
+	if got := flatten(m, transparent); got != m {
+		t.Errorf("flatten returned a new image for an opaque image")
+	}
+}
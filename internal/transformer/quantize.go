@@ -0,0 +1,125 @@
+package transformer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// quantizeSamples is the maximum number of pixels sampled by medianCut
+const quantizeSamples = 1 << 16
+
+// quantize converts m to a paletted image using the colors in p. A
+// transparent color is added if there is room, as images such as the
+// frames of animations may be transparent in parts
+func quantize(m image.Image, p color.Palette) *image.Paletted {
+	palette := make(color.Palette, len(p), len(p)+1)
+	copy(palette, p)
+
+	transparent := false
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = true
+			break
+		}
+	}
+	if !transparent && len(palette) < 256 {
+		palette = append(palette, color.Transparent)
+	}
+
+	pm := image.NewPaletted(m.Bounds(), palette)
+	draw.Draw(pm, pm.Bounds(), m, m.Bounds().Min, draw.Src)
+	return pm
+}
+
+// medianCut creates a palette of up to n colors representing the
+// colors in m, by repeatedly splitting the group of colors with the
+// widest range at its median
+func medianCut(m image.Image, n int) color.Palette {
+	b := m.Bounds()
+	step := 1
+	for (b.Dx()/step)*(b.Dy()/step) > quantizeSamples {
+		step++
+	}
+
+	var pixels []color.NRGBA
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			pixels = append(pixels, color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA))
+		}
+	}
+	if len(pixels) == 0 {
+		return color.Palette{color.Transparent}
+	}
+
+	boxes := [][]color.NRGBA{pixels}
+	for len(boxes) < n {
+		split, channel, widest := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, r := widestChannel(box); r > widest {
+				split, channel, widest = i, c, r
+			}
+		}
+		if split < 0 {
+			break
+		}
+
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool {
+			return component(box[i], channel) < component(box[j], channel)
+		})
+		boxes[split] = box[:len(box)/2]
+		boxes = append(boxes, box[len(box)/2:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [4]int
+		for _, c := range box {
+			for ch := range sum {
+				sum[ch] += int(component(c, ch))
+			}
+		}
+		l := len(box)
+		palette[i] = color.NRGBA{uint8(sum[0] / l), uint8(sum[1] / l), uint8(sum[2] / l), uint8(sum[3] / l)}
+	}
+	return palette
+}
+
+// widestChannel returns the channel with the widest range of values
+// among the colors, and the range
+func widestChannel(colors []color.NRGBA) (int, int) {
+	var channel, widest int
+	for ch := 0; ch < 4; ch++ {
+		min, max := 255, 0
+		for _, c := range colors {
+			v := int(component(c, ch))
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if max-min > widest {
+			channel, widest = ch, max-min
+		}
+	}
+	return channel, widest
+}
+
+func component(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	}
+	return c.A
+}
@@ -0,0 +1,97 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMedianCut(t *testing.T) {
+	palette := medianCut(newImage(2, 2, red, green, blue, yellow), 4)
+	if !assert.Len(t, palette, 4, "palette should have 4 colors") {
+		return
+	}
+	for _, c := range []color.NRGBA{red, green, blue, yellow} {
+		assert.Contains(t, palette, c, "palette should contain %v", c)
+	}
+
+	palette = medianCut(newImage(2, 2, red), 16)
+	assert.Equal(t, color.Palette{red}, palette, "palette should not have more colors than the image")
+}
+
+func TestEncoding(t *testing.T) {
+	// a gradient, so that the encoders have something to work with
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8((x + y) * 2), 255})
+		}
+	}
+
+	encode := func(t *testing.T, src []byte, rule string) []byte {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		if !assert.NoError(t, New().transform(context.Background(), dst, bytes.NewReader(src), ParseOptions(rule)), "transform should succeed") {
+			t.FailNow()
+		}
+		return append([]byte(nil), dst.Bytes()...)
+	}
+
+	t.Run("jpeg quality", func(t *testing.T) {
+		var src bytes.Buffer
+		if !assert.NoError(t, jpeg.Encode(&src, m, nil), "jpeg.Encode should succeed") {
+			return
+		}
+
+		high := encode(t, src.Bytes(), "32")
+		low := encode(t, src.Bytes(), "32,q10")
+		assert.True(t, len(low) < len(high), "lower quality should result in a smaller image (%d >= %d)", len(low), len(high))
+	})
+
+	t.Run("progressive jpeg", func(t *testing.T) {
+		var src bytes.Buffer
+		if !assert.NoError(t, jpeg.Encode(&src, m, nil), "jpeg.Encode should succeed") {
+			return
+		}
+
+		out := encode(t, src.Bytes(), "32,progressive,sub444")
+		if !assert.True(t, bytes.Contains(out, []byte{0xff, 0xc2}), "image should be progressive") {
+			return
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(out))
+		if !assert.NoError(t, err, "jpeg.Decode should succeed") {
+			return
+		}
+		assert.Equal(t, image.Rect(0, 0, 32, 32), decoded.Bounds(), "image should be resized")
+		assert.Equal(t, image.YCbCrSubsampleRatio444, decoded.(*image.YCbCr).SubsampleRatio, "chroma should not be subsampled")
+	})
+
+	t.Run("png palette", func(t *testing.T) {
+		var src bytes.Buffer
+		if !assert.NoError(t, png.Encode(&src, m), "png.Encode should succeed") {
+			return
+		}
+
+		out := encode(t, src.Bytes(), "32,pal16,pngbest")
+		decoded, err := png.Decode(bytes.NewReader(out))
+		if !assert.NoError(t, err, "png.Decode should succeed") {
+			return
+		}
+
+		pm, ok := decoded.(*image.Paletted)
+		if !assert.True(t, ok, "image should be paletted") {
+			return
+		}
+		assert.True(t, len(pm.Palette) <= 17, "palette should have at most 16 colors, and transparent")
+	})
+}
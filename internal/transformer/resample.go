@@ -0,0 +1,53 @@
+package transformer
+
+import "github.com/disintegration/imaging"
+
+// Resample specifies the filter used when resizing images
+type Resample int
+
+const (
+	ResampleDefault Resample = iota // resampleFilter
+	ResampleNearest
+	ResampleBox
+	ResampleLinear
+	ResampleCatmullRom
+	ResampleLanczos
+)
+
+var resampleNames = map[Resample]string{
+	ResampleNearest:    "nearest",
+	ResampleBox:        "box",
+	ResampleLinear:     "linear",
+	ResampleCatmullRom: "catmullrom",
+	ResampleLanczos:    "lanczos",
+}
+
+var resampleFilters = map[Resample]imaging.ResampleFilter{
+	ResampleNearest:    imaging.NearestNeighbor,
+	ResampleBox:        imaging.Box,
+	ResampleLinear:     imaging.Linear,
+	ResampleCatmullRom: imaging.CatmullRom,
+	ResampleLanczos:    imaging.Lanczos,
+}
+
+func (r Resample) String() string {
+	return resampleNames[r]
+}
+
+// parseResample returns the Resample named s
+func parseResample(s string) (Resample, bool) {
+	for r, name := range resampleNames {
+		if name == s {
+			return r, true
+		}
+	}
+	return ResampleDefault, false
+}
+
+// resampler returns the filter used to resize the image
+func (o Options) resampler() imaging.ResampleFilter {
+	if f, ok := resampleFilters[o.Resample]; ok {
+		return f
+	}
+	return resampleFilter
+}
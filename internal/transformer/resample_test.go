@@ -0,0 +1,36 @@
+// +build !appengine
+
+package transformer
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResample(t *testing.T) {
+	src := newImage(2, 1, red, blue)
+	pixel := func(m image.Image) color.NRGBA {
+		return color.NRGBAModel.Convert(m.At(0, 0)).(color.NRGBA)
+	}
+
+	// nearest picks one of the pixels
+	got := pixel(transformImage(src, ParseOptions("1x,nearest")))
+	if !assert.True(t, got == red || got == blue, "nearest should not blend colors (got %v)", got) {
+		return
+	}
+
+	// box averages them
+	got = pixel(transformImage(src, ParseOptions("1x,box")))
+	if !assert.True(t, got != red && got != blue, "box should blend colors (got %v)", got) {
+		return
+	}
+
+	for r, name := range resampleNames {
+		if !assert.Equal(t, resampleFilters[r].Support, Options{Resample: r}.resampler().Support, "filter for %s should match", name) {
+			return
+		}
+	}
+}
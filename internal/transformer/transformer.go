@@ -3,37 +3,71 @@ package transformer
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
-	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
 	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/variant"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
 // Transformer is based on imageproxy by Will Norris. Code was shamelessly
 // stolen from there.
-type Transformer struct{}
+type Transformer struct {
+	mu       sync.RWMutex
+	overlays map[string]*overlay
+}
 
 type TransformingTransport struct {
-	transport http.RoundTripper
+	transformer *Transformer
+	transport   http.RoundTripper
 }
 
 type Result struct {
 	Content     io.Writer
 	ContentType string
+	ETag        string // hex encoded MD5 of the content
+	Height      int
 	Size        int64
+	SourceETag  string
+	Width       int
+
+	// closed by read once the fields other than ETag and Size are set
+	header chan struct{}
+}
+
+// Metadata creates the metadata to be stored along with the content
+func (r *Result) Metadata(preset, rule, u string) *variant.Metadata {
+	return &variant.Metadata{
+		ContentType: r.ContentType,
+		Created:     time.Now(),
+		ETag:        r.ETag,
+		Height:      r.Height,
+		Preset:      preset,
+		Rule:        rule,
+		Size:        r.Size,
+		SourceETag:  r.SourceETag,
+		SourceURL:   u,
+		Width:       r.Width,
+	}
 }
 
 func New() *Transformer {
@@ -42,14 +76,18 @@ func New() *Transformer {
 
 // Transform takes a string that specifies the transformation,
 // the url of the target, and populates the given result object
-// if transformation was successful
+// if transformation was successful. Options in the fragment of the
+// url are applied after those in options. See MergeOptions
 func (t *Transformer) Transform(ctx context.Context, options string, u string, result *Result) error {
-	if opts := ParseOptions(options); opts != emptyOptions {
-		u += "#" + opts.String()
-	}
+	u, extra := splitOptions(u)
+
+	// The fragment tells TransformingTransport to transform the image.
+	// It is added even if no transformation was requested, so that the
+	// metadata is stripped
+	u += "#" + ParseOptions(MergeOptions(options, extra)).String()
 
 	// Create a client here (this could be different for appengine)
-	cl := newClient(ctx)
+	cl := newClient(ctx, t)
 	res, err := cl.Get(u)
 	if err != nil {
 		return errors.Wrap(err, `failed to fetch remote image`)
@@ -60,11 +98,149 @@ func (t *Transformer) Transform(ctx context.Context, options string, u string, r
 		return errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
 	}
 
-	if _, err := io.CopyN(result.Content, res.Body, res.ContentLength); err != nil {
+	// The transformed response retains the headers from the original
+	return result.read(res.Body, res.Header.Get("Content-Type"), res.Header.Get("ETag"))
+}
+
+// Stream is the transformed content being read while the image is
+// still being transformed. See TransformStream
+type Stream struct {
+	*io.PipeReader
+	done   chan struct{}
+	err    error
+	result Result
+}
+
+// TransformStream is like Transform, but the transformed content is
+// read from the returned Stream while the transformation is still in
+// progress, so that it does not have to be held in memory all at once.
+// The Stream must be closed
+func (t *Transformer) TransformStream(ctx context.Context, options string, u string) *Stream {
+	pr, pw := io.Pipe()
+	s := &Stream{
+		PipeReader: pr,
+		done:       make(chan struct{}),
+	}
+	s.result.Content = pw
+	s.result.header = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		s.err = t.Transform(ctx, options, u, &s.result)
+		pw.CloseWithError(s.err)
+	}()
+	return s
+}
+
+// Header waits until the transformed content is available, and returns
+// a result with everything but the ETag and Size, which are only known
+// once all of the content has been read. This allows the content type
+// and metadata to be set before uploading the content
+func (s *Stream) Header() (*Result, error) {
+	select {
+	case <-s.result.header:
+	case <-s.done:
+		if s.err != nil {
+			return nil, s.err
+		}
+	}
+	return &Result{
+		ContentType: s.result.ContentType,
+		Height:      s.result.Height,
+		SourceETag:  s.result.SourceETag,
+		Width:       s.result.Width,
+	}, nil
+}
+
+// Result waits for the transformation to finish, and returns its
+// result. The Content field of the result is not usable
+func (s *Stream) Result() (*Result, error) {
+	<-s.done
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &s.result, nil
+}
+
+// Source is an image fetched by Fetch, before any transformation
+type Source struct {
+	Content     []byte
+	ContentType string
+	ETag        string
+	Hash        string // hex encoded SHA-256 of the content
+	Options     string // options in the fragment of the URL, applied by TransformSource
+}
+
+// Fetch retrieves the image at u without transforming it
+func (t *Transformer) Fetch(ctx context.Context, u string) (*Source, error) {
+	// The fragment would tell TransformingTransport to transform the
+	// image, so it is kept aside until the image is transformed
+	u, extra := splitOptions(u)
+
+	cl := newClient(ctx, t)
+	res, err := cl.Get(u)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to fetch remote image`)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to read remote image`)
+	}
+
+	h := sha256.Sum256(content)
+	return &Source{
+		Content:     content,
+		ContentType: res.Header.Get("Content-Type"),
+		ETag:        res.Header.Get("ETag"),
+		Hash:        hex.EncodeToString(h[:]),
+		Options:     extra,
+	}, nil
+}
+
+// TransformSource is like Transform, but works on an image that has
+// already been fetched, so that it can be transformed several times
+// without fetching it again
+func (t *Transformer) TransformSource(ctx context.Context, options string, src *Source, result *Result) error {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	if err := t.transform(ctx, buf, bytes.NewReader(src.Content), ParseOptions(MergeOptions(options, src.Options))); err != nil {
+		return errors.Wrap(err, `failed to transform image`)
+	}
+	return result.read(buf, src.ContentType, src.ETag)
+}
+
+// read copies the transformed content in src to the result, and
+// populates the rest of the fields
+func (r *Result) read(src io.Reader, contentType, sourceETag string) error {
+	// Peek at the header of the image to find out its dimensions. The
+	// bytes consumed while doing so are kept in hdr, and are replayed
+	var hdr bytes.Buffer
+	cfg, _, cfgErr := image.DecodeConfig(io.TeeReader(src, &hdr))
+
+	r.ContentType = contentType
+	r.SourceETag = sourceETag
+	if cfgErr == nil {
+		r.Width = cfg.Width
+		r.Height = cfg.Height
+	}
+	if r.header != nil {
+		close(r.header)
+	}
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(r.Content, h), io.MultiReader(&hdr, src))
+	if err != nil {
 		return errors.Wrap(err, `failed to read transformed content`)
 	}
-	result.ContentType = res.Header.Get("Content-Type")
-	result.Size = res.ContentLength
+	r.ETag = hex.EncodeToString(h.Sum(nil))
+	r.Size = n
 
 	return nil
 }
@@ -96,7 +272,7 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 	defer bbpool.Release(img)
 
 	opt := ParseOptions(req.URL.Fragment)
-	if err := transform(ctx, img, resp.Body, opt); err != nil {
+	if err := t.transformer.transform(ctx, img, resp.Body, opt); err != nil {
 		return nil, err
 	}
 
@@ -143,28 +319,185 @@ type Options struct {
 	Width  float64
 	Height float64
 
+	// The region of the original image that is kept, before resizing.
+	// Values are interpreted like Width and Height
+	CropX      float64
+	CropY      float64
+	CropWidth  float64
+	CropHeight float64
+
 	// If true, resize the image to fit in the specified dimensions.  Image
 	// will not be cropped, and aspect ratio will be maintained.
 	Fit bool
 
+	// If true, resize the image to fit in the specified dimensions like
+	// Fit, and fill the rest with Background, so that the image has the
+	// exact dimensions.
+	Pad bool
+
+	// The color used for padding, and for transparent areas of images
+	// encoded as JPEG. The zero value is transparent, in which case JPEG
+	// images use white
+	Background color.NRGBA
+
+	// The part of the image that is kept when it is cropped. FocusX and
+	// FocusY are the relative coordinates of the focal point, and are
+	// only used with GravityFocus
+	Gravity Gravity
+	FocusX  float64
+	FocusY  float64
+
 	// Rotate image the specified degrees counter-clockwise.  Valid values
 	// are 90, 180, 270.
 	Rotate int
 
 	FlipVertical   bool
 	FlipHorizontal bool
+
+	// Filters applied after resizing. See ParseOptions for their values
+	Grayscale  bool
+	Brightness float64
+	Contrast   float64
+	Gamma      float64
+	Sharpen    float64
+	Blur       float64
+
+	// If true, the EXIF orientation of the image is ignored. Otherwise
+	// the image is rotated and flipped so that it is upright, before
+	// any other transformation is applied
+	NoAutoOrient bool
+
+	// Name of the overlay composited onto the image, after all other
+	// transformations. The other fields specify its position, its margin
+	// from the edges in pixels, its width relative to the image (0 keeps
+	// its size), and its opacity (0 is the same as 1)
+	Watermark        string
+	WatermarkGravity Gravity
+	WatermarkMargin  int
+	WatermarkScale   float64
+	WatermarkOpacity float64
+
+	// If true, only the first frame of animated GIFs is kept
+	Poster bool
+
+	// The filter used when resizing the image
+	Resample Resample
+
+	// Metadata of the source image that is kept in the transformed
+	// image. Only JPEG and PNG images carry metadata
+	Metadata MetadataPolicy
+
+	// Quality of JPEG images, from 1 to 100. 0 means jpegQuality
+	Quality int
+
+	// If true, JPEG images are encoded as progressive JPEG, which
+	// browsers display at a lower quality until they are fully loaded.
+	// Subsampling is the chroma subsampling of JPEG images
+	Progressive bool
+	Subsampling Subsampling
+
+	// Compression level of PNG images, and the number of colors PNG
+	// images are reduced to (0 keeps all colors)
+	PNGCompression png.CompressionLevel
+	Palette        int
 }
 
 var emptyOptions = Options{}
 
+// MergeOptions returns rule followed by the options in extra, so
+// that they take precedence over those in rule. Source URLs of signed
+// requests carry their options in the fragment, and these are merged
+// with the rule of each preset when the image is transformed
+func MergeOptions(rule, extra string) string {
+	if extra == "" {
+		return rule
+	}
+	if rule == "" {
+		return extra
+	}
+	return rule + "," + extra
+}
+
+// splitOptions returns u without its fragment, and the options in
+// the fragment
+func splitOptions(u string) (string, string) {
+	i := strings.IndexByte(u, '#')
+	if i < 0 {
+		return u, ""
+	}
+
+	extra := u[i+1:]
+	if v, err := url.PathUnescape(extra); err == nil {
+		extra = v
+	}
+	return u[:i], extra
+}
+
+// RuleHash returns a short hash identifying the transformation
+// specified by rule. Rules that specify the same transformation,
+// such as "100" and "100x100", or "100" and "100,lanczos,q95", result
+// in the same hash. Backends include this in storage paths, so that
+// variants are regenerated when a preset's rule changes
+func RuleHash(rule string) string {
+	h := sha256.Sum256([]byte(ParseOptions(rule).String()))
+	return hex.EncodeToString(h[:4])
+}
+
+// normalize returns o with the options that are explicitly set to
+// their default values cleared, so that they are formatted the same
+// as when they are omitted. StripMetadata and png.DefaultCompression
+// are already the zero values of their fields
+func (o Options) normalize() Options {
+	if o.Resample == ResampleLanczos {
+		o.Resample = ResampleDefault
+	}
+	if o.Quality == jpegQuality {
+		o.Quality = 0
+	}
+	if o.WatermarkOpacity == 1 {
+		o.WatermarkOpacity = 0
+	}
+	if o.Gamma == 1 {
+		o.Gamma = 0
+	}
+	return o
+}
+
 func (o Options) String() string {
 	buf := bbpool.Get()
 	defer bbpool.Release(buf)
 
+	o = o.normalize()
+
 	fmt.Fprintf(buf, "%vx%v", o.Width, o.Height)
+	if o.CropX != 0 {
+		fmt.Fprintf(buf, ",cx%v", o.CropX)
+	}
+	if o.CropY != 0 {
+		fmt.Fprintf(buf, ",cy%v", o.CropY)
+	}
+	if o.CropWidth != 0 {
+		fmt.Fprintf(buf, ",cw%v", o.CropWidth)
+	}
+	if o.CropHeight != 0 {
+		fmt.Fprintf(buf, ",ch%v", o.CropHeight)
+	}
 	if o.Fit {
 		buf.WriteString(",fit")
 	}
+	if o.Pad {
+		buf.WriteString(",pad")
+	}
+	if o.Background != (color.NRGBA{}) {
+		fmt.Fprintf(buf, ",%s", formatColor(o.Background))
+	}
+	switch o.Gravity {
+	case GravityCenter:
+	case GravityFocus:
+		fmt.Fprintf(buf, ",%s", formatFocus(o.FocusX, o.FocusY))
+	default:
+		fmt.Fprintf(buf, ",%s", o.Gravity)
+	}
 	if o.Rotate != 0 {
 		fmt.Fprintf(buf, ",r%d", o.Rotate)
 	}
@@ -174,6 +507,52 @@ func (o Options) String() string {
 	if o.FlipHorizontal {
 		buf.WriteString(",fh")
 	}
+	if o.Grayscale {
+		buf.WriteString(",gray")
+	}
+	if o.Brightness != 0 {
+		fmt.Fprintf(buf, ",brightness%v", o.Brightness)
+	}
+	if o.Contrast != 0 {
+		fmt.Fprintf(buf, ",contrast%v", o.Contrast)
+	}
+	if o.Gamma != 0 {
+		fmt.Fprintf(buf, ",gamma%v", o.Gamma)
+	}
+	if o.Sharpen != 0 {
+		fmt.Fprintf(buf, ",sharpen%v", o.Sharpen)
+	}
+	if o.Blur != 0 {
+		fmt.Fprintf(buf, ",blur%v", o.Blur)
+	}
+	if o.NoAutoOrient {
+		buf.WriteString(",noorient")
+	}
+	formatOverlay(buf, o)
+	if o.Poster {
+		buf.WriteString(",poster")
+	}
+	if o.Resample != ResampleDefault {
+		fmt.Fprintf(buf, ",%s", o.Resample)
+	}
+	if o.Metadata != StripMetadata {
+		fmt.Fprintf(buf, ",%s", o.Metadata)
+	}
+	if o.Quality != 0 {
+		fmt.Fprintf(buf, ",q%d", o.Quality)
+	}
+	if o.Progressive {
+		buf.WriteString(",progressive")
+	}
+	if o.Subsampling != Subsampling420 {
+		fmt.Fprintf(buf, ",%s", o.Subsampling)
+	}
+	if name, ok := pngCompressionNames[o.PNGCompression]; ok && o.PNGCompression != png.DefaultCompression {
+		fmt.Fprintf(buf, ",%s", name)
+	}
+	if o.Palette != 0 {
+		fmt.Fprintf(buf, ",pal%d", o.Palette)
+	}
 	return buf.String()
 }
 
@@ -209,6 +588,43 @@ func (o Options) String() string {
 // option with only one of either width or height does the same thing as if
 // "fit" had not been specified.
 //
+// If the "pad" option is specified together with a width and height value,
+// the image is resized like "fit", and the rest of the box is filled with the
+// background color, so that the image has the exact dimensions. The image is
+// placed at the center of the box, and is not enlarged even if the box is
+// larger than the image.
+//
+// Background Color
+//
+// The "bg{color}" option specifies the background color used for padding, as
+// a hexadecimal "rgb", "rrggbb" or "rrggbbaa" value. It is also used for
+// transparent areas of JPEG images, which can't be transparent. Padding is
+// transparent by default, and turns white in JPEG images.
+//
+// Crop Rectangle
+//
+// The "cx{x}", "cy{y}", "cw{width}" and "ch{height}" options crop the
+// original image to the specified region before it is resized. As with the
+// size option, integer values are interpreted as pixels, and floats between 0
+// and 1 as percentages of the original image size. Omitted values default to
+// the top left corner and the rest of the image. The region is clipped to the
+// bounds of the image. Percentages in the size option then refer to the
+// cropped region.
+//
+// Gravity
+//
+// When an image is cropped, its center is kept by default. The "top",
+// "bottom", "left", "right", "topleft", "topright", "bottomleft" and
+// "bottomright" options keep the specified edge or corner instead.
+//
+// The "fp{x}:{y}" option keeps the area around a focal point, where x and y
+// are relative coordinates between 0 and 1 (e.g. "fp0.5:0.2" is centered
+// horizontally, near the top). The coordinates refer to the image after it
+// has been rotated according to its EXIF orientation.
+//
+// The "smart" option keeps the area with the most detail, based on the edges
+// found in the image.
+//
 // Rotation and Flips
 //
 // The "r{degrees}" option will rotate the image the specified number of
@@ -217,6 +633,69 @@ func (o Options) String() string {
 // The "fv" option will flip the image vertically. The "fh" option will flip
 // the image horizontally. Images are flipped after being rotated.
 //
+// Filters
+//
+// The following filters are applied after the image is resized, in this
+// order:
+//
+// - "gray" converts the image to grayscale.
+//
+// - "brightness{percentage}" and "contrast{percentage}" adjust the brightness
+// and contrast. Values range from -100 to 100, where 0 means no change.
+//
+// - "gamma{gamma}" applies gamma correction. Values less than 1 darken the
+// image, and values greater than 1 lighten it.
+//
+// - "sharpen{sigma}" and "blur{sigma}" sharpen and blur the image. The larger
+// the sigma, the stronger the effect.
+//
+// Watermark
+//
+// The "wm:{name}" option composites the overlay registered with the
+// Transformer under the given name onto the image, after all other
+// transformations. "wmpos:{position}" places it at one of the edges or
+// corners named as in the gravity options (the center by default), and
+// "wmmargin:{pixels}" keeps it away from the edges. "wmscale:{ratio}" resizes
+// it relative to the width of the image, and "wmopacity:{opacity}" makes it
+// translucent. Ratio and opacity are between 0 and 1.
+//
+// Resampling
+//
+// Images are resized using the Lanczos filter by default, which gives sharp
+// results but is the slowest. The "nearest", "box", "linear", "catmullrom"
+// and "lanczos" options select the filter, from the fastest to the slowest.
+//
+// Encoding
+//
+// The "q{quality}" option sets the quality of JPEG images, from 1 to 100. It
+// defaults to 95. JPEG images are baseline JPEG with 4:2:0 chroma
+// subsampling by default. The "progressive" option encodes them as
+// progressive JPEG ("baseline" switches back), and the "sub444" and
+// "sub422" options keep more of the chroma. The "pngfast", "pngbest" and
+// "pngnone" options set the compression level of PNG images, trading file
+// size for speed. The "pal{colors}" option reduces PNG images to a palette
+// of 2 to 256 colors, which makes them considerably smaller.
+//
+// Orientation
+//
+// Images carrying an EXIF Orientation tag (e.g. photos taken with phones)
+// are rotated and flipped so that they are upright, before any of the
+// above is applied. The "noorient" option disables this.
+//
+// Animation
+//
+// All frames of animated GIFs are transformed, and the result is animated as
+// well. The "poster" option keeps only the first frame.
+//
+// Metadata
+//
+// Metadata such as EXIF (including GPS coordinates) and ICC color profiles
+// is stripped from transformed images. The "keepicc" option keeps the ICC
+// color profile, so that the colors of wide-gamut images are preserved. The
+// "keepmeta" option keeps the ICC color profile, EXIF, XMP, IPTC, and
+// comments. The "strip" option explicitly strips everything. These only
+// apply to JPEG and PNG images.
+//
 // Examples
 //
 // 	0x0       - no resizing
@@ -226,19 +705,94 @@ func (o Options) String() string {
 // 	100x150   - 100 by 150 pixels, cropping as needed
 // 	100       - 100 pixels square, cropping as needed
 // 	150,fit   - scale to fit 150 pixels square, no cropping
+// 	150x100,pad,bg000 - scale to fit 150 by 100 pixels, padded with black
+// 	100,top   - 100 pixels square, cropping from the bottom
+// 	100,fp0.2:0.3 - 100 pixels square, around the focal point
+// 	100,smart - 100 pixels square, cropping to the area with the most detail
+// 	20,blur5  - 20 pixels square, blurred (e.g. for placeholders)
+// 	200,q75   - 200 pixels square, JPEG quality of 75
+// 	200,progressive,sub444 - 200 pixels square, progressive JPEG without chroma subsampling
+// 	100,linear - 100 pixels square, resized with the linear filter
+// 	600,wm:logo,wmpos:bottomright,wmmargin:10,wmscale:0.2 - 600 pixels square, with a watermark
+// 	cx10,cy20,cw300,ch200,150x - the 300x200 region at (10, 20), 150 pixels wide
 // 	100,r90   - 100 pixels square, rotated 90 degrees
 // 	100,fv,fh - 100 pixels square, flipped horizontal and vertical
+// 	100,keepicc - 100 pixels square, with the ICC color profile
 func ParseOptions(str string) Options {
 	var options Options
 
 	for _, opt := range strings.Split(str, ",") {
+		if parseOverlay(&options, opt) {
+			continue
+		}
+		if r, ok := parseResample(opt); ok {
+			options.Resample = r
+			continue
+		}
+		if g, ok := parseGravity(opt); ok {
+			options.Gravity = g
+			options.FocusX = 0
+			options.FocusY = 0
+			continue
+		}
+
+		if parseFilter(&options, opt) {
+			continue
+		}
+
 		switch {
 		case opt == "fit":
 			options.Fit = true
+		case opt == "pad":
+			options.Pad = true
+		case strings.HasPrefix(opt, "bg"):
+			if c, ok := parseColor(opt); ok {
+				options.Background = c
+			}
+		case strings.HasPrefix(opt, "fp"):
+			if x, y, ok := parseFocus(opt); ok {
+				options.Gravity = GravityFocus
+				options.FocusX = x
+				options.FocusY = y
+			}
 		case opt == "fv":
 			options.FlipVertical = true
 		case opt == "fh":
 			options.FlipHorizontal = true
+		case opt == "noorient":
+			options.NoAutoOrient = true
+		case opt == "pngfast" || opt == "pngbest" || opt == "pngnone":
+			for level, name := range pngCompressionNames {
+				if name == opt {
+					options.PNGCompression = level
+				}
+			}
+		case opt == "progressive":
+			options.Progressive = true
+		case opt == "baseline":
+			options.Progressive = false
+		case strings.HasPrefix(opt, "sub"):
+			if sub, ok := parseSubsampling(opt); ok {
+				options.Subsampling = sub
+			}
+		case len(opt) > 1 && opt[:1] == "q":
+			if q, err := strconv.Atoi(opt[1:]); err == nil && q >= 1 && q <= 100 {
+				options.Quality = q
+			}
+		case strings.HasPrefix(opt, "pal"):
+			if n, err := strconv.Atoi(opt[3:]); err == nil && n >= 2 && n <= 256 {
+				options.Palette = n
+			}
+		case opt == "poster":
+			options.Poster = true
+		case opt == "strip":
+			options.Metadata = StripMetadata
+		case opt == "keepicc":
+			options.Metadata = KeepICCProfile
+		case opt == "keepmeta":
+			options.Metadata = KeepMetadata
+		case len(opt) > 2 && opt[:1] == "c":
+			parseCrop(&options, opt)
 		case len(opt) > 2 && opt[:1] == "r":
 			options.Rotate, _ = strconv.Atoi(opt[1:])
 		case strings.ContainsRune(opt, 'x'):
@@ -314,57 +868,121 @@ func NewRequest(r *http.Request) (*Request, error) {
 	return req, nil
 }
 
-// compression quality of resized jpegs
+// compression quality of resized jpegs, unless specified in the options
 const jpegQuality = 95
 
-// resample filter used when resizing images
+var pngCompressionNames = map[png.CompressionLevel]string{
+	png.DefaultCompression: "pngdefault",
+	png.NoCompression:      "pngnone",
+	png.BestSpeed:          "pngfast",
+	png.BestCompression:    "pngbest",
+}
+
+// resample filter used when resizing images, unless specified in the
+// options
 var resampleFilter = imaging.Lanczos
 
 // Transform the provided image.  img should contain the raw bytes of an
 // encoded image in one of the supported formats (gif, jpeg, or png).  The
 // bytes of a similarly encoded image is returned.
-func transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options) error {
+func (t *Transformer) transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	if opt.String() == emptyOptions.String() { // XXX WTF. This is bad. fix it
-		// bail if no transformation was requested
-		n, err := io.Copy(dst, img)
-		if err != nil {
+	// The whole image is needed to decode it anyway. Keep it around,
+	// so that the EXIF metadata can be read from it
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if _, err := buf.ReadFrom(img); err != nil {
+		return errors.Wrap(err, `failed to read image`)
+	}
+
+	// If no transformation was requested, the image is copied as is,
+	// except for the metadata, which is stripped by default. Images
+	// that need to be rotated according to their EXIF orientation are
+	// decoded like any other, as the orientation would be lost
+	if opt.normalize() == emptyOptions && exifOrientation(buf.Bytes()) == 1 {
+		if err := stripMetadata(dst, buf.Bytes(), opt.Metadata); err != nil {
 			return errors.Wrap(err, `failed to copy image`)
 		}
-		log.Debugf(ctx, "empty options, copied %d bytes", n)
+		log.Debugf(ctx, "empty options, copied %d bytes", buf.Len())
 		return nil
 	}
 
 	log.Debugf(ctx, "Transforming image with rule '%#v'", opt)
+
+	// Animated GIFs keep all of their frames, unless only the first
+	// frame is requested
+	if !opt.Poster && bytes.HasPrefix(buf.Bytes(), []byte("GIF8")) {
+		g, err := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return errors.Wrap(err, `failed to decode image`)
+		}
+		if len(g.Image) > 1 {
+			return errors.Wrap(t.transformAnimation(dst, g, opt), `failed to transform animation`)
+		}
+	}
+
 	// decode image
-	m, format, err := image.Decode(img)
+	m, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
 	if err != nil {
 		return errors.Wrap(err, `failed to decode image`)
 	}
 
-	m = transformImage(m, opt)
+	if !opt.NoAutoOrient {
+		m = orient(m, exifOrientation(buf.Bytes()))
+	}
+	m, err = t.transformFrame(m, opt)
+	if err != nil {
+		return err
+	}
 
-	// encode image
+	// encode image, along with the metadata that should be kept
 	switch format {
 	case "gif":
-		gif.Encode(dst, m, nil)
+		err = gif.Encode(dst, m, nil)
 	case "jpeg":
-		jpeg.Encode(dst, m, &jpeg.Options{Quality: jpegQuality})
+		m = flatten(m, opt.Background)
+		segments := jpegMetadata(buf.Bytes(), opt.Metadata, !opt.NoAutoOrient)
+		quality := jpegQuality
+		if opt.Quality > 0 {
+			quality = opt.Quality
+		}
+		err = encodeJPEG(dst, m, &jpegOptions{Quality: quality, Progressive: opt.Progressive, Subsampling: opt.Subsampling}, segments)
 	case "png":
-		png.Encode(dst, m)
+		if opt.Palette > 0 {
+			m = quantize(m, medianCut(m, opt.Palette))
+		}
+		chunks := pngMetadata(buf.Bytes(), opt.Metadata, !opt.NoAutoOrient)
+		err = encodePNG(dst, m, &png.Encoder{CompressionLevel: opt.PNGCompression}, chunks)
+	}
+	if err != nil {
+		return errors.Wrap(err, `failed to encode image`)
 	}
 
 	return nil
 }
 
-// transformImage modifies the image m based on the transformations specified
-// in opt.
-func transformImage(m image.Image, opt Options) image.Image {
-	// convert percentage width and height values to absolute values
-	imgW := m.Bounds().Max.X - m.Bounds().Min.X
-	imgH := m.Bounds().Max.Y - m.Bounds().Min.Y
+// transformFrame applies the transformations specified in opt to m,
+// including the overlay
+func (t *Transformer) transformFrame(m image.Image, opt Options) (image.Image, error) {
+	m = transformImage(m, opt)
+	if opt.Watermark == "" {
+		return m, nil
+	}
+
+	o := t.overlay(opt.Watermark)
+	if o == nil {
+		return nil, errors.Errorf(`overlay %s does not exist`, overlayName(opt.Watermark))
+	}
+	return o.composite(m, opt), nil
+}
+
+// resizeDimensions converts the percentage width and height values in
+// opt to absolute values for an image with bounds b
+func resizeDimensions(b image.Rectangle, opt Options) (int, int) {
+	imgW := b.Max.X - b.Min.X
+	imgH := b.Max.Y - b.Min.Y
 	var w, h int
 	if 0 < opt.Width && opt.Width < 1 {
 		w = int(float64(imgW) * opt.Width)
@@ -380,6 +998,19 @@ func transformImage(m image.Image, opt Options) image.Image {
 	} else {
 		h = int(opt.Height)
 	}
+	return w, h
+}
+
+// transformImage modifies the image m based on the transformations specified
+// in opt.
+func transformImage(m image.Image, opt Options) image.Image {
+	m = cropImage(m, opt)
+	w, h := resizeDimensions(m.Bounds(), opt)
+	imgW, imgH := m.Bounds().Dx(), m.Bounds().Dy()
+
+	// padding fills the requested dimensions, even if the image
+	// is smaller
+	boxW, boxH := w, h
 
 	// never resize larger than the original image
 	if w > imgW {
@@ -390,18 +1021,25 @@ func transformImage(m image.Image, opt Options) image.Image {
 	}
 
 	// resize
+	padded := opt.Pad && w != 0 && h != 0
 	if w != 0 || h != 0 {
-		if opt.Fit {
-			m = imaging.Fit(m, w, h, resampleFilter)
+		if opt.Fit || padded {
+			m = imaging.Fit(m, w, h, opt.resampler())
 		} else {
 			if w == 0 || h == 0 {
-				m = imaging.Resize(m, w, h, resampleFilter)
+				m = imaging.Resize(m, w, h, opt.resampler())
 			} else {
-				m = imaging.Thumbnail(m, w, h, resampleFilter)
+				m = fill(m, w, h, opt)
 			}
 		}
 	}
 
+	// filters are applied to the image only, and not to the padding
+	m = filter(m, opt)
+	if padded {
+		m = pad(m, boxW, boxH, opt.Background)
+	}
+
 	// flip
 	if opt.FlipVertical {
 		m = imaging.FlipV(m)
@@ -9,10 +9,11 @@ import (
 	"google.golang.org/appengine/urlfetch"
 )
 
-func newClient(ctx context.Context) *http.Client {
+func newClient(ctx context.Context, t *Transformer) *http.Client {
 	return &http.Client{
 		Transport: &TransformingTransport{
-			transport: &urlfetch.Transport{Context: ctx},
+			transformer: t,
+			transport:   &urlfetch.Transport{Context: ctx},
 		},
 	}
 }
@@ -8,10 +8,11 @@ import (
 	"golang.org/x/net/context"
 )
 
-func newClient(ctx context.Context) *http.Client {
+func newClient(ctx context.Context, t *Transformer) *http.Client {
 	return &http.Client{
 		Transport: &TransformingTransport{
-			transport: &http.Transport{},
+			transformer: t,
+			transport:   &http.Transport{},
 		},
 	}
 }
@@ -3,6 +3,7 @@
 package transformer
 
 import (
+	"bytes"
 	"image"
 	"image/color"
 	"image/draw"
@@ -10,7 +11,9 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
@@ -30,9 +33,57 @@ func TestOptions_String(t *testing.T) {
 			"0x0",
 		},
 		{
-			Options{1, 2, true, 90, true, true},
+			Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true},
 			"1x2,fit,r90,fv,fh",
 		},
+		{
+			Options{Width: 100, Height: 100, NoAutoOrient: true},
+			"100x100,noorient",
+		},
+		{
+			Options{Width: 100, Height: 100, Metadata: KeepICCProfile},
+			"100x100,keepicc",
+		},
+		{
+			Options{Width: 20, Height: 20, Grayscale: true, Brightness: 10, Contrast: -20, Gamma: 1.5, Sharpen: 0.5, Blur: 5},
+			"20x20,gray,brightness10,contrast-20,gamma1.5,sharpen0.5,blur5",
+		},
+		{
+			Options{Width: 150, Height: 100, Pad: true, Background: color.NRGBA{0, 0, 0, 255}},
+			"150x100,pad,bg000000",
+		},
+		{
+			Options{Width: 150, Height: 100, Pad: true, Background: color.NRGBA{255, 0, 0, 128}},
+			"150x100,pad,bgff000080",
+		},
+		{
+			Options{Width: 100, Height: 100, Watermark: "logo", WatermarkGravity: GravityBottomRight, WatermarkMargin: 10, WatermarkScale: 0.2, WatermarkOpacity: 0.5},
+			"100x100,wm:logo,wmpos:bottomright,wmmargin:10,wmscale:0.2,wmopacity:0.5",
+		},
+		{
+			Options{Width: 100, Height: 100, Quality: 75, PNGCompression: png.BestSpeed, Palette: 16},
+			"100x100,q75,pngfast,pal16",
+		},
+		{
+			Options{Width: 100, Height: 100, Quality: 80, Progressive: true, Subsampling: Subsampling444},
+			"100x100,q80,progressive,sub444",
+		},
+		{
+			Options{Width: 100, Height: 100, Resample: ResampleCatmullRom},
+			"100x100,catmullrom",
+		},
+		{
+			Options{Width: 150, CropX: 10, CropY: 20, CropWidth: 300, CropHeight: 200},
+			"150x0,cx10,cy20,cw300,ch200",
+		},
+		{
+			Options{Width: 100, Height: 100, Gravity: GravityTopLeft},
+			"100x100,topleft",
+		},
+		{
+			Options{Width: 100, Height: 100, Gravity: GravityFocus, FocusX: 0.25, FocusY: 0.5},
+			"100x100,fp0.25:0.5",
+		},
 	}
 
 	for i, tt := range tests {
@@ -78,8 +129,34 @@ func TestParseOptions(t *testing.T) {
 		{"FOO,1,BAR,r90,BAZ", Options{Width: 1, Height: 1, Rotate: 90}},
 
 		// all flags, in different orders
-		{"1x2,fit,r90,fv,fh", Options{1, 2, true, 90, true, true}},
-		{"r90,fh,1x2,fv,fit", Options{1, 2, true, 90, true, true}},
+		{"1x2,fit,r90,fv,fh", Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true}},
+		{"r90,fh,1x2,fv,fit", Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true}},
+		{"noorient,100", Options{Width: 100, Height: 100, NoAutoOrient: true}},
+		{"100,keepmeta", Options{Width: 100, Height: 100, Metadata: KeepMetadata}},
+		{"keepicc,strip", Options{}},
+		{"100,smart", Options{Width: 100, Height: 100, Gravity: GravitySmart}},
+		{"100,fp0.25:0.5", Options{Width: 100, Height: 100, Gravity: GravityFocus, FocusX: 0.25, FocusY: 0.5}},
+		{"fp0.25:0.5,right", Options{Gravity: GravityRight}},
+		{"fp2:0.5", emptyOptions},
+		{"fp0.5", emptyOptions},
+		{"blur5,sharpen0.5,gray", Options{Blur: 5, Sharpen: 0.5, Grayscale: true}},
+		{"brightness-10,contrast20,gamma0.8", Options{Brightness: -10, Contrast: 20, Gamma: 0.8}},
+		{"brightness200,gamma0,blur-1,contrastfoo", emptyOptions},
+		{"wm:logo,100,wmpos:topleft,wmmargin:5", Options{Width: 100, Height: 100, Watermark: "logo", WatermarkGravity: GravityTopLeft, WatermarkMargin: 5}},
+		{"wm:logo,wmpos:smart,wmmargin:-1,wmscale:2,wmopacity:0", Options{Watermark: "logo"}},
+		{"100,q75,pngbest,pal64", Options{Width: 100, Height: 100, Quality: 75, PNGCompression: png.BestCompression, Palette: 64}},
+		{"q0,q101,pal1,pal257,pngdefault", emptyOptions},
+		{"100,progressive,sub422", Options{Width: 100, Height: 100, Progressive: true, Subsampling: Subsampling422}},
+		{"progressive,baseline,sub444,sub420,sub411", emptyOptions},
+		{"100,linear", Options{Width: 100, Height: 100, Resample: ResampleLinear}},
+		{"catmullrom,nearest", Options{Resample: ResampleNearest}},
+		{"100,poster", Options{Width: 100, Height: 100, Poster: true}},
+		{"pad,bgf00", Options{Pad: true, Background: color.NRGBA{255, 0, 0, 255}}},
+		{"bgff000080", Options{Background: color.NRGBA{255, 0, 0, 128}}},
+		{"bgzzz,bg12345", emptyOptions},
+		{"cx10,cy20,cw300,ch200", Options{CropX: 10, CropY: 20, CropWidth: 300, CropHeight: 200}},
+		{"cx0.1,cw0.5,100x", Options{Width: 100, CropX: 0.1, CropWidth: 0.5}},
+		{"cx-1,cyfoo", emptyOptions},
 	}
 
 	for _, tt := range tests {
@@ -89,6 +166,35 @@ func TestParseOptions(t *testing.T) {
 	}
 }
 
+func TestRuleHash(t *testing.T) {
+	tests := []struct {
+		A, B  string
+		Equal bool
+	}{
+		{"100", "100x100", true},
+		{"1x2,fit,r90", "r90,fit,1x2", true},
+		{"300x400", "320x400", false},
+		{"100", "100,fit", false},
+		{"100", "100,lanczos", true},
+		{"100", "100,linear", false},
+		{"100", "100,q95", true},
+		{"100", "100,q80", false},
+		{"100", "100,strip", true},
+		{"100", "100,keepicc", false},
+		{"100", "100,baseline,sub420", true},
+		{"100", "100,progressive", false},
+		{"100,wm:logo", "100,wm:logo,wmopacity:1", true},
+		{"100", "100,gamma1", true},
+		{"100", "100,gamma2.2", false},
+	}
+
+	for _, tt := range tests {
+		if got := RuleHash(tt.A) == RuleHash(tt.B); got != tt.Equal {
+			t.Errorf("RuleHash(%q) == RuleHash(%q) returned %v, want %v", tt.A, tt.B, got, tt.Equal)
+		}
+	}
+}
+
 // Test that request URLs are properly parsed into Options and RemoteURL.  This
 // test verifies that invalid remote URLs throw errors, and that valid
 // combinations of Options and URL are accept.  This does not exhaustively test
@@ -171,8 +277,16 @@ var (
 	green  = color.NRGBA{0, 255, 0, 255}
 	blue   = color.NRGBA{0, 0, 255, 255}
 	yellow = color.NRGBA{255, 255, 0, 255}
+
+	transparent = color.NRGBA{}
 )
 
+// gray returns c converted to grayscale, as done by the gray filter
+func gray(c color.NRGBA) color.NRGBA {
+	y := uint8(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B) + 0.5)
+	return color.NRGBA{y, y, y, c.A}
+}
+
 // newImage creates a new NRGBA image with the specified dimensions and pixel
 // color data.  If the length of pixels is 1, the entire image is filled with
 // that color.
@@ -236,7 +350,7 @@ func TestTransform(t *testing.T) {
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			if !assert.NoError(t, transform(ctx, dst, src, emptyOptions), "Transform with encoder should succeed") {
+			if !assert.NoError(t, New().transform(ctx, dst, src, emptyOptions), "Transform with encoder should succeed") {
 				return
 			}
 
@@ -259,7 +373,7 @@ func TestTransform(t *testing.T) {
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			if !assert.NoError(t, transform(ctx, dst, src, Options{Width: -1, Height: -1}), "Transform with encoder %s returned unexpected error", tt.name) {
+			if !assert.NoError(t, New().transform(ctx, dst, src, Options{Width: -1, Height: -1}), "Transform with encoder %s returned unexpected error", tt.name) {
 				return
 			}
 
@@ -283,12 +397,114 @@ func TestTransform(t *testing.T) {
 		defer bbpool.Release(dst)
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		if !assert.Error(t, transform(ctx, dst, src, Options{Width: 1}), "Transform with invalid image input did not return expected err") {
+		if !assert.Error(t, New().transform(ctx, dst, src, Options{Width: 1}), "Transform with invalid image input did not return expected err") {
 			return
 		}
 	})
 }
 
+func TestTransformStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"abc"`)
+		png.Encode(w, newImage(40, 20, color.NRGBA{255, 0, 0, 255}))
+	}))
+	defer srv.Close()
+
+	st := New().TransformStream(context.Background(), "20x10", srv.URL)
+	defer st.Close()
+
+	// The header is available before all of the content has been read
+	if _, err := io.ReadFull(st, make([]byte, 8)); !assert.NoError(t, err, "reading from the stream should succeed") {
+		return
+	}
+	hdr, err := st.Header()
+	if !assert.NoError(t, err, "Header should succeed") {
+		return
+	}
+	if !assert.Equal(t, "image/png", hdr.ContentType, "content type should match") {
+		return
+	}
+	if !assert.Equal(t, `"abc"`, hdr.SourceETag, "source etag should match") {
+		return
+	}
+	if !assert.Equal(t, 20, hdr.Width, "width should match") {
+		return
+	}
+	if !assert.Empty(t, hdr.ETag, "etag should not be known yet") {
+		return
+	}
+
+	if _, err := io.Copy(ioutil.Discard, st); !assert.NoError(t, err, "reading from the stream should succeed") {
+		return
+	}
+	res, err := st.Result()
+	if !assert.NoError(t, err, "Result should succeed") {
+		return
+	}
+	if !assert.NotEmpty(t, res.ETag, "etag should be known") {
+		return
+	}
+}
+
+func TestURLOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, newImage(40, 20, color.NRGBA{255, 0, 0, 255}))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	tr := New()
+
+	// options in the fragment take precedence over the rule
+	var res Result
+	res.Content = ioutil.Discard
+	if !assert.NoError(t, tr.Transform(ctx, "20x10", srv.URL+"#10x5,fit", &res), "Transform should succeed") {
+		return
+	}
+	if !assert.Equal(t, 10, res.Width, "width should match the fragment") {
+		return
+	}
+
+	src, err := tr.Fetch(ctx, srv.URL+"#10x5,fit")
+	if !assert.NoError(t, err, "Fetch should succeed") {
+		return
+	}
+	if !assert.Equal(t, "10x5,fit", src.Options, "options should be kept") {
+		return
+	}
+	if !assert.Equal(t, 40, mustDecodeWidth(t, src.Content), "fetched image should not be transformed") {
+		return
+	}
+
+	res = Result{Content: ioutil.Discard}
+	if !assert.NoError(t, tr.TransformSource(ctx, "20x10", src, &res), "TransformSource should succeed") {
+		return
+	}
+	if !assert.Equal(t, 10, res.Width, "width should match the fragment") {
+		return
+	}
+
+	for _, tt := range []struct{ rule, extra, merged string }{
+		{"100", "", "100"},
+		{"", "fp0.2:0.3", "fp0.2:0.3"},
+		{"100,q80", "fp0.2:0.3", "100,q80,fp0.2:0.3"},
+	} {
+		if !assert.Equal(t, tt.merged, MergeOptions(tt.rule, tt.extra), "MergeOptions(%q, %q)", tt.rule, tt.extra) {
+			return
+		}
+	}
+}
+
+func mustDecodeWidth(t *testing.T, content []byte) int {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("image.DecodeConfig failed: %s", err)
+	}
+	return cfg.Width
+}
+
 func TestTransformImage(t *testing.T) {
 	// ref is a 2x2 reference image containing four colors
 	ref := newImage(2, 2, red, green, blue, yellow)
@@ -379,6 +595,62 @@ func TestTransformImage(t *testing.T) {
 			newImage(2, 1, red, blue),
 		},
 
+		// padding
+		{ // fit inside the box, transparent padding
+			newImage(4, 2, red),
+			Options{Width: 2, Height: 2, Pad: true},
+			newImage(2, 2, transparent, transparent, red, red),
+		},
+		{ // never enlarged, but padded to the requested size
+			newImage(1, 1, red),
+			Options{Width: 3, Height: 1, Pad: true, Background: blue},
+			newImage(3, 1, blue, red, blue),
+		},
+		{ // single dimension is not padded
+			newImage(4, 2, red),
+			Options{Width: 2, Pad: true},
+			newImage(2, 1, red),
+		},
+
+		// filters
+		{
+			ref,
+			Options{Grayscale: true},
+			newImage(2, 2, gray(red), gray(green), gray(blue), gray(yellow)),
+		},
+		{
+			newImage(1, 1, color.NRGBA{100, 100, 100, 255}),
+			Options{Brightness: 10},
+			newImage(1, 1, color.NRGBA{126, 126, 126, 255}),
+		},
+		{ // applied to the image, but not the padding
+			newImage(1, 1, red),
+			Options{Width: 3, Height: 1, Pad: true, Grayscale: true},
+			newImage(3, 1, transparent, gray(red), transparent),
+		},
+
+		// cropping
+		{ // absolute values
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{CropX: 2, CropWidth: 2},
+			newImage(2, 2, blue),
+		},
+		{ // percentage values, clipped to the image
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{CropWidth: 0.5, CropY: 1, CropHeight: 5},
+			newImage(2, 1, red),
+		},
+		{ // outside of the image is a noop
+			ref,
+			Options{CropX: 10},
+			ref,
+		},
+		{ // cropped before resizing
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{CropX: 2, Width: 0.5},
+			newImage(1, 1, blue),
+		},
+
 		// combinations of options
 		{
 			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
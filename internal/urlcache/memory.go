@@ -0,0 +1,10 @@
+package urlcache
+
+import "github.com/lestrrat-go/sharaq/cache"
+
+func newMemory(c *Config) (*URLCache, error) {
+	return &URLCache{
+		cache:   cache.NewMemory(cache.WithMaxItems(c.Memory.MaxItems)),
+		expires: c.Expires,
+	}, nil
+}
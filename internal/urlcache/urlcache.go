@@ -28,6 +28,7 @@ type Config struct {
 	Type      string
 	Memcached cache.MemcacheConfig
 	Redis     cache.RedisConfig
+	Memory    cache.MemoryConfig
 	Expires   int32
 }
 
@@ -41,6 +42,8 @@ func New(c *Config) (*URLCache, error) {
 		return newRedis(c)
 	case "Memcached":
 		return newMemcached(c)
+	case "Memory":
+		return newMemory(c)
 	default:
 		return nil, errors.Errorf(`urlcache: unknown backend type "%s"`, c.Type)
 	}
@@ -40,6 +40,9 @@ func GetTargetURL(r *http.Request) (*url.URL, error) {
 		return nil, errors.New("empty host")
 	}
 
+	// Fragments are never sent when fetching the image, and sharaq
+	// uses them to carry signed options
+	u.Fragment = ""
 	return u, nil
 }
 
@@ -0,0 +1,246 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+// Backend stores transformed images in memory, and serves them
+// directly. Contents are lost when the process exits
+type Backend struct {
+	mu          sync.Mutex
+	entries     map[entryKey]*list.Element
+	lru         *list.List // front is the most recently used
+	maxSize     int64
+	presets     map[string]string
+	size        int64
+	storeConfig variant.StoreConfig
+	transformer *transformer.Transformer
+}
+
+// entryKey identifies a variant. The hash of the preset's rule is
+// included, so that variants created with a different rule are not
+// served after the rule changes
+type entryKey struct {
+	preset string
+	rule   string
+	url    string
+}
+
+type entry struct {
+	key      entryKey
+	content  []byte
+	metadata *variant.Metadata
+	opts     variant.StoreOptions
+}
+
+func NewBackend(c *Config, trans *transformer.Transformer, presets map[string]string) (*Backend, error) {
+	if c.MaxSize < 0 {
+		return nil, errors.New("memory backend: 'MaxSize' must not be negative")
+	}
+
+	return &Backend{
+		entries:     make(map[entryKey]*list.Element),
+		lru:         list.New(),
+		maxSize:     c.MaxSize,
+		presets:     presets,
+		storeConfig: c.Store,
+		transformer: trans,
+	}, nil
+}
+
+func (b *Backend) makeKey(preset string, u *url.URL) entryKey {
+	return entryKey{
+		preset: preset,
+		rule:   transformer.RuleHash(b.presets[preset]),
+		url:    u.String(),
+	}
+}
+
+// ServeHTTP serves the stored content. entry objects are never
+// modified once stored, so it's safe to do this without locking
+func (e *entry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", e.metadata.ContentType)
+	if etag := e.metadata.ETag; etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	if v := e.opts.CacheControl; v != "" {
+		w.Header().Set("Cache-Control", v)
+	}
+	if v := e.opts.ContentDisposition; v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+	http.ServeContent(w, r, "", e.metadata.Created, bytes.NewReader(e.content))
+}
+
+func (b *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elem, ok := b.entries[b.makeKey(preset, u)]
+	if !ok {
+		return nil, errors.TransformationRequiredError{}
+	}
+
+	b.lru.MoveToFront(elem)
+	return elem.Value.(*entry), nil
+}
+
+// store saves the content, and evicts least recently used entries
+// until the total size fits within the limit. Content that is larger
+// than the limit by itself is not stored, and an error is returned
+func (b *Backend) store(ctx context.Context, e *entry) error {
+	size := int64(len(e.content))
+	if b.maxSize > 0 && size > b.maxSize {
+		return errors.Storage(errors.Errorf(`memory backend: content for %s (%s) is %d bytes, larger than MaxSize (%d)`, e.key.url, e.key.preset, size, b.maxSize))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(e.key)
+	b.entries[e.key] = b.lru.PushFront(e)
+	b.size += size
+
+	for b.maxSize > 0 && b.size > b.maxSize {
+		oldest := b.lru.Back().Value.(*entry)
+		log.Debugf(ctx, "memory backend: evicting %s (%s)", oldest.key.url, oldest.key.preset)
+		b.remove(oldest.key)
+	}
+	return nil
+}
+
+// remove must be called while holding the lock
+func (b *Backend) remove(key entryKey) {
+	elem, ok := b.entries[key]
+	if !ok {
+		return
+	}
+
+	b.lru.Remove(elem)
+	delete(b.entries, key)
+	b.size -= int64(len(elem.Value.(*entry).content))
+}
+
+func (b *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+	log.Debugf(ctx, "memory backend: transforming image at url %s", u)
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	for preset, rule := range b.presets {
+		t := b.transformer
+		preset := preset
+		rule := rule
+		grp.Go(func() error {
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+
+			if err := t.Transform(ctx, rule, u.String(), &res); err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+
+			return b.Put(ctx, u, preset, res.Metadata(preset, rule, u.String()), buf.Bytes())
+		})
+	}
+	return grp.Wait()
+}
+
+// Put stores already transformed content. content is copied, so
+// the caller is free to reuse it afterwards
+func (b *Backend) Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error {
+	md2 := *md
+	md2.Size = int64(len(content))
+	return b.store(ctx, &entry{
+		key:      b.makeKey(preset, u),
+		content:  append([]byte(nil), content...),
+		metadata: &md2,
+		opts:     b.storeConfig.Options(preset),
+	})
+}
+
+// HealthCheck always succeeds, as there is nothing that can fail
+func (b *Backend) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (b *Backend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elem, ok := b.entries[b.makeKey(preset, u)]
+	if !ok {
+		return nil, errors.TransformationRequiredError{}
+	}
+
+	md := *elem.Value.(*entry).metadata
+	return &md, nil
+}
+
+// List returns the variants created from the image at u
+func (b *Backend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var list []*variant.Metadata
+	for key, elem := range b.entries {
+		if key.url != u.String() {
+			continue
+		}
+		md := *elem.Value.(*entry).metadata
+		list = append(list, &md)
+	}
+	return list, nil
+}
+
+// Walk calls fn for each stored variant, from the most recently
+// used to the least recently used
+func (b *Backend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	// Don't hold the lock while calling fn, which may very well
+	// call other methods on the backend
+	b.mu.Lock()
+	list := make([]*variant.Metadata, 0, b.lru.Len())
+	for elem := b.lru.Front(); elem != nil; elem = elem.Next() {
+		md := *elem.Value.(*entry).metadata
+		list = append(list, &md)
+	}
+	b.mu.Unlock()
+
+	for _, md := range list {
+		if err := fn(md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes all variants of the image at u, including those for
+// presets that are no longer configured
+func (b *Backend) Delete(ctx context.Context, u *url.URL) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key := range b.entries {
+		if key.url != u.String() {
+			continue
+		}
+		log.Debugf(ctx, " + DELETE memory entry %s (%s)\n", u, key.preset)
+		b.remove(key)
+	}
+	return nil
+}
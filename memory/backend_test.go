@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestEviction(t *testing.T) {
+	presets := map[string]string{"small": "100x100"}
+	store := variant.StoreConfig{
+		Presets: map[string]variant.StoreOptions{
+			"small": {CacheControl: "public, max-age=60"},
+		},
+	}
+	b, err := NewBackend(&Config{MaxSize: 10, Store: store}, nil, presets)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u1, _ := url.Parse("http://example.com/1.png")
+	u2, _ := url.Parse("http://example.com/2.png")
+	u3, _ := url.Parse("http://example.com/3.png")
+
+	for _, u := range []*url.URL{u1, u2} {
+		err := b.store(ctx, &entry{
+			key:      b.makeKey("small", u),
+			content:  []byte("abcd"),
+			metadata: &variant.Metadata{ContentType: "image/png", Created: time.Now()},
+		})
+		if !assert.NoError(t, err, "store should succeed") {
+			return
+		}
+	}
+
+	// touch u1, so that u2 becomes the least recently used
+	if _, err := b.Get(ctx, u1, "small"); !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, b.Put(ctx, u3, "small", &variant.Metadata{ContentType: "image/png", ETag: "deadbeef", Created: time.Now()}, []byte("efgh")), "Put should succeed") {
+		return
+	}
+
+	if _, err := b.Get(ctx, u2, "small"); !assert.True(t, errors.IsTransformationRequired(err), "u2 should have been evicted") {
+		return
+	}
+
+	h, err := b.Get(ctx, u3, "small")
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	if !assert.Equal(t, "efgh", string(body), "content should match") {
+		return
+	}
+	if !assert.Equal(t, "image/png", w.Header().Get("Content-Type"), "content type should match") {
+		return
+	}
+	if !assert.Equal(t, `"deadbeef"`, w.Header().Get("ETag"), "ETag should match") {
+		return
+	}
+	if !assert.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"), "Cache-Control should match") {
+		return
+	}
+
+	md, err := b.Stat(ctx, u3, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, int64(4), md.Size, "Size should match") {
+		return
+	}
+
+	// too large to be stored at all
+	err = b.Put(ctx, u2, "small", &variant.Metadata{ContentType: "image/png", Created: time.Now()}, []byte("0123456789abc"))
+	if !assert.Error(t, err, "Put should fail") {
+		return
+	}
+	if !assert.True(t, errors.IsStorageFailure(err), "error should be a storage failure") {
+		return
+	}
+	if !assert.Equal(t, int64(8), b.size, "size should not change") {
+		return
+	}
+
+	if !assert.NoError(t, b.Delete(ctx, u1), "Delete should succeed") {
+		return
+	}
+	if !assert.Equal(t, int64(4), b.size, "size should be updated") {
+		return
+	}
+}
+
+func TestRuleChange(t *testing.T) {
+	presets := map[string]string{"small": "100x100"}
+	b, err := NewBackend(&Config{}, nil, presets)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png")
+	if !assert.NoError(t, b.Put(ctx, u, "small", &variant.Metadata{ContentType: "image/png"}, []byte("abcd")), "Put should succeed") {
+		return
+	}
+
+	presets["small"] = "100x100,lanczos"
+	if _, err := b.Get(ctx, u, "small"); !assert.NoError(t, err, "Get should succeed for an equivalent rule") {
+		return
+	}
+
+	presets["small"] = "200x200"
+	if _, err := b.Get(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Get should require transformation after the rule changes") {
+		return
+	}
+	if _, err := b.Stat(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Stat should require transformation after the rule changes") {
+		return
+	}
+
+	if !assert.NoError(t, b.Delete(ctx, u), "Delete should succeed") {
+		return
+	}
+	if !assert.Equal(t, int64(0), b.size, "variants created with the old rule should be deleted") {
+		return
+	}
+}
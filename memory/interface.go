@@ -0,0 +1,8 @@
+package memory
+
+import "github.com/lestrrat-go/sharaq/variant"
+
+type Config struct {
+	MaxSize int64               // maximum number of bytes to hold. Least recently used images are evicted first. 0 means unlimited
+	Store   variant.StoreConfig // only CacheControl and ContentDisposition are used, as response headers
+}
@@ -0,0 +1,306 @@
+package sharaq
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/variant"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+// Putter is implemented by backends that can store content that has
+// already been transformed. The destination backend of a migration
+// must implement this
+type Putter interface {
+	Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error
+}
+
+// MigrateOptions controls how variants are copied by Migrate
+type MigrateOptions struct {
+	Checkpoint  string // file recording copied variants, so that an interrupted migration can be resumed
+	Concurrency int    // number of variants copied at the same time. Defaults to 1
+	DryRun      bool   // only report what would be copied
+	Verify      bool   // read back each copied variant from the destination and compare checksums
+}
+
+// MigrateStats reports the outcome of Migrate
+type MigrateStats struct {
+	Copied  int // variants copied (or that would be copied, in dry-run mode)
+	Skipped int // variants that are stale, already copied, or already exist in the destination
+	Failed  int // variants that could not be copied
+}
+
+type migration struct {
+	src     Backend
+	dst     Backend
+	put     Putter
+	opts    *MigrateOptions
+	presets map[string]string
+
+	mu         sync.Mutex
+	checkpoint io.Writer
+	done       map[string]struct{}
+	stats      MigrateStats
+}
+
+// Migrate copies every variant in the configured backend to the
+// backend described by dst, which stores them using its own path
+// scheme. Variants created with a rule other than the current rule
+// for their preset are not copied. Failures to copy individual
+// variants are logged and counted, and do not stop the migration.
+// The server must be initialized first, and its backend must
+// implement Walker
+func (s *Server) Migrate(ctx context.Context, dst *BackendConfig, opts *MigrateOptions) (*MigrateStats, error) {
+	if s.backend == nil {
+		return nil, errors.New(`server must be initialized before migrating`)
+	}
+	walker, ok := s.backend.(Walker)
+	if !ok {
+		return nil, errors.Errorf(`storage backend %s can not enumerate variants`, s.config.Backend.Type)
+	}
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+
+	// The destination gets a cache of its own, so that it does not
+	// overwrite the entries that point to the source
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create urlcache for destination`)
+	}
+	env := &BackendEnv{
+		cache:       cache,
+		presets:     s.presets,
+		transformer: s.transformer,
+	}
+	b, err := env.NewBackend(dst)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create destination backend`)
+	}
+	if c, ok := b.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	put, ok := b.(Putter)
+	if !ok {
+		return nil, errors.Errorf(`destination backend %s does not support storing content`, dst.Type)
+	}
+
+	m := &migration{
+		src:     s.backend,
+		dst:     b,
+		put:     put,
+		opts:    opts,
+		presets: s.presets,
+		done:    make(map[string]struct{}),
+	}
+
+	if opts.Checkpoint != "" {
+		f, err := m.loadCheckpoint(opts.Checkpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to load checkpoint`)
+		}
+		defer f.Close()
+		m.checkpoint = f
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	ch := make(chan *variant.Metadata)
+	grp.Go(func() error {
+		defer close(ch)
+		return walker.Walk(ctx, func(md *variant.Metadata) error {
+			if !m.current(ctx, md) {
+				m.count(&m.stats.Skipped)
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- md:
+				return nil
+			}
+		})
+	})
+
+	for i := 0; i < concurrency; i++ {
+		grp.Go(func() error {
+			for md := range ch {
+				m.migrate(ctx, md)
+			}
+			return nil
+		})
+	}
+
+	if err := grp.Wait(); err != nil {
+		return &m.stats, errors.Wrap(err, `failed to walk source backend`)
+	}
+	return &m.stats, nil
+}
+
+// loadCheckpoint reads the variants that have already been copied,
+// and opens the file so that more can be appended
+func (m *migration) loadCheckpoint(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to open %s`, path)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := scanner.Text(); l != "" {
+			m.done[l] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, `failed to read %s`, path)
+	}
+	return f, nil
+}
+
+func checkpointKey(md *variant.Metadata) string {
+	return md.Preset + "\t" + md.SourceURL
+}
+
+func (m *migration) count(n *int) {
+	m.mu.Lock()
+	*n++
+	m.mu.Unlock()
+}
+
+// current returns true if the variant was created using the current
+// rule for its preset, and has not been copied yet
+func (m *migration) current(ctx context.Context, md *variant.Metadata) bool {
+	if md.Preset == "" || md.SourceURL == "" {
+		log.Debugf(ctx, "Skipping %s: no metadata available", md.Path)
+		return false
+	}
+
+	rule, ok := m.presets[md.Preset]
+	if !ok {
+		log.Debugf(ctx, "Skipping %s (%s): preset is not configured", md.SourceURL, md.Preset)
+		return false
+	}
+	if md.Rule != "" && md.Rule != rule {
+		log.Debugf(ctx, "Skipping %s (%s): created with a stale rule", md.SourceURL, md.Preset)
+		return false
+	}
+
+	m.mu.Lock()
+	_, done := m.done[checkpointKey(md)]
+	m.mu.Unlock()
+	return !done
+}
+
+func (m *migration) migrate(ctx context.Context, md *variant.Metadata) {
+	copied, err := m.copy(ctx, md)
+	if err != nil {
+		log.Debugf(ctx, "Failed to migrate %s (%s): %s", md.SourceURL, md.Preset, err)
+		m.count(&m.stats.Failed)
+		return
+	}
+
+	if !copied {
+		m.count(&m.stats.Skipped)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Copied++
+	if m.checkpoint != nil && !m.opts.DryRun {
+		if _, err := io.WriteString(m.checkpoint, checkpointKey(md)+"\n"); err != nil {
+			log.Debugf(ctx, "Failed to write checkpoint for %s (%s): %s", md.SourceURL, md.Preset, err)
+		}
+	}
+}
+
+// copy copies a single variant. false is returned if the destination
+// already has an identical copy
+func (m *migration) copy(ctx context.Context, md *variant.Metadata) (bool, error) {
+	u, err := url.Parse(md.SourceURL)
+	if err != nil {
+		return false, errors.Wrap(err, `failed to parse source url`)
+	}
+
+	if st, ok := m.dst.(Stater); ok && md.ETag != "" {
+		if existing, err := st.Stat(ctx, u, md.Preset); err == nil && existing.ETag == md.ETag {
+			return false, nil
+		}
+	}
+
+	if m.opts.DryRun {
+		log.Debugf(ctx, "Would migrate %s (%s)", md.SourceURL, md.Preset)
+		return true, nil
+	}
+
+	h, err := m.src.Get(ctx, u, md.Preset)
+	if err != nil {
+		return false, errors.Wrap(err, `failed to get variant from source`)
+	}
+
+	content, contentType, err := httputil.Fetch(ctx, h)
+	if err != nil {
+		return false, errors.Wrap(err, `failed to fetch variant from source`)
+	}
+
+	sum := checksum(content)
+	if md.ETag != "" && md.ETag != sum {
+		return false, errors.Errorf(`checksum mismatch for content from source: expected %s, got %s`, md.ETag, sum)
+	}
+
+	newmd := *md
+	newmd.Path = ""
+	newmd.ETag = sum
+	if newmd.ContentType == "" {
+		newmd.ContentType = contentType
+	}
+	if newmd.Size == 0 {
+		newmd.Size = int64(len(content))
+	}
+
+	log.Debugf(ctx, "Migrating %s (%s)", md.SourceURL, md.Preset)
+	if err := m.put.Put(ctx, u, md.Preset, &newmd, content); err != nil {
+		return false, errors.Wrap(err, `failed to store variant in destination`)
+	}
+
+	if m.opts.Verify {
+		h, err := m.dst.Get(ctx, u, md.Preset)
+		if err != nil {
+			return false, errors.Wrap(err, `failed to get variant from destination`)
+		}
+
+		stored, _, err := httputil.Fetch(ctx, h)
+		if err != nil {
+			return false, errors.Wrap(err, `failed to fetch variant from destination`)
+		}
+
+		if got := checksum(stored); got != sum {
+			return false, errors.Errorf(`checksum mismatch for content in destination: expected %s, got %s`, sum, got)
+		}
+	}
+	return true, nil
+}
+
+func checksum(content []byte) string {
+	h := md5.Sum(content)
+	return hex.EncodeToString(h[:])
+}
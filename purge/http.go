@@ -0,0 +1,102 @@
+package purge
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+)
+
+// DefaultTimeout is used when HTTPConfig.Timeout is not specified
+const DefaultTimeout = 10 * time.Second
+
+// HTTPPurger purges cached content by sending an HTTP request per
+// variant. This works with CDNs and caching proxies that accept
+// PURGE requests (e.g. Fastly, Varnish), as well as with custom
+// endpoints that forward the request to a CDN API
+type HTTPPurger struct {
+	client  *http.Client
+	headers map[string]string
+	method  string
+	signer  func(string, string) string
+	url     *template.Template
+}
+
+func NewHTTP(c *HTTPConfig, options ...HTTPOption) (*HTTPPurger, error) {
+	if c.URL == "" {
+		return nil, errors.New("http purger: 'URL' is required")
+	}
+
+	t, err := template.New("purge").Option("missingkey=error").Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, `http purger: failed to parse 'URL'`)
+	}
+
+	method := c.Method
+	if method == "" {
+		method = "PURGE"
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	p := &HTTPPurger{
+		client:  &http.Client{Timeout: timeout},
+		headers: c.Headers,
+		method:  method,
+		url:     t,
+	}
+	for _, o := range options {
+		o.Configure(p)
+	}
+	return p, nil
+}
+
+func (p *HTTPPurger) Purge(ctx context.Context, u *url.URL, preset string) error {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	// signed options are kept in the fragment
+	src := *u
+	src.Fragment = ""
+	vars := TemplateVars{Preset: preset, URL: src.String(), Options: u.Fragment}
+	if vars.Options != "" && p.signer != nil {
+		vars.Signature = p.signer(vars.URL, vars.Options)
+	}
+
+	if err := p.url.Execute(buf, vars); err != nil {
+		return errors.Wrap(err, `failed to create purge URL`)
+	}
+	purgeURL := buf.String()
+
+	req, err := http.NewRequest(p.method, purgeURL, nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create purge request`)
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+
+	log.Debugf(ctx, "Sending %s request to %s...", p.method, purgeURL)
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, `failed to send purge request to %s`, purgeURL)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf(`purge request to %s failed: %d`, purgeURL, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package purge_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/purge"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestHTTPPurger(t *testing.T) {
+	var method, requestURI, key string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		requestURI = r.RequestURI
+		key = r.Header.Get("Fastly-Key")
+		if r.URL.Query().Get("preset") == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	p, err := purge.NewHTTP(&purge.HTTPConfig{
+		URL:     srv.URL + "/?url={{.URL | urlquery}}&preset={{.Preset}}",
+		Headers: map[string]string{"Fastly-Key": "secret"},
+	})
+	if !assert.NoError(t, err, "NewHTTP should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png?bar=baz")
+	if !assert.NoError(t, p.Purge(ctx, u, "small"), "Purge should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, "PURGE", method, "method should be PURGE") {
+		return
+	}
+	if !assert.Equal(t, "/?url=http%3A%2F%2Fexample.com%2Ffoo.png%3Fbar%3Dbaz&preset=small", requestURI, "URL should match") {
+		return
+	}
+	if !assert.Equal(t, "secret", key, "headers should be sent") {
+		return
+	}
+
+	if !assert.Error(t, p.Purge(ctx, u, "missing"), "Purge should fail on non-2xx responses") {
+		return
+	}
+}
+
+func TestHTTPPurgerSignedOptions(t *testing.T) {
+	var requestURI string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	p, err := purge.NewHTTP(&purge.HTTPConfig{
+		URL: srv.URL + "/?url={{.URL | urlquery}}&preset={{.Preset}}{{if .Options}}&opts={{.Options | urlquery}}&sig={{.Signature}}{{end}}",
+	}, purge.WithSigner(func(rawurl, opts string) string {
+		return "signed"
+	}))
+	if !assert.NoError(t, err, "NewHTTP should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png#fp0.2:0.3")
+	if !assert.NoError(t, p.Purge(ctx, u, "small"), "Purge should succeed") {
+		return
+	}
+	if !assert.Equal(t, "/?url=http%3A%2F%2Fexample.com%2Ffoo.png&preset=small&opts=fp0.2%3A0.3&sig=signed", requestURI, "URL should include the options") {
+		return
+	}
+
+	u, _ = url.Parse("http://example.com/foo.png")
+	if !assert.NoError(t, p.Purge(ctx, u, "small"), "Purge should succeed") {
+		return
+	}
+	if !assert.Equal(t, "/?url=http%3A%2F%2Fexample.com%2Ffoo.png&preset=small", requestURI, "URL should not include options") {
+		return
+	}
+}
+
+func TestNewHTTP(t *testing.T) {
+	if _, err := purge.NewHTTP(&purge.HTTPConfig{}); !assert.Error(t, err, "NewHTTP should fail without URL") {
+		return
+	}
+	if _, err := purge.NewHTTP(&purge.HTTPConfig{URL: "http://example.com/{{.Preset"}); !assert.Error(t, err, "NewHTTP should fail with bad template") {
+		return
+	}
+}
@@ -0,0 +1,55 @@
+package purge
+
+import (
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Purger removes the transformed image for the given source URL and
+// preset from caches in front of sharaq, such as CDNs. For images
+// requested with signed options, the options are in the fragment of
+// the URL
+type Purger interface {
+	Purge(ctx context.Context, u *url.URL, preset string) error
+}
+
+// HTTPConfig configures HTTPPurger. URL is a text/template, which is
+// executed with TemplateVars, e.g.
+// "https://cdn.example.com/{{.Preset}}/{{.URL}}" or
+// "https://cdn.example.com/?url={{.URL | urlquery}}&preset={{.Preset}}"
+type HTTPConfig struct {
+	Method  string            // defaults to "PURGE"
+	URL     string            // template of the URL to send requests to
+	Headers map[string]string // additional headers, e.g. API keys
+	Timeout time.Duration     // defaults to DefaultTimeout
+}
+
+// TemplateVars is passed to the URL template
+type TemplateVars struct {
+	Preset    string
+	URL       string // the source URL
+	Options   string // the signed options, if the image was requested with them
+	Signature string // the signature of Options. Empty unless WithSigner is given
+}
+
+// HTTPOption configures HTTPPurger
+type HTTPOption interface {
+	Configure(*HTTPPurger)
+}
+
+type HTTPOptionFunc func(*HTTPPurger)
+
+func (f HTTPOptionFunc) Configure(p *HTTPPurger) {
+	f(p)
+}
+
+// WithSigner sets the function used to sign the options of images
+// requested with signed options, so that purge URLs can include the
+// signature along with the options
+func WithSigner(fn func(rawurl, opts string) string) HTTPOption {
+	return HTTPOptionFunc(func(p *HTTPPurger) {
+		p.signer = fn
+	})
+}
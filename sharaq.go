@@ -4,23 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
-	"github.com/lestrrat-go/sharaq/aws"
-	"github.com/lestrrat-go/sharaq/fs"
-	"github.com/lestrrat-go/sharaq/gcp"
+	"github.com/lestrrat-go/sharaq/cas"
+	"github.com/lestrrat-go/sharaq/internal/breaker"
 	"github.com/lestrrat-go/sharaq/internal/errors"
 	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/purge"
+	"github.com/lestrrat-go/sharaq/variant"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
 )
 
+// healthCheckTimeout is how long the readiness endpoint waits for
+// the backend health check
+const healthCheckTimeout = 5 * time.Second
+
 func NewServer(c *Config) (*Server, error) {
 	// Just so that we don't barf...
 	if c == nil {
@@ -65,12 +73,118 @@ func (s *Server) Initialize() error {
 	}
 	s.transformer = transformer.New()
 
+	// Overlays may be read from the backend, so the presets referring
+	// to them are filled in once it is created. The backend keeps a
+	// reference to the map
+	s.presets = make(map[string]string, len(s.config.Presets))
 	if err := s.newBackend(); err != nil {
 		return errors.Wrap(err, `failed to create storage backend`)
 	}
+	if err := s.loadOverlays(); err != nil {
+		return errors.Wrap(err, `failed to load overlays`)
+	}
+
+	s.breaker = nil
+	if c := s.config.CircuitBreaker; c != nil {
+		threshold := c.Threshold
+		if threshold <= 0 {
+			threshold = DefaultCircuitBreakerThreshold
+		}
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = DefaultCircuitBreakerTimeout
+		}
+		s.breaker = breaker.New(threshold, timeout)
+	}
+
+	s.purger = s.customPurger
+	if s.purger == nil && s.config.Purge != nil {
+		key := s.config.SigningKey
+		p, err := purge.NewHTTP(s.config.Purge, purge.WithSigner(func(rawurl, opts string) string {
+			return SignOptions(key, rawurl, opts)
+		}))
+		if err != nil {
+			return errors.Wrap(err, `failed to create purger`)
+		}
+		s.purger = p
+	}
 	return nil
 }
 
+// loadOverlays registers the configured overlay images with the
+// transformer, and pins the presets referring to them to their
+// content, so that variants are regenerated when they change
+func (s *Server) loadOverlays() error {
+	ctx := context.Background()
+	for name, src := range s.config.Overlays {
+		var content []byte
+		switch {
+		case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+			img, err := s.transformer.Fetch(ctx, src)
+			if err != nil {
+				return errors.Wrapf(err, `failed to fetch overlay %s`, name)
+			}
+			content = img.Content
+		case strings.HasPrefix(src, "backend:"):
+			r, ok := s.backend.(ObjectReader)
+			if !ok {
+				return errors.Errorf(`overlay %s: storage backend %s can not read objects`, name, s.config.Backend.Type)
+			}
+			var err error
+			content, err = r.ReadObject(ctx, strings.TrimPrefix(src, "backend:"))
+			if err != nil {
+				return errors.Wrapf(err, `failed to read overlay %s from the storage backend`, name)
+			}
+		default:
+			var err error
+			content, err = ioutil.ReadFile(src)
+			if err != nil {
+				return errors.Wrapf(err, `failed to read overlay %s`, name)
+			}
+		}
+
+		if err := s.transformer.AddOverlay(name, content); err != nil {
+			return errors.Wrapf(err, `failed to add overlay %s`, name)
+		}
+	}
+
+	for preset, rule := range s.config.Presets {
+		bound, err := s.transformer.BindOverlays(rule)
+		if err != nil {
+			return errors.Wrapf(err, `invalid rule for preset %s`, preset)
+		}
+		s.presets[preset] = bound
+	}
+	return nil
+}
+
+// SetPurger sets the Purger to be used to purge CDN caches when
+// images are deleted or regenerated. This takes precedence over
+// the Purge configuration, and must be called before Initialize
+func (s *Server) SetPurger(p purge.Purger) {
+	s.customPurger = p
+}
+
+// purge purges the variants for the given presets from CDN caches.
+// Errors are logged, as there's nothing more we can do about them
+func (s *Server) purge(ctx context.Context, u *url.URL, presets []string) {
+	if s.purger == nil {
+		return
+	}
+
+	var grp errgroup.Group
+	for _, preset := range presets {
+		preset := preset
+		grp.Go(func() error {
+			if err := s.purger.Purge(ctx, u, preset); err != nil {
+				log.Debugf(ctx, "Failed to purge %s (%s): %s", u, preset, err)
+			}
+			return nil
+		})
+	}
+	grp.Wait()
+}
+
 func (s *Server) dumpConfig() {
 	j, err := json.MarshalIndent(s.config, "", "  ")
 	if err != nil {
@@ -86,43 +200,33 @@ func (s *Server) dumpConfig() {
 }
 
 func (s *Server) newBackend() error {
-	switch s.config.Backend.Type {
-	case "aws":
-		b, err := aws.NewBackend(
-			&s.config.Backend.Amazon,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
-		if err != nil {
-			return errors.Wrap(err, `failed to create aws backend`)
-		}
-		s.backend = b
-	case "gcp":
-		b, err := gcp.NewBackend(
-			&s.config.Backend.Google,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
-		if err != nil {
-			return errors.Wrap(err, `failed to create gcp backend`)
+	env := &BackendEnv{
+		cache:       s.cache,
+		presets:     s.presets,
+		transformer: s.transformer,
+	}
+
+	b, err := env.NewBackend(&s.config.Backend)
+	if err != nil {
+		return err
+	}
+
+	if s.config.ContentAddressed {
+		st, ok := b.(cas.Storage)
+		if !ok {
+			return errors.Errorf(`storage backend %s can not be used for content addressed storage`, s.config.Backend.Type)
 		}
-		s.backend = b
-	case "fs":
-		b, err := fs.NewBackend(
-			&s.config.Backend.FileSystem,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
+		b, err = cas.NewBackend(st, s.cache, s.transformer, s.presets)
 		if err != nil {
-			return errors.Wrap(err, `failed to create file system backend`)
+			return errors.Wrap(err, `failed to create content addressed backend`)
 		}
-		s.backend = b
-	default:
-		return errors.Errorf(`invalid storage backend %s`, s.config.Backend.Type)
 	}
+
+	// Some backends run background jobs. Stop them before replacing
+	if c, ok := s.backend.(io.Closer); ok {
+		c.Close()
+	}
+	s.backend = b
 	return nil
 }
 
@@ -132,6 +236,24 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/ready" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "What, what, what?", http.StatusBadRequest)
+			return
+		}
+		s.handleReady(w, r)
+		return
+	}
+
+	if r.URL.Path == "/variants" {
+		if r.Method != "GET" {
+			http.Error(w, "What, what, what?", http.StatusBadRequest)
+			return
+		}
+		s.handleVariants(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		s.handleFetch(w, r)
@@ -149,8 +271,11 @@ func (s *Server) allowedTarget(u *url.URL) bool {
 		return true
 	}
 
+	// signed options don't change which image is fetched
+	v := *u
+	v.Fragment = ""
 	for _, pat := range s.whitelist {
-		if pat.MatchString(u.String()) {
+		if pat.MatchString(v.String()) {
 			return true
 		}
 	}
@@ -161,10 +286,10 @@ func (s *Server) allowedTarget(u *url.URL) bool {
 func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 	ctx := util.RequestCtx(r)
 
-	u, err := util.GetTargetURL(r)
+	u, err := s.getSource(r)
 	if err != nil {
 		log.Debugf(ctx, "Bad url: %s", err)
-		http.Error(w, "Bad url", http.StatusBadRequest)
+		replySourceError(w, err, "Bad url")
 		return
 	}
 
@@ -180,7 +305,14 @@ func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.backendAvailable() {
+		log.Debugf(ctx, "Backend is down, fallback to serving original content at %s", u)
+		serveOriginal(w, u)
+		return
+	}
+
 	content, err := s.backend.Get(ctx, u, preset)
+	s.reportBackend(err)
 	if err == nil {
 		content.ServeHTTP(w, r)
 		return
@@ -188,6 +320,10 @@ func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 
 	if !errors.IsTransformationRequired(err) {
 		log.Debugf(ctx, "failed to serve from backend: %s", err)
+		if s.breaker != nil {
+			serveOriginal(w, u)
+			return
+		}
 		http.Error(w, "Internal server error", 500)
 		return
 	}
@@ -200,10 +336,61 @@ func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 
 	// Serve the original file, just so that we don't return an error
 	log.Debugf(ctx, "Fallback to serving original content at %s", u)
+	serveOriginal(w, u)
+}
+
+func serveOriginal(w http.ResponseWriter, u *url.URL) {
 	w.Header().Add("Location", u.String())
 	w.WriteHeader(http.StatusFound)
+}
 
-	return
+// backendAvailable returns false if the circuit breaker has determined
+// that the backend is down
+func (s *Server) backendAvailable() bool {
+	return s.breaker == nil || s.breaker.Allow()
+}
+
+// reportBackend reports the result of a call to the backend to the
+// circuit breaker. Missing variants are not failures
+func (s *Server) reportBackend(err error) {
+	if s.breaker == nil {
+		return
+	}
+
+	if err != nil && !errors.IsTransformationRequired(err) {
+		s.breaker.Failure()
+		return
+	}
+	s.breaker.Success()
+}
+
+// handleReady replies with 200 if the backend is usable, and with 503
+// otherwise, so that load balancers can stop sending requests. The
+// circuit breaker is only consulted, as a passing health check does
+// not mean that actual requests to the backend succeed
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(util.RequestCtx(r), healthCheckTimeout)
+	defer cancel()
+
+	if s.breaker != nil && s.breaker.Open() {
+		log.Debugf(ctx, "Circuit breaker is open")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var err error
+	if hc, ok := s.backend.(HealthChecker); ok {
+		err = hc.HealthCheck(ctx)
+	}
+
+	if err != nil {
+		log.Debugf(ctx, "Backend health check failed: %s", err)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "OK\n")
 }
 
 func (s *Server) markProcessing(ctx context.Context, u *url.URL) error {
@@ -232,9 +419,14 @@ func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := util.GetTargetURL(r)
+	u, err := s.getSource(r)
 	if err != nil {
-		http.Error(w, `url parameter missing`, http.StatusBadRequest)
+		replySourceError(w, err, `url parameter missing`)
+		return
+	}
+
+	if !s.backendAvailable() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -255,9 +447,34 @@ func (s *Server) transformAndStore(ctx context.Context, u *url.URL) error {
 	}
 	defer s.unmarkProcessing(ctx, u)
 
+	// Variants that already exist are overwritten, so stale copies
+	// need to be purged from CDN caches afterwards. If the backend
+	// can't tell which exist, all of them are purged
+	var existing []string
+	if s.purger != nil {
+		st, ok := s.backend.(Stater)
+		for preset := range s.presets {
+			if !ok {
+				existing = append(existing, preset)
+				continue
+			}
+			if _, err := st.Stat(ctx, u, preset); err == nil {
+				existing = append(existing, preset)
+			}
+		}
+	}
+
+	// Only failures of the storage are reported to the circuit
+	// breaker, as others may well be caused by the source image
 	if err := s.backend.StoreTransformedContent(ctx, u); err != nil {
+		if errors.IsStorageFailure(err) {
+			s.reportBackend(err)
+		}
 		return errors.Wrap(err, `failed to process content`)
 	}
+	s.reportBackend(nil)
+
+	s.purge(ctx, u, existing)
 	return nil
 }
 
@@ -268,9 +485,14 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := util.GetTargetURL(r)
+	u, err := s.getSource(r)
 	if err != nil {
-		http.Error(w, `url parameter missing`, http.StatusBadRequest)
+		replySourceError(w, err, `url parameter missing`)
+		return
+	}
+
+	if !s.backendAvailable() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -283,15 +505,67 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	defer s.unmarkProcessing(ctx, u)
 
-	if err := s.backend.Delete(ctx, u); err != nil {
+	err = s.backend.Delete(ctx, u)
+	s.reportBackend(err)
+	if err != nil {
 		log.Debugf(ctx, "Error detected while processing: %s", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
+	presets := make([]string, 0, len(s.presets))
+	for preset := range s.presets {
+		presets = append(presets, preset)
+	}
+	s.purge(ctx, u, presets)
+
 	// w.Header().Add("X-Sharaq-Elapsed-Time", fmt.Sprintf("%0.2f", time.Since(start).Seconds()))
 }
 
+// handleVariants replies with the list of variants stored for
+// the given url
+func (s *Server) handleVariants(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, `not authorized`, http.StatusForbidden)
+		return
+	}
+
+	u, err := s.getSource(r)
+	if err != nil {
+		replySourceError(w, err, `url parameter missing`)
+		return
+	}
+
+	lister, ok := s.backend.(Lister)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	if !s.backendAvailable() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	list, err := lister.List(ctx, u)
+	s.reportBackend(err)
+	if err != nil {
+		log.Debugf(ctx, "Error detected while listing variants: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if list == nil {
+		list = []*variant.Metadata{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Debugf(ctx, "Failed to encode variants: %s", err)
+	}
+}
+
 func (s *Server) authorized(r *http.Request) bool {
 	if r.Header.Get("X-Appengine-Taskname") != "" {
 		// Trust inbound taskqueue requests
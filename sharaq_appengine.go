@@ -15,9 +15,18 @@ var queueName = os.Getenv("SHARAQ_QUEUE_NAME")
 
 // Under appengine, we MUST use a task queue to offload this
 func (s *Server) deferedTransformAndStore(ctx context.Context, u *url.URL) error {
-	task := taskqueue.NewPOSTTask("/", url.Values{
-		"url": []string{u.String()},
-	})
+	// the options of signed requests are passed on, as they are not
+	// part of the url parameter
+	v := *u
+	v.Fragment = ""
+	values := url.Values{
+		"url": []string{v.String()},
+	}
+	if opts := u.Fragment; opts != "" {
+		values.Set("opts", opts)
+		values.Set("sig", SignOptions(s.config.SigningKey, v.String(), opts))
+	}
+	task := taskqueue.NewPOSTTask("/", values)
 	if _, err := taskqueue.Add(ctx, task, queueName); err != nil {
 		return errors.Wrap(err, `failed to add task to queue`)
 	}
@@ -3,14 +3,31 @@
 package sharaq
 
 import (
+	"encoding/json"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/lestrrat-go/sharaq/azure"
+	"github.com/lestrrat-go/sharaq/fs"
+	"github.com/lestrrat-go/sharaq/internal/breaker"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/purge"
+	"github.com/lestrrat-go/sharaq/tiered"
+	"github.com/lestrrat-go/sharaq/variant"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func newImageSource() *httptest.Server {
@@ -144,3 +161,942 @@ func TestDelete(t *testing.T) {
 		return
 	}
 }
+
+type nullBackend struct {
+	Greeting string
+}
+
+func (b *nullBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	return nil, errors.TransformationRequiredError{}
+}
+func (b *nullBackend) StoreTransformedContent(context.Context, *url.URL) error { return nil }
+func (b *nullBackend) Delete(context.Context, *url.URL) error                  { return nil }
+
+// closingBackend can be used as content addressed storage, and records
+// whether it has been closed
+type closingBackend struct {
+	nullBackend
+	closed bool
+}
+
+func (b *closingBackend) Stat(context.Context, *url.URL, string) (*variant.Metadata, error) {
+	return nil, errors.TransformationRequiredError{}
+}
+func (b *closingBackend) Put(context.Context, *url.URL, string, *variant.Metadata, []byte) error {
+	return nil
+}
+func (b *closingBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestReloadClosesBackend(t *testing.T) {
+	var created []*closingBackend
+	RegisterBackend("closing", func(env *BackendEnv) (Backend, error) {
+		b := &closingBackend{}
+		created = append(created, b)
+		return b, nil
+	})
+
+	var c Config
+	src := `{"Presets":{"small":"100x100"},"ContentAddressed":true,"Backend":{"Type":"closing"}}`
+	if !assert.NoError(t, c.Parse(strings.NewReader(src)), "Parse should succeed") {
+		return
+	}
+
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+
+	// the initial start, followed by two reloads
+	for i := 0; i < 3; i++ {
+		if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+			return
+		}
+	}
+
+	if !assert.Len(t, created, 3, "a backend should be created for each Initialize") {
+		return
+	}
+	for i, b := range created[:2] {
+		if !assert.True(t, b.closed, "backend %d should be closed when replaced", i) {
+			return
+		}
+	}
+	if !assert.False(t, created[2].closed, "current backend should not be closed") {
+		return
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("null", func(env *BackendEnv) (Backend, error) {
+		var b nullBackend
+		if err := env.Decode(&b); err != nil {
+			return nil, err
+		}
+		return &b, nil
+	})
+
+	if !assert.Contains(t, Backends(), "null", "Backends should contain registered backend") {
+		return
+	}
+
+	if !assert.Panics(t, func() { RegisterBackend("null", nil) }, "RegisterBackend should panic for nil factory") {
+		return
+	}
+
+	if !assert.Panics(t, func() {
+		RegisterBackend("fs", func(*BackendEnv) (Backend, error) { return nil, nil })
+	}, "RegisterBackend should panic for duplicate names") {
+		return
+	}
+
+	var c Config
+	src := `{"Presets":{"small":"100x100"},"Backend":{"Type":"null","null":{"Greeting":"Hello, World!"}}}`
+	if !assert.NoError(t, c.Parse(strings.NewReader(src)), "Parse should succeed") {
+		return
+	}
+
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, &nullBackend{Greeting: "Hello, World!"}, s.backend, "backend should be configured") {
+		return
+	}
+
+	// Backends don't have to implement the optional interfaces
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/variants?url=http://example.com/foo.png", nil)
+	r.Header.Set("Sharaq-Token", "AbCdEfG")
+	s.tokens = map[string]struct{}{"AbCdEfG": {}}
+	s.ServeHTTP(w, r)
+	if !assert.Equal(t, http.StatusNotImplemented, w.Code, "listing variants should not be implemented") {
+		return
+	}
+	if _, err := s.Migrate(context.Background(), &BackendConfig{Type: "memory"}, nil); !assert.Error(t, err, "Migrate should fail without Walk") {
+		return
+	}
+
+	c.Backend.Type = "unknown"
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for unknown backends") {
+		return
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Presets: map[string]string{"small": "10x10"},
+		Tokens:  []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	imageURL := newURL(src, "sharaq.png")
+	target := st.URL + "/?" + url.Values{"url": {imageURL}, "preset": {"small"}}.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "status code should be no content") {
+		return
+	}
+
+	res, err = http.Get(target)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "status code should be OK") {
+		return
+	}
+	if !assert.Equal(t, "image/png", res.Header.Get("Content-Type"), "content type should be image/png") {
+		return
+	}
+
+	m, err := png.Decode(res.Body)
+	if !assert.NoError(t, err, "png.Decode should succeed") {
+		return
+	}
+	if !assert.Equal(t, image.Rect(0, 0, 10, 10), m.Bounds(), "image should be transformed") {
+		return
+	}
+
+	req, err = http.NewRequest(http.MethodGet, st.URL+"/variants?"+url.Values{"url": {imageURL}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	var list []*variant.Metadata
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&list), "json.Decode should succeed") {
+		return
+	}
+	if !assert.Len(t, list, 1, "there should be 1 variant") {
+		return
+	}
+	if !assert.Equal(t, "small", list[0].Preset, "preset should match") {
+		return
+	}
+	if !assert.Equal(t, 10, list[0].Width, "width should match") {
+		return
+	}
+}
+
+func TestSignedOptions(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:    BackendConfig{Type: "memory"},
+		Presets:    map[string]string{"small": "10x10"},
+		SigningKey: "s3cr3t",
+		Tokens:     []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	imageURL := newURL(src, "sharaq.png")
+	opts := "20x20,fp0.1:0.9"
+	request := func(method string, v url.Values) *http.Response {
+		req, err := http.NewRequest(method, st.URL+"/?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return nil
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return nil
+		}
+		return res
+	}
+
+	for _, v := range []url.Values{
+		{"url": {imageURL}, "preset": {"small"}, "opts": {opts}},
+		{"url": {imageURL}, "preset": {"small"}, "opts": {opts}, "sig": {SignOptions("wrong", imageURL, opts)}},
+		{"url": {imageURL}, "preset": {"small"}, "opts": {"40x40"}, "sig": {SignOptions(c.SigningKey, imageURL, opts)}},
+	} {
+		res := request(http.MethodGet, v)
+		if res == nil {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "options without a valid signature should be rejected") {
+			return
+		}
+	}
+
+	res := request(http.MethodGet, url.Values{"url": {imageURL}, "preset": {"small"}, "opts": {"wm:logo"}, "sig": {SignOptions(c.SigningKey, imageURL, "wm:logo")}})
+	if res == nil {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "overlays should be rejected") {
+		return
+	}
+
+	signed := url.Values{"url": {imageURL}, "preset": {"small"}, "opts": {opts}, "sig": {SignOptions(c.SigningKey, imageURL, opts)}}
+	for _, v := range []url.Values{{"url": {imageURL}, "preset": {"small"}}, signed} {
+		res := request(http.MethodPost, v)
+		if res == nil {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "status code should be no content") {
+			return
+		}
+	}
+
+	for _, tt := range []struct {
+		v    url.Values
+		size int
+	}{
+		{url.Values{"url": {imageURL}, "preset": {"small"}}, 10},
+		{signed, 20},
+	} {
+		res := request(http.MethodGet, tt.v)
+		if res == nil {
+			return
+		}
+		m, err := png.Decode(res.Body)
+		res.Body.Close()
+		if !assert.NoError(t, err, "png.Decode should succeed") {
+			return
+		}
+		if !assert.Equal(t, image.Rect(0, 0, tt.size, tt.size), m.Bounds(), "signed options should take precedence over the preset") {
+			return
+		}
+	}
+
+	// Deleting the variants created with options leaves the others
+	res = request(http.MethodDelete, signed)
+	if res == nil {
+		return
+	}
+	res.Body.Close()
+
+	u, _ := url.Parse(imageURL)
+	if _, err := s.backend.(Stater).Stat(context.Background(), u, "small"); !assert.NoError(t, err, "variant without options should remain") {
+		return
+	}
+	u.Fragment = opts
+	if _, err := s.backend.(Stater).Stat(context.Background(), u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "variant with options should be deleted") {
+		return
+	}
+}
+
+func TestTieredBackend(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		error bool
+	}{
+		{
+			name:  "memory in front of memory",
+			src:   `{"Presets":{"small":"100x100"},"URLCache":{"Type":"Memory"},"Backend":{"Type":"tiered","Tiered":{"Local":{"Type":"memory","Memory":{"MaxSize":1024}},"Remote":{"Type":"memory"}}}}`,
+			error: false,
+		},
+		{
+			name:  "local tier does not support Put",
+			src:   `{"Presets":{"small":"100x100"},"URLCache":{"Type":"Memory"},"Backend":{"Type":"tiered","Tiered":{"Local":{"Type":"tiered","Tiered":{"Local":{"Type":"memory"},"Remote":{"Type":"memory"}}},"Remote":{"Type":"memory"}}}}`,
+			error: true,
+		},
+		{
+			name:  "unknown remote tier",
+			src:   `{"Presets":{"small":"100x100"},"URLCache":{"Type":"Memory"},"Backend":{"Type":"tiered","Tiered":{"Local":{"Type":"memory"},"Remote":{"Type":"unknown"}}}}`,
+			error: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			if !assert.NoError(t, c.Parse(strings.NewReader(tt.src)), "Parse should succeed") {
+				return
+			}
+
+			s, err := NewServer(&c)
+			if !assert.NoError(t, err, "NewServer should succeed") {
+				return
+			}
+
+			if tt.error {
+				assert.Error(t, s.Initialize(), "Initialize should fail")
+				return
+			}
+
+			if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+				return
+			}
+			assert.IsType(t, &tiered.Backend{}, s.backend, "backend should be tiered")
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	var mu sync.Mutex
+	var purged []string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		purged = append(purged, r.Method+" "+r.URL.Path)
+	}))
+	defer cdn.Close()
+
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Presets: map[string]string{"small": "10x10"},
+		Purge:   &purge.HTTPConfig{URL: cdn.URL + "/{{.Preset}}/{{.URL}}"},
+		Tokens:  []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	imageURL := newURL(src, "sharaq.png")
+	target := st.URL + "/?" + url.Values{"url": {imageURL}}.Encode()
+	expected := "PURGE /small/" + imageURL
+
+	// The first store creates the variant, so there's nothing to purge.
+	// Storing again overwrites it, and deleting removes it
+	tests := []struct {
+		method string
+		purges int
+	}{
+		{http.MethodPost, 0},
+		{http.MethodPost, 1},
+		{http.MethodDelete, 2},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, target, nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		res.Body.Close()
+
+		mu.Lock()
+		got := append([]string(nil), purged...)
+		mu.Unlock()
+
+		if !assert.Len(t, got, tt.purges, "number of purges should match after %s", tt.method) {
+			return
+		}
+		for _, v := range got {
+			if !assert.Equal(t, expected, v, "purge request should match") {
+				return
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "sharaq-migrate-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Presets: map[string]string{"small": "10x10"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, err := url.Parse(newURL(src, "sharaq.png"))
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.backend.StoreTransformedContent(ctx, u), "StoreTransformedContent should succeed") {
+		return
+	}
+
+	dst := BackendConfig{
+		Type: "fs",
+		FileSystem: fs.Config{
+			Root: filepath.Join(dir, "images"),
+		},
+	}
+	checkpoint := filepath.Join(dir, "checkpoint")
+
+	stats, err := s.Migrate(ctx, &dst, &MigrateOptions{DryRun: true})
+	if !assert.NoError(t, err, "Migrate (dry-run) should succeed") {
+		return
+	}
+	if !assert.Equal(t, &MigrateStats{Copied: 1}, stats, "dry-run should report 1 variant") {
+		return
+	}
+
+	stats, err = s.Migrate(ctx, &dst, &MigrateOptions{Checkpoint: checkpoint, Concurrency: 2, Verify: true})
+	if !assert.NoError(t, err, "Migrate should succeed") {
+		return
+	}
+	if !assert.Equal(t, &MigrateStats{Copied: 1}, stats, "1 variant should be copied") {
+		return
+	}
+
+	b, err := fs.NewBackend(&dst.FileSystem, s.cache, s.transformer, c.Presets)
+	if !assert.NoError(t, err, "fs.NewBackend should succeed") {
+		return
+	}
+	defer b.Close()
+
+	expected, err := s.backend.(Stater).Stat(ctx, u, "small")
+	if !assert.NoError(t, err, "Stat on source should succeed") {
+		return
+	}
+	md, err := b.Stat(ctx, u, "small")
+	if !assert.NoError(t, err, "Stat on destination should succeed") {
+		return
+	}
+	if !assert.Equal(t, expected.ETag, md.ETag, "ETag should match") {
+		return
+	}
+
+	// Already copied variants are recorded in the checkpoint
+	stats, err = s.Migrate(ctx, &dst, &MigrateOptions{Checkpoint: checkpoint})
+	if !assert.NoError(t, err, "Migrate should succeed") {
+		return
+	}
+	if !assert.Equal(t, &MigrateStats{Skipped: 1}, stats, "1 variant should be skipped") {
+		return
+	}
+
+	// Variants created with a different rule are not copied
+	c.Presets["small"] = "20x20"
+	stats, err = s.Migrate(ctx, &dst, nil)
+	if !assert.NoError(t, err, "Migrate should succeed") {
+		return
+	}
+	if !assert.Equal(t, &MigrateStats{Skipped: 1}, stats, "stale variant should be skipped") {
+		return
+	}
+}
+
+// downBackend fails every call while down is set
+type downBackend struct {
+	nullBackend
+	mu   sync.Mutex
+	down bool
+	gets int
+}
+
+func (b *downBackend) setDown(v bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = v
+}
+
+func (b *downBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gets++
+	if b.down {
+		return nil, errors.New("backend is down")
+	}
+	return nil, errors.TransformationRequiredError{}
+}
+
+func (b *downBackend) HealthCheck(context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("backend is down")
+	}
+	return nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := Config{
+		Backend:        BackendConfig{Type: "memory"},
+		CircuitBreaker: &CircuitBreakerConfig{Threshold: 2, Timeout: 500 * time.Millisecond},
+		Presets:        map[string]string{"small": "10x10"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	res, err := http.Get(st.URL + "/ready")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "memory backend should be ready") {
+		return
+	}
+
+	b := &downBackend{down: true}
+	s.backend = b
+
+	res, err = http.Get(st.URL + "/ready")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "backend should not be ready") {
+		return
+	}
+
+	// Don't follow redirects to the original image
+	cl := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	imageURL := "http://images.example.com/foo.png"
+	target := st.URL + "/?" + url.Values{"url": {imageURL}, "preset": {"small"}}.Encode()
+	for i := 0; i < 3; i++ {
+		res, err = cl.Get(target)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusFound, res.StatusCode, "should redirect to the original image") {
+			return
+		}
+		if !assert.Equal(t, imageURL, res.Header.Get("Location"), "should redirect to the original image") {
+			return
+		}
+	}
+	// the failed /ready check does not count, so the circuit opens
+	// after the second request
+	if !assert.Equal(t, 2, b.gets, "backend should not be called while the circuit is open") {
+		return
+	}
+
+	// A passing health check does not close the circuit
+	b.setDown(false)
+	res, err = http.Get(st.URL + "/ready")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "backend should not be ready while the circuit is open") {
+		return
+	}
+
+	res, err = cl.Get(target)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, 2, b.gets, "backend should not be called while the circuit is open") {
+		return
+	}
+
+	// Once the timeout passes, a request is let through, and closes
+	// the circuit as it succeeds
+	time.Sleep(500 * time.Millisecond)
+	res, err = cl.Get(target)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, 3, b.gets, "backend should be called once the timeout passes") {
+		return
+	}
+
+	res, err = http.Get(st.URL + "/ready")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "backend should be ready") {
+		return
+	}
+}
+
+// storeFailBackend fails to write every variant to its storage
+type storeFailBackend struct {
+	nullBackend
+}
+
+func (b *storeFailBackend) StoreTransformedContent(context.Context, *url.URL) error {
+	return errors.Storage(errors.New("disk full"))
+}
+
+func TestCircuitBreakerBackendErrors(t *testing.T) {
+	var mu sync.Mutex
+	var hits int
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+
+		// drop the connection, so that the backend gets a transport error
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+	}))
+	defer storage.Close()
+
+	c := Config{
+		Backend: BackendConfig{
+			Type: "azure",
+			Azure: azure.Config{
+				Container: "images",
+				Endpoint:  storage.URL,
+				SASToken:  "?sv=2018-03-28&sig=abc",
+			},
+		},
+		CircuitBreaker: &CircuitBreakerConfig{Threshold: 2, Timeout: time.Hour},
+		Presets:        map[string]string{"small": "10x10"},
+		Tokens:         []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	// Don't follow redirects to the original image
+	cl := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	target := st.URL + "/?" + url.Values{"url": {"http://images.example.com/foo.png"}, "preset": {"small"}}.Encode()
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(target)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusFound, res.StatusCode, "should redirect to the original image") {
+			return
+		}
+	}
+
+	mu.Lock()
+	before := hits
+	mu.Unlock()
+	if !assert.False(t, s.backendAvailable(), "transport errors should open the circuit") {
+		return
+	}
+
+	res, err := cl.Get(target)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	mu.Lock()
+	after := hits
+	mu.Unlock()
+	if !assert.Equal(t, before, after, "storage should not be called while the circuit is open") {
+		return
+	}
+
+	// Errors writing to the storage open the circuit as well
+	s.breaker = breaker.New(2, time.Hour)
+	s.backend = &storeFailBackend{}
+	store := st.URL + "/?" + url.Values{"url": {"http://images.example.com/foo.png"}}.Encode()
+	for _, code := range []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		req, err := http.NewRequest(http.MethodPost, store, nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, code, res.StatusCode, "status code should match") {
+			return
+		}
+	}
+}
+
+func TestOverlays(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("etc", "sharaq.png"))
+	})
+	overlays := httptest.NewServer(mux)
+	defer overlays.Close()
+
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Overlays: map[string]string{
+			"logo":   filepath.Join("etc", "sharaq.png"),
+			"remote": overlays.URL + "/logo.png",
+		},
+		Presets: map[string]string{
+			"large":  "400x400,wm:logo,wmpos:bottomright",
+			"medium": "200x200,wm:remote",
+			"small":  "10x10",
+		},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.Equal(t, "10x10", s.presets["small"], "presets without overlays should not change") {
+		return
+	}
+	if !assert.Contains(t, s.presets["large"], "wm:logo@", "overlay should be pinned to its content") {
+		return
+	}
+	// e.g. "400x400,wm:logo@0123abcd,wmpos:bottomright"
+	hash := strings.SplitN(strings.SplitN(s.presets["large"], "@", 2)[1], ",", 2)[0]
+	if !assert.Equal(t, "200x200,wm:remote@"+hash, s.presets["medium"], "overlay fetched from a URL should be pinned to its content") {
+		return
+	}
+
+	c.Overlays["remote"] = overlays.URL + "/nonexistent.png"
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for missing overlay URLs") {
+		return
+	}
+	c.Overlays["remote"] = overlays.URL + "/logo.png"
+
+	c.Presets["large"] = "400x400,wm:unknown"
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for unknown overlays") {
+		return
+	}
+
+	c.Overlays["logo"] = filepath.Join("etc", "nonexistent.png")
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for missing overlay files") {
+		return
+	}
+}
+
+func TestOverlaysFromBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharaq-overlays-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	logo, err := ioutil.ReadFile(filepath.Join("etc", "sharaq.png"))
+	if !assert.NoError(t, err, "ioutil.ReadFile should succeed") {
+		return
+	}
+	root := filepath.Join(dir, "images")
+	if !assert.NoError(t, os.MkdirAll(filepath.Join(root, "overlays"), 0755), "os.MkdirAll should succeed") {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "overlays", "logo.png"), logo, 0644), "ioutil.WriteFile should succeed") {
+		return
+	}
+	// outside of the root, and should not be readable through the backend
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret.png"), logo, 0644), "ioutil.WriteFile should succeed") {
+		return
+	}
+
+	c := Config{
+		Backend: BackendConfig{
+			Type:       "fs",
+			FileSystem: fs.Config{Root: root},
+		},
+		Overlays: map[string]string{
+			"logo": "backend:overlays/logo.png",
+		},
+		Presets: map[string]string{
+			"large": "400x400,wm:logo",
+		},
+		URLCache: &urlcache.Config{
+			Type: "Memory",
+		},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.Contains(t, s.presets["large"], "wm:logo@", "overlay read from the backend should be pinned to its content") {
+		return
+	}
+
+	// the backend is created before the overlays are loaded, and should
+	// see the presets with the overlay pinned
+	src := newImageSource()
+	defer src.Close()
+
+	ctx := context.Background()
+	u, err := url.Parse(newURL(src, "sharaq.png"))
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.backend.StoreTransformedContent(ctx, u), "StoreTransformedContent should succeed") {
+		return
+	}
+	md, err := s.backend.(Stater).Stat(ctx, u, "large")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, s.presets["large"], md.Rule, "variant should be created with the pinned rule") {
+		return
+	}
+
+	c.Overlays["logo"] = "backend:../secret.png"
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for paths outside of the backend") {
+		return
+	}
+
+	c.Overlays["logo"] = "backend:overlays/logo.png"
+	c.Backend = BackendConfig{Type: "memory"}
+	if !assert.Error(t, s.Initialize(), "Initialize should fail for backends that can not read objects") {
+		return
+	}
+}
@@ -0,0 +1,70 @@
+package sharaq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+var errInvalidSignature = errors.New(`invalid signature`)
+
+// SignOptions returns the signature of the options for the image at
+// rawurl, which is passed in the "sig" parameter along with the options
+// in the "opts" parameter. rawurl must be the same as the value of the
+// "url" parameter
+func SignOptions(key, rawurl, opts string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	io.WriteString(h, rawurl+"#"+opts)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getSource returns the URL of the source image of the request. If
+// the request carries options, their signature is verified, and they
+// are kept in the fragment of the URL. Backends treat the fragment as
+// part of the source URL, so that the variants are stored separately,
+// and the transformer applies the options after the rule of each preset
+func (s *Server) getSource(r *http.Request) (*url.URL, error) {
+	u, err := util.GetTargetURL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := r.FormValue("opts")
+	if opts == "" {
+		return u, nil
+	}
+
+	key := s.config.SigningKey
+	if key == "" {
+		return nil, errInvalidSignature
+	}
+	expected := SignOptions(key, r.FormValue("url"), opts)
+	if !hmac.Equal([]byte(r.FormValue("sig")), []byte(expected)) {
+		return nil, errInvalidSignature
+	}
+
+	// Overlays are pinned to their content in the preset rules, which
+	// can't be done for options that are fixed by the signature
+	if transformer.ParseOptions(opts).Watermark != "" {
+		return nil, errors.New(`overlays can not be used in signed options`)
+	}
+
+	u.Fragment = opts
+	return u, nil
+}
+
+// replySourceError replies with the error returned by getSource
+func replySourceError(w http.ResponseWriter, err error, msg string) {
+	if err == errInvalidSignature {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	http.Error(w, msg, http.StatusBadRequest)
+}
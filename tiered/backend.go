@@ -0,0 +1,240 @@
+package tiered
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/variant"
+)
+
+// Backend stacks a (presumably fast) local storage in front of a
+// remote storage. Reads are served from the local tier if possible,
+// and the local tier is populated from the remote tier as needed.
+type Backend struct {
+	local       Tier
+	presets     map[string]string
+	remote      Tier
+	transformer *transformer.Transformer
+}
+
+func NewBackend(local Storage, remote Storage, trans *transformer.Transformer, presets map[string]string) (*Backend, error) {
+	l, ok := local.(Tier)
+	if !ok {
+		return nil, errors.Errorf("tiered backend: local storage %T can not be used as a tier", local)
+	}
+	r, ok := remote.(Tier)
+	if !ok {
+		return nil, errors.Errorf("tiered backend: remote storage %T can not be used as a tier", remote)
+	}
+
+	return &Backend{
+		local:       l,
+		presets:     presets,
+		remote:      r,
+		transformer: trans,
+	}, nil
+}
+
+func (b *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	h, err := b.local.Get(ctx, u, preset)
+	if err == nil {
+		return h, nil
+	}
+
+	if !errors.IsTransformationRequired(err) {
+		// Something is wrong with the local tier, but we may still
+		// be able to serve from the remote tier
+		log.Debugf(ctx, "tiered backend: failed to serve from local tier: %s", err)
+	}
+
+	h, err = b.remote.Get(ctx, u, preset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.populate(ctx, u, preset, h); err != nil {
+		log.Debugf(ctx, "tiered backend: failed to populate local tier: %s", err)
+		return h, nil
+	}
+
+	// Serve from the local tier if we can, otherwise just let the
+	// remote tier handle it
+	if lh, err := b.local.Get(ctx, u, preset); err == nil {
+		return lh, nil
+	}
+	return h, nil
+}
+
+// populate fetches the content served by the remote tier, and stores
+// it in the local tier
+func (b *Backend) populate(ctx context.Context, u *url.URL, preset string, h http.Handler) error {
+	log.Debugf(ctx, "tiered backend: fetching %s (%s) to populate local tier", u, preset)
+	content, contentType, err := httputil.Fetch(ctx, h)
+	if err != nil {
+		return errors.Wrap(err, `failed to fetch content from remote tier`)
+	}
+
+	var md *variant.Metadata
+	if st, ok := b.remote.(Stater); ok {
+		if md, err = st.Stat(ctx, u, preset); err != nil {
+			log.Debugf(ctx, "tiered backend: failed to fetch metadata from remote tier: %s", err)
+		}
+	}
+	if md == nil {
+		// Still worth keeping the content around locally
+		md = &variant.Metadata{
+			Created:   time.Now(),
+			Preset:    preset,
+			SourceURL: u.String(),
+		}
+	}
+	if md.ContentType == "" {
+		md.ContentType = contentType
+	}
+
+	return b.local.Put(ctx, u, preset, md, content)
+}
+
+// ReadObject reads the object at p from the remote tier, which holds
+// everything
+func (b *Backend) ReadObject(ctx context.Context, p string) ([]byte, error) {
+	r, ok := b.remote.(ObjectReader)
+	if !ok {
+		return nil, errors.Errorf(`remote tier %T can not read objects`, b.remote)
+	}
+	return r.ReadObject(ctx, p)
+}
+
+// HealthCheck checks the health of the remote tier. Problems with the
+// local tier are only logged, as requests can still be served from
+// the remote tier
+func (b *Backend) HealthCheck(ctx context.Context) error {
+	if hc, ok := b.local.(HealthChecker); ok {
+		if err := hc.HealthCheck(ctx); err != nil {
+			log.Debugf(ctx, "tiered backend: local tier is unhealthy: %s", err)
+		}
+	}
+
+	if hc, ok := b.remote.(HealthChecker); ok {
+		return errors.Wrap(hc.HealthCheck(ctx), `remote tier is unhealthy`)
+	}
+	return nil
+}
+
+// Stat returns the metadata from the local tier if available, and
+// from the remote tier otherwise
+func (b *Backend) Stat(ctx context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	if st, ok := b.local.(Stater); ok {
+		if md, err := st.Stat(ctx, u, preset); err == nil {
+			return md, nil
+		}
+	}
+
+	st, ok := b.remote.(Stater)
+	if !ok {
+		return nil, errors.Errorf("tiered backend: remote storage %T does not record metadata", b.remote)
+	}
+	return st.Stat(ctx, u, preset)
+}
+
+// List returns the variants held by the remote tier, which holds
+// everything that the local tier does
+func (b *Backend) List(ctx context.Context, u *url.URL) ([]*variant.Metadata, error) {
+	l, ok := b.remote.(Lister)
+	if !ok {
+		return nil, errors.Errorf("tiered backend: remote storage %T can not list variants", b.remote)
+	}
+	return l.List(ctx, u)
+}
+
+// Walk walks the remote tier
+func (b *Backend) Walk(ctx context.Context, fn variant.WalkFunc) error {
+	w, ok := b.remote.(Walker)
+	if !ok {
+		return errors.Errorf("tiered backend: remote storage %T can not enumerate variants", b.remote)
+	}
+	return w.Walk(ctx, fn)
+}
+
+// StoreTransformedContent fetches the image at u once, transforms it
+// for each preset, and stores the same content in both tiers
+func (b *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+	log.Debugf(ctx, "tiered backend: transforming image at url %s", u)
+
+	src, err := b.transformer.Fetch(ctx, u.String())
+	if err != nil {
+		return errors.Wrap(err, `failed to fetch image`)
+	}
+
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	for preset, rule := range b.presets {
+		preset := preset
+		rule := rule
+		grp.Go(func() error {
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+
+			if err := b.transformer.TransformSource(ctx, rule, src, &res); err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+
+			md := res.Metadata(preset, rule, u.String())
+			if err := b.remote.Put(ctx, u, preset, md, buf.Bytes()); err != nil {
+				return errors.Wrap(err, `failed to store in remote tier`)
+			}
+
+			// The local tier is populated on demand anyway
+			if err := b.local.Put(ctx, u, preset, md, buf.Bytes()); err != nil {
+				log.Debugf(ctx, "tiered backend: failed to store in local tier: %s", err)
+			}
+			return nil
+		})
+	}
+	return grp.Wait()
+}
+
+func (b *Backend) Delete(ctx context.Context, u *url.URL) error {
+	var grp *errgroup.Group
+	grp, ctx = errgroup.WithContext(ctx)
+
+	grp.Go(func() error {
+		return errors.Wrap(b.remote.Delete(ctx, u), `failed to delete from remote tier`)
+	})
+	grp.Go(func() error {
+		// The local tier is just a cache, and it's perfectly normal for
+		// it not to have all the variants. Don't fail because of it
+		if err := b.local.Delete(ctx, u); err != nil {
+			log.Debugf(ctx, "tiered backend: failed to delete from local tier: %s", err)
+		}
+		return nil
+	})
+	return grp.Wait()
+}
+
+// Close closes the underlying storages, if they need to be closed
+func (b *Backend) Close() error {
+	var err error
+	for _, s := range []Storage{b.local, b.remote} {
+		if c, ok := s.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package tiered_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/memory"
+	"github.com/lestrrat-go/sharaq/tiered"
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// redirectStorage mimics cloud storage backends, which redirect
+// clients to the actual location of the content
+type redirectStorage struct {
+	location string
+	gets     int
+}
+
+func (s *redirectStorage) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	s.gets++
+	if s.location == "" {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return http.RedirectHandler(s.location, http.StatusFound), nil
+}
+func (s *redirectStorage) StoreTransformedContent(context.Context, *url.URL) error { return nil }
+func (s *redirectStorage) Delete(context.Context, *url.URL) error                  { return nil }
+func (s *redirectStorage) List(context.Context, *url.URL) ([]*variant.Metadata, error) {
+	return nil, nil
+}
+func (s *redirectStorage) Walk(context.Context, variant.WalkFunc) error { return nil }
+func (s *redirectStorage) Put(context.Context, *url.URL, string, *variant.Metadata, []byte) error {
+	return nil
+}
+func (s *redirectStorage) Stat(_ context.Context, u *url.URL, preset string) (*variant.Metadata, error) {
+	if s.location == "" {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return &variant.Metadata{ETag: "deadbeef", Preset: preset, SourceURL: u.String()}, nil
+}
+
+// readOnlyStorage can't store content that has already been transformed
+type readOnlyStorage struct {
+	tiered.Storage
+}
+
+func serve(h http.Handler) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return w.Code, string(body)
+}
+
+func TestBackend(t *testing.T) {
+	if _, err := tiered.NewBackend(readOnlyStorage{&redirectStorage{}}, &redirectStorage{}, nil, nil); !assert.Error(t, err, "NewBackend should fail if the local tier can't Put") {
+		return
+	}
+	if _, err := tiered.NewBackend(&redirectStorage{}, readOnlyStorage{&redirectStorage{}}, nil, nil); !assert.Error(t, err, "NewBackend should fail if the remote tier can't Put") {
+		return
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("Hello, World!"))
+	}))
+	defer srv.Close()
+
+	presets := map[string]string{"small": "100x100"}
+	local, err := memory.NewBackend(&memory.Config{}, nil, presets)
+	if !assert.NoError(t, err, "memory.NewBackend should succeed") {
+		return
+	}
+
+	remote := &redirectStorage{}
+	b, err := tiered.NewBackend(local, remote, transformer.New(), presets)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.png")
+
+	if _, err := b.Get(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "Get should require transformation") {
+		return
+	}
+
+	remote.location = srv.URL + "/small/foo.png"
+	for i := 0; i < 2; i++ {
+		h, err := b.Get(ctx, u, "small")
+		if !assert.NoError(t, err, "Get should succeed") {
+			return
+		}
+
+		// Content should always be served directly from the local tier
+		code, body := serve(h)
+		if !assert.Equal(t, http.StatusOK, code, "status should be 200") {
+			return
+		}
+		if !assert.Equal(t, "Hello, World!", body, "content should match") {
+			return
+		}
+	}
+
+	if !assert.Equal(t, 2, remote.gets, "remote tier should only be consulted until the local tier is populated") {
+		return
+	}
+
+	md, err := local.Stat(ctx, u, "small")
+	if !assert.NoError(t, err, "Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, "deadbeef", md.ETag, "metadata should be copied from the remote tier") {
+		return
+	}
+	if !assert.Equal(t, "image/png", md.ContentType, "content type should be taken from the response") {
+		return
+	}
+}
+
+func TestStoreTransformedContent(t *testing.T) {
+	var buf bytes.Buffer
+	if !assert.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 20, 20))), "png.Encode should succeed") {
+		return
+	}
+
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	presets := map[string]string{"small": "10x10", "tiny": "5x5"}
+	local, err := memory.NewBackend(&memory.Config{}, nil, presets)
+	if !assert.NoError(t, err, "memory.NewBackend should succeed") {
+		return
+	}
+	remote, err := memory.NewBackend(&memory.Config{}, nil, presets)
+	if !assert.NoError(t, err, "memory.NewBackend should succeed") {
+		return
+	}
+
+	b, err := tiered.NewBackend(local, remote, transformer.New(), presets)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse(srv.URL + "/foo.png")
+	if !assert.NoError(t, b.StoreTransformedContent(ctx, u), "StoreTransformedContent should succeed") {
+		return
+	}
+	if !assert.Equal(t, 1, fetches, "source image should be fetched once") {
+		return
+	}
+
+	for preset := range presets {
+		lmd, err := local.Stat(ctx, u, preset)
+		if !assert.NoError(t, err, "variant should be stored in the local tier") {
+			return
+		}
+		rmd, err := remote.Stat(ctx, u, preset)
+		if !assert.NoError(t, err, "variant should be stored in the remote tier") {
+			return
+		}
+		if !assert.Equal(t, rmd.ETag, lmd.ETag, "both tiers should hold the same content") {
+			return
+		}
+	}
+}
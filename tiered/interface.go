@@ -0,0 +1,61 @@
+package tiered
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/sharaq/variant"
+	"golang.org/x/net/context"
+)
+
+// Storage is what each tier must implement. It has the same
+// method set as sharaq.Backend
+type Storage interface {
+	Get(context.Context, *url.URL, string) (http.Handler, error)
+	StoreTransformedContent(context.Context, *url.URL) error
+	Delete(context.Context, *url.URL) error
+}
+
+// Stater is implemented by storages that record the metadata of the
+// variants they store
+type Stater interface {
+	Stat(context.Context, *url.URL, string) (*variant.Metadata, error)
+}
+
+// Lister is implemented by storages that can list the variants
+// created from an image
+type Lister interface {
+	List(context.Context, *url.URL) ([]*variant.Metadata, error)
+}
+
+// Walker is implemented by storages that can enumerate every variant
+// they store
+type Walker interface {
+	Walk(context.Context, variant.WalkFunc) error
+}
+
+// Putter is implemented by storages that can store content that has
+// already been transformed. Both tiers must implement this, so that
+// images are transformed once for both tiers, and so that the local
+// tier can be populated from the remote tier
+type Putter interface {
+	Put(ctx context.Context, u *url.URL, preset string, md *variant.Metadata, content []byte) error
+}
+
+// Tier is the interface for each tier
+type Tier interface {
+	Storage
+	Putter
+}
+
+// HealthChecker is implemented by storages that can check if they
+// are usable
+type HealthChecker interface {
+	HealthCheck(context.Context) error
+}
+
+// ObjectReader is implemented by storages that can read arbitrary
+// objects, such as overlay images
+type ObjectReader interface {
+	ReadObject(context.Context, string) ([]byte, error)
+}
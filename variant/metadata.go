@@ -0,0 +1,93 @@
+package variant
+
+import (
+	"strconv"
+	"time"
+)
+
+// Metadata describes a transformed image (a variant of the source
+// image) stored in a backend
+type Metadata struct {
+	ContentType string
+	Created     time.Time // when the variant was created
+	ETag        string    // hex encoded MD5 of the variant's content
+	Height      int
+	Path        string `json:",omitempty"` // where the variant is stored. Filled in by backends, not stored
+	Preset      string
+	Rule        string // the transformation rule used for the preset
+	Size        int64
+	SourceETag  string // ETag of the source image at the time of transformation, if any
+	SourceURL   string
+	Width       int
+}
+
+// Keys used by Encode/Decode. Backends that store metadata as
+// simple key/value pairs have different restrictions on what can
+// be used as keys, so these are kept as plain lowercase alphanumerics
+const (
+	CreatedKey    = "created"
+	ETagKey       = "etag"
+	HeightKey     = "height"
+	PresetKey     = "preset"
+	RuleKey       = "rule"
+	SourceETagKey = "sourceetag"
+	SourceURLKey  = "sourceurl"
+	WidthKey      = "width"
+)
+
+// Encode converts the metadata into key/value pairs, for backends
+// that store metadata as such (e.g. object metadata in S3).
+// ContentType and Size are not included, as backends keep track
+// of those on their own
+func (m *Metadata) Encode() map[string]string {
+	v := map[string]string{
+		CreatedKey:   m.Created.UTC().Format(time.RFC3339Nano),
+		PresetKey:    m.Preset,
+		RuleKey:      m.Rule,
+		SourceURLKey: m.SourceURL,
+	}
+	if m.ETag != "" {
+		v[ETagKey] = m.ETag
+	}
+	if m.SourceETag != "" {
+		v[SourceETagKey] = m.SourceETag
+	}
+	if m.Width > 0 {
+		v[WidthKey] = strconv.Itoa(m.Width)
+	}
+	if m.Height > 0 {
+		v[HeightKey] = strconv.Itoa(m.Height)
+	}
+	return v
+}
+
+// Decode populates the metadata from key/value pairs created by
+// Encode. Unknown keys, and values that can not be parsed are ignored
+func (m *Metadata) Decode(v map[string]string) {
+	for key, value := range v {
+		switch key {
+		case CreatedKey:
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				m.Created = t
+			}
+		case ETagKey:
+			m.ETag = value
+		case HeightKey:
+			if n, err := strconv.Atoi(value); err == nil {
+				m.Height = n
+			}
+		case PresetKey:
+			m.Preset = value
+		case RuleKey:
+			m.Rule = value
+		case SourceETagKey:
+			m.SourceETag = value
+		case SourceURLKey:
+			m.SourceURL = value
+		case WidthKey:
+			if n, err := strconv.Atoi(value); err == nil {
+				m.Width = n
+			}
+		}
+	}
+}
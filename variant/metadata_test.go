@@ -0,0 +1,72 @@
+package variant_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/variant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataEncodeDecode(t *testing.T) {
+	md := variant.Metadata{
+		Created:    time.Date(2017, 4, 1, 12, 34, 56, 0, time.UTC),
+		ETag:       "d41d8cd98f00b204e9800998ecf8427e",
+		Height:     100,
+		Preset:     "small",
+		Rule:       "100x100",
+		SourceETag: `"abc"`,
+		SourceURL:  "http://example.com/foo.png",
+		Width:      80,
+	}
+
+	var md2 variant.Metadata
+	md2.Decode(md.Encode())
+	if !assert.Equal(t, md, md2, "metadata should survive a round trip") {
+		return
+	}
+
+	md2.Decode(map[string]string{variant.WidthKey: "garbage", "unknown": "value"})
+	if !assert.Equal(t, 80, md2.Width, "bad values should be ignored") {
+		return
+	}
+}
+
+func TestStoreConfig(t *testing.T) {
+	c := variant.StoreConfig{
+		StoreOptions: variant.StoreOptions{
+			CacheControl: "public, max-age=86400",
+			StorageClass: "STANDARD",
+			Metadata:     map[string]string{"owner": "images", "preset": "bogus"},
+		},
+		Presets: map[string]variant.StoreOptions{
+			"big": {
+				StorageClass: "STANDARD_IA",
+				Metadata:     map[string]string{"tier": "cold"},
+			},
+		},
+	}
+
+	opts := c.Options("big")
+	if !assert.Equal(t, "public, max-age=86400", opts.CacheControl, "defaults should be inherited") {
+		return
+	}
+	if !assert.Equal(t, "STANDARD_IA", opts.StorageClass, "preset options should take precedence") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"owner": "images", "preset": "bogus", "tier": "cold"}, opts.Metadata, "metadata should be merged") {
+		return
+	}
+	if !assert.Len(t, c.Metadata, 2, "defaults should not be modified") {
+		return
+	}
+
+	md := variant.Metadata{Preset: "big"}
+	om := md.ObjectMetadata(opts)
+	if !assert.Equal(t, "big", om[variant.PresetKey], "variant metadata should take precedence") {
+		return
+	}
+	if !assert.Equal(t, "cold", om["tier"], "additional metadata should be included") {
+		return
+	}
+}
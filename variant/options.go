@@ -0,0 +1,61 @@
+package variant
+
+// StoreOptions specifies the properties of the objects that backends
+// write. Empty fields are left to the defaults of the storage
+type StoreOptions struct {
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string            // storage specific, e.g. "STANDARD_IA" for S3, "NEARLINE" for Google Storage, "Cool" for Azure
+	Metadata           map[string]string // additional object metadata. Keys should be lowercase alphanumerics
+}
+
+// Merge returns a copy of o, with the non-empty fields of other
+// taking precedence. Metadata is merged key by key
+func (o StoreOptions) Merge(other StoreOptions) StoreOptions {
+	if other.CacheControl != "" {
+		o.CacheControl = other.CacheControl
+	}
+	if other.ContentDisposition != "" {
+		o.ContentDisposition = other.ContentDisposition
+	}
+	if other.StorageClass != "" {
+		o.StorageClass = other.StorageClass
+	}
+	if len(other.Metadata) > 0 {
+		m := make(map[string]string, len(o.Metadata)+len(other.Metadata))
+		for k, v := range o.Metadata {
+			m[k] = v
+		}
+		for k, v := range other.Metadata {
+			m[k] = v
+		}
+		o.Metadata = m
+	}
+	return o
+}
+
+// StoreConfig holds the StoreOptions for a backend. The options given
+// for each preset are applied on top of the backend wide options
+type StoreConfig struct {
+	StoreOptions
+	Presets map[string]StoreOptions
+}
+
+// Options returns the options to use when storing objects for preset
+func (c *StoreConfig) Options(preset string) StoreOptions {
+	return c.StoreOptions.Merge(c.Presets[preset])
+}
+
+// ObjectMetadata returns the key/value pairs to be stored as object
+// metadata, which is the additional metadata in opts along with the
+// encoded variant metadata. The latter takes precedence
+func (m *Metadata) ObjectMetadata(opts StoreOptions) map[string]string {
+	v := make(map[string]string, len(opts.Metadata)+8)
+	for key, value := range opts.Metadata {
+		v[key] = value
+	}
+	for key, value := range m.Encode() {
+		v[key] = value
+	}
+	return v
+}
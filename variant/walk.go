@@ -0,0 +1,5 @@
+package variant
+
+// WalkFunc is called for each variant visited by Walk. If it returns
+// an error, walking stops and the error is returned from Walk
+type WalkFunc func(*Metadata) error